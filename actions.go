@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/term"
+)
+
+// --actions (tui.actions in the config) offers a line of keys below a
+// one-shot answer on a terminal: copy it, save it, ask again or follow up
+// on it in the chat. Any other key or three seconds without one dismiss it.
+
+const actionBarTimeout = 3 * time.Second
+
+type answerActions struct {
+	answer   string
+	retry    func() (string, error) // streams another answer
+	followUp func() error           // in the chat
+}
+
+func actionBarAvailable() bool {
+	caps := terminal()
+	return caps.Stdin && caps.Stdout && caps.Stderr && !plainOutput
+}
+
+// readActionKey waits for a single key press, false if none came in time
+func readActionKey(timeout time.Duration) (byte, bool) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return 0, false
+	}
+	defer term.Restore(fd, state)
+	return waitForKey(fd, timeout)
+}
+
+func (a *answerActions) run() error {
+	style := lipgloss.NewStyle().Faint(true)
+	for {
+		fmt.Fprint(os.Stderr, "\n"+style.Render("c copy · s save · r retry · f follow up in chat"))
+		key, _ := readActionKey(actionBarTimeout)
+		fmt.Fprint(os.Stderr, "\r\033[K")
+
+		switch key {
+		case 'c':
+			if err := putTextIntoClipboard(a.answer); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "copied the answer to the clipboard")
+		case 's':
+			path := "answer-" + time.Now().Format("20060102-150405") + ".md"
+			if err := os.WriteFile(path, []byte(a.answer+"\n"), 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "saved the answer to %s\n", path)
+		case 'r':
+			fmt.Println()
+			answer, err := a.retry()
+			if err != nil {
+				return err
+			}
+			a.answer = answer
+			continue
+		case 'f':
+			return a.followUp()
+		}
+		return nil
+	}
+}
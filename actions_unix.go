@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitForKey reads a byte of the terminal in raw mode unless none arrives in
+// time, leaving nothing behind reading stdin afterwards
+func waitForKey(fd int, timeout time.Duration) (byte, bool) {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil || n == 0 {
+			return 0, false
+		}
+		break
+	}
+	var buf [1]byte
+	if n, err := os.Stdin.Read(buf[:]); err != nil || n == 0 {
+		return 0, false
+	}
+	return buf[0], true
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// waitForKey reads a byte of the console in raw mode unless none arrives in
+// time, leaving nothing behind reading stdin afterwards
+func waitForKey(fd int, timeout time.Duration) (byte, bool) {
+	event, err := windows.WaitForSingleObject(windows.Handle(fd), uint32(timeout.Milliseconds()))
+	if err != nil || event != windows.WAIT_OBJECT_0 {
+		return 0, false
+	}
+	var buf [1]byte
+	if n, err := os.Stdin.Read(buf[:]); err != nil || n == 0 {
+		return 0, false
+	}
+	return buf[0], true
+}
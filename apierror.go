@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// failed requests are explained with what to do about them, below the
+// message of the provider
+
+type hintedError struct {
+	err  error
+	hint string
+}
+
+func (e *hintedError) Error() string {
+	return e.err.Error() + "\nhint: " + e.hint
+}
+
+func (e *hintedError) Unwrap() error {
+	return e.err
+}
+
+func withErrorHint(err error) error {
+	var hinted *hintedError
+	if err == nil || errors.As(err, &hinted) {
+		return err
+	}
+	if hint := errorHint(err); hint != "" {
+		return &hintedError{err: err, hint: hint}
+	}
+	return err
+}
+
+func errorHint(err error) string {
+	switch llmclient.ClassifyError(err) {
+	case llmclient.ErrAuth:
+		return "the API key was rejected, set it with -k, OPENAI_API_KEY or llm config init"
+	case llmclient.ErrRateLimit:
+		return "the provider limits the requests, try again in a moment; requests.<model>.retries in the config waits and retries"
+	case llmclient.ErrQuota:
+		return "the account is out of credits or over its quota, see the billing page of the provider"
+	case llmclient.ErrContextLength:
+		return contextLengthHint(err)
+	case llmclient.ErrContentFilter:
+		return "the content filter of the provider blocked the request or the answer, rephrase it"
+	case llmclient.ErrNetwork:
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			if u, perr := url.Parse(urlErr.URL); perr == nil {
+				return fmt.Sprintf("%s can't be reached, check the connection and --api-base (api_base in the config)", u.Host)
+			}
+		}
+		return "the API can't be reached, check the connection and --api-base (api_base in the config)"
+	case llmclient.ErrTimeout:
+		return "the API didn't answer in time, try again"
+	}
+	return ""
+}
+
+var (
+	// OpenAI, vLLM: maximum context length is 16385 tokens. However, your messages resulted in 20012 tokens
+	openAIContextRe = regexp.MustCompile(`maximum context length is (\d+) tokens.*?(?:resulted in|requested) (\d+) tokens`)
+	// Anthropic: prompt is too long: 210000 tokens > 200000 maximum
+	anthropicContextRe = regexp.MustCompile(`(\d+) tokens > (\d+) maximum`)
+)
+
+func contextLengthHint(err error) string {
+	advice := "try --summarize-overflow, fewer -f files or a model with a larger context window"
+
+	message := err.Error()
+	var window, prompt int
+	if m := openAIContextRe.FindStringSubmatch(message); m != nil {
+		window, _ = strconv.Atoi(m[1])
+		prompt, _ = strconv.Atoi(m[2])
+	} else if m := anthropicContextRe.FindStringSubmatch(message); m != nil {
+		prompt, _ = strconv.Atoi(m[1])
+		window, _ = strconv.Atoi(m[2])
+	}
+	if window > 0 && prompt > 0 {
+		return fmt.Sprintf("the context window of the model is %d tokens, the request %d; %s", window, prompt, advice)
+	}
+	return "the request doesn't fit in the context window of the model, " + advice
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// llm batch runs one request per input file or manifest line with bounded
+// concurrency. Answers go to a directory (one file per input) or to JSONL in
+// the order of the inputs, the usage and cost of the whole batch are summed
+// up at the end.
+
+type batchItem struct {
+	ID     string `json:"id"`
+	Prompt string `json:"prompt,omitempty"`
+	Input  string `json:"input,omitempty"` // file sent along with the prompt
+}
+
+type batchResult struct {
+	ID      string           `json:"id"`
+	Input   string           `json:"input,omitempty"`
+	Output  string           `json:"output"`
+	Error   string           `json:"error,omitempty"`
+	Usage   *llmclient.Usage `json:"usage,omitempty"`
+	CostUSD *float64         `json:"cost_usd,omitempty"`
+}
+
+func newBatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "batch [input files]",
+		Short: "Run the prompt over many inputs concurrently, writing the answers to a directory or JSONL",
+		Example: `  llm batch --prompt "summarize" a.txt b.txt --out-dir summaries
+  llm batch --manifest prompts.jsonl -P 8 --jsonl answers.jsonl`,
+		GroupID: "chat",
+		RunE:    runBatch,
+	}
+
+	cmd.Flags().StringSliceP("input", "i", []string{}, "Input files, each sent with the prompt in a request of its own (also taken from the arguments)")
+	cmd.Flags().StringP("prompt", "p", "", "Instruction applied to every input")
+	cmd.Flags().String("system", "", "System prompt of every request")
+	cmd.Flags().String("manifest", "", `JSONL file with a request per line, {"id": ..., "prompt": ..., "input": file} with all fields optional; plain text lines are prompts`)
+	cmd.Flags().IntP("concurrency", "P", 4, "Number of requests in flight")
+	cmd.Flags().StringP("out-dir", "o", "", "Write each answer to <dir>/<id>.md")
+	cmd.Flags().String("jsonl", "", "Write the answers as JSONL to this file, - for stdout (the default without --out-dir)")
+	cmd.Flags().IntP("max_tokens", "N", 4096, "Max amount of tokens in each response")
+
+	return cmd
+}
+
+func runBatch(cmd *cobra.Command, args []string) error {
+	inputs, _ := cmd.Flags().GetStringSlice("input")
+	prompt, _ := cmd.Flags().GetString("prompt")
+	system, _ := cmd.Flags().GetString("system")
+	manifest, _ := cmd.Flags().GetString("manifest")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	outDir, _ := cmd.Flags().GetString("out-dir")
+	jsonlPath, _ := cmd.Flags().GetString("jsonl")
+	maxTokens, _ := cmd.Flags().GetInt("max_tokens")
+
+	modelname := getModelName(cmd)
+	seed, _ := cmd.Flags().GetInt("seed")
+	temperature, _ := cmd.Flags().GetFloat64("temperature")
+	apiKey, apiBase := configuredAPI(cmd)
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	noInstructions, _ := cmd.Flags().GetBool("no-instructions")
+
+	if concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+
+	var items []batchItem
+	for _, path := range append(inputs, args...) {
+		items = append(items, batchItem{Input: path})
+	}
+	if manifest != "" {
+		manifestItems, err := readBatchManifest(manifest)
+		if err != nil {
+			return err
+		}
+		items = append(items, manifestItems...)
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("nothing to do, give input files or a --manifest")
+	}
+	if prompt == "" && manifest == "" {
+		return fmt.Errorf("--prompt is required with input files")
+	}
+	assignBatchIDs(items)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if !noInstructions {
+		instructions, err := loadProjectInstructions(cfg)
+		if err != nil {
+			return err
+		}
+		system = appendSystemPrompt(system, instructions)
+	}
+	cache, err := openResponseCache(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer
+	if jsonlPath == "-" || (jsonlPath == "" && outDir == "") {
+		out = os.Stdout
+	} else if jsonlPath != "" {
+		f, err := os.Create(jsonlPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	session := newSession()
+	extra := map[string]interface{}{"max_tokens": maxTokens}
+
+	run := func(item batchItem) batchResult {
+		res := batchResult{ID: item.ID, Input: item.Input}
+
+		parts := map[string]string{"prompt": strings.TrimSpace(prompt + "\n\n" + item.Prompt)}
+		if item.Input != "" {
+			files, err := contextbuilder.FormatFiles([]string{item.Input}, "md")
+			if err != nil {
+				res.Error = err.Error()
+				return res
+			}
+			parts["files"] = files
+		}
+		var messages []llmclient.Message
+		if strings.TrimSpace(system) != "" {
+			messages = append(messages, llmclient.Message{Role: "system", Content: system})
+		}
+		messages = append(messages, llmclient.Message{Role: "user", Content: contextbuilder.Compose([]string{"prompt", "files"}, parts)})
+
+		usage := newUsageReporter(cfg, session, modelname)
+		ch, err := llmclient.Chat(messages, modelname, seed, temperature, nil, apiKey, apiBase, false, extra, verbose, usage.Record, cache, cfg.Hooks, requestMiddlewares(cfg, modelname)...)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		var answer strings.Builder
+		for content := range ch {
+			answer.WriteString(content)
+		}
+		res.Output = answer.String()
+
+		if usage.last != nil {
+			res.Usage = usage.last
+			if cost, known := estimateCost(cfg, modelname, *usage.last); known {
+				res.CostUSD = &cost
+			}
+		}
+		return res
+	}
+
+	results := make([]chan batchResult, len(items))
+	for i := range results {
+		results[i] = make(chan batchResult, 1)
+	}
+
+	progress := newBatchProgress(len(items))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res := run(item)
+			progress.done(res)
+			results[i] <- res
+		}()
+	}
+
+	// results are written in the order of the inputs
+	var total llmclient.Usage
+	var totalCost float64
+	costKnown := true
+	failed := 0
+	for i := range items {
+		res := <-results[i]
+
+		if res.Error != "" {
+			failed++
+		}
+		if res.Usage != nil {
+			total.PromptTokens += res.Usage.PromptTokens
+			total.CompletionTokens += res.Usage.CompletionTokens
+			total.TotalTokens += res.Usage.TotalTokens
+			total.Estimated = total.Estimated || res.Usage.Estimated
+		}
+		if res.CostUSD != nil {
+			totalCost += *res.CostUSD
+		} else if res.Error == "" {
+			costKnown = false
+		}
+
+		if outDir != "" && res.Error == "" {
+			if err := os.WriteFile(filepath.Join(outDir, res.ID+".md"), []byte(res.Output), 0644); err != nil {
+				return err
+			}
+		}
+		if out != nil {
+			line, err := json.Marshal(res)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(out, "%s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+	wg.Wait()
+	progress.finish()
+
+	approx := ""
+	if total.Estimated {
+		approx = "~"
+	}
+	summary := fmt.Sprintf("batch: %d of %d done, %s%d in / %s%d out tokens", len(items)-failed, len(items), approx, total.PromptTokens, approx, total.CompletionTokens)
+	if costKnown {
+		summary += fmt.Sprintf(", cost %s$%.6f", approx, totalCost)
+	} else {
+		summary += fmt.Sprintf(", cost unknown, no pricing for %s", modelname)
+	}
+	fmt.Fprintln(os.Stderr, summary)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", failed, len(items))
+	}
+	return nil
+}
+
+func readBatchManifest(path string) ([]batchItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []batchItem
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "{") {
+			items = append(items, batchItem{Prompt: line})
+			continue
+		}
+
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &raw); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		var item batchItem
+		switch id := raw["id"].(type) {
+		case string:
+			item.ID = id
+		case float64:
+			item.ID = strconv.FormatFloat(id, 'f', -1, 64)
+		}
+		item.Prompt, _ = raw["prompt"].(string)
+		item.Input, _ = raw["input"].(string)
+		if item.Prompt == "" && item.Input == "" {
+			return nil, fmt.Errorf("%s:%d: neither prompt nor input", path, n)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// assignBatchIDs names the items without an id after their input file or
+// their position, the ids are unique and usable as file names
+func assignBatchIDs(items []batchItem) {
+	seen := map[string]bool{}
+	for i := range items {
+		id := items[i].ID
+		if id == "" && items[i].Input != "" {
+			id = strings.TrimSuffix(filepath.Base(items[i].Input), filepath.Ext(items[i].Input))
+		}
+		if id == "" {
+			id = strconv.Itoa(i + 1)
+		}
+		id = strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' || r == 0 {
+				return '_'
+			}
+			return r
+		}, id)
+
+		unique := id
+		for n := 2; seen[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", id, n)
+		}
+		seen[unique] = true
+		items[i].ID = unique
+	}
+}
+
+// batchProgress keeps a status line on a terminal, elsewhere it logs the
+// failures only
+type batchProgress struct {
+	mu                      sync.Mutex
+	total, finished, failed int
+	live                    bool
+}
+
+func newBatchProgress(total int) *batchProgress {
+	p := &batchProgress{total: total, live: terminal().StatusLine()}
+	p.render()
+	return p
+}
+
+func (p *batchProgress) render() {
+	if p.live {
+		fmt.Fprintf(os.Stderr, "\r\033[Kbatch: %d/%d done, %d failed", p.finished, p.total, p.failed)
+	}
+}
+
+func (p *batchProgress) done(res batchResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.finished++
+	if res.Error != "" {
+		p.failed++
+		if p.live {
+			fmt.Fprint(os.Stderr, "\r\033[K")
+		}
+		fmt.Fprintf(os.Stderr, "batch: %s failed: %s\n", res.ID, res.Error)
+	}
+	p.render()
+}
+
+func (p *batchProgress) finish() {
+	if p.live {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+const defaultCacheTTL = 24 * time.Hour
+
+type CacheConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	TTL     string `yaml:"ttl"` // Go duration, e.g. 1h or 720h
+}
+
+func cacheDirPath() (string, error) {
+	configDir, err := historyDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "cache"), nil
+}
+
+// openResponseCache returns nil when caching is disabled for this invocation
+func openResponseCache(cmd *cobra.Command, cfg *Config) (*llmclient.Cache, error) {
+	enabled := cfg.Cache.Enabled
+	if useCache, _ := cmd.Flags().GetBool("cache"); useCache {
+		enabled = true
+	}
+	if noCache, _ := cmd.Flags().GetBool("no-cache"); noCache {
+		enabled = false
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	ttl := defaultCacheTTL
+	if cfg.Cache.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(cfg.Cache.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("cache.ttl: %w", err)
+		}
+	}
+
+	dir, err := cacheDirPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return llmclient.NewCache(dir, ttl), nil
+}
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "cache",
+		Short:   "Manage the response cache",
+		GroupID: "data",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "Delete all cached responses",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := cacheDirPath()
+			if err != nil {
+				return err
+			}
+			return os.RemoveAll(dir)
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// --check "criterion" judges the answer with a second request and sets the
+// exit status like grep: 0 when the criterion holds, 1 when it doesn't, 2 on
+// errors, so a CI step can be gated on e.g. "does this diff break the API?"
+
+const checkSystemText = `You decide whether a criterion holds for a request and the response to it. The criterion is a statement or a yes/no question, it holds when the statement is true or the answer to the question is yes. Reply with a JSON object only: {"pass": true or false, "reason": "one sentence"}`
+
+// exitError ends the program with code, err is reported as usual if set
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+type checkVerdict struct {
+	Pass   bool   `json:"pass"`
+	Reason string `json:"reason"`
+}
+
+func judgeResponse(cfg *Config, model string, seed int, apiKey, apiBase string, verbose bool, usage *usageReporter, request, response, criterion string) (checkVerdict, error) {
+	messages := []llmclient.Message{
+		{Role: "system", Content: checkSystemText},
+		{Role: "user", Content: fmt.Sprintf("Criterion: %s\n\nRequest:\n%s\n\nResponse:\n%s", criterion, request, response)},
+	}
+
+	ch, err := llmclient.Chat(messages, model, seed, 0, nil, apiKey, apiBase, false, map[string]interface{}{"max_tokens": 512}, verbose, usage.Record, nil, cfg.Hooks, requestMiddlewares(cfg, model)...)
+	if err != nil {
+		return checkVerdict{}, err
+	}
+	var out strings.Builder
+	for content := range ch {
+		out.WriteString(content)
+	}
+
+	return parseVerdict(out.String())
+}
+
+// parseVerdict reads the JSON verdict, also when it's wrapped in prose or
+// a code block, and falls back to a leading PASS/FAIL or yes/no
+func parseVerdict(text string) (checkVerdict, error) {
+	var v checkVerdict
+	if start, end := strings.Index(text, "{"), strings.LastIndex(text, "}"); start >= 0 && end > start {
+		var raw map[string]interface{}
+		if json.Unmarshal([]byte(text[start:end+1]), &raw) == nil {
+			if pass, ok := raw["pass"].(bool); ok {
+				v.Pass = pass
+				v.Reason, _ = raw["reason"].(string)
+				return v, nil
+			}
+		}
+	}
+
+	if fields := strings.Fields(text); len(fields) > 0 {
+		switch strings.ToLower(strings.Trim(fields[0], ".,:!*\"'`")) {
+		case "pass", "yes", "true":
+			return checkVerdict{Pass: true, Reason: strings.TrimSpace(text)}, nil
+		case "fail", "no", "false":
+			return checkVerdict{Pass: false, Reason: strings.TrimSpace(text)}, nil
+		}
+	}
+	return v, fmt.Errorf("the judge gave no verdict: %s", strings.TrimSpace(text))
+}
+
+// printVerdict reports on stderr, stdout has the answer
+func printVerdict(v checkVerdict) {
+	status := "PASS"
+	if !v.Pass {
+		status = "FAIL"
+	}
+	if v.Reason != "" {
+		fmt.Fprintf(os.Stderr, "check: %s, %s\n", status, v.Reason)
+	} else {
+		fmt.Fprintf(os.Stderr, "check: %s\n", status)
+	}
+}
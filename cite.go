@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// --cite numbers the -f files and asks the model to cite them as [n], the
+// citations of an answer are listed with their paths below it
+
+const citeSystemText = "The provided files are numbered [1], [2], ... Cite the files each claim is based on right after it with their numbers in square brackets, e.g. [2] or [1][3]. Don't cite anything else this way."
+
+var citationRe = regexp.MustCompile(`\[(\d+)\]`)
+
+// citationFooter lists the sources cited in answer, empty if none of them is
+func citationFooter(answer string, sources []string) string {
+	if len(sources) == 0 {
+		return ""
+	}
+
+	cited := map[int]bool{}
+	for _, m := range citationRe.FindAllStringSubmatch(answer, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil && n >= 1 && n <= len(sources) {
+			cited[n] = true
+		}
+	}
+	if len(cited) == 0 {
+		return ""
+	}
+
+	nums := make([]int, 0, len(cited))
+	for n := range cited {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	var ret strings.Builder
+	ret.WriteString("Sources:\n")
+	for _, n := range nums {
+		fmt.Fprintf(&ret, "[%d] %s\n", n, sources[n-1])
+	}
+	return strings.TrimRight(ret.String(), "\n")
+}
+
+// withCitationFooters adds the footer to the assistant messages for display
+func withCitationFooters(msgs []Message, sources []string) []Message {
+	if len(sources) == 0 {
+		return msgs
+	}
+	ret := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		ret[i] = msg
+		if msg.Role != "assistant" {
+			continue
+		}
+		if footer := citationFooter(msg.Content, sources); footer != "" {
+			// a markdown list keeps the lines apart when rendered
+			ret[i].Content = strings.TrimRight(msg.Content, " \t\r\n") + "\n\n" + strings.ReplaceAll(footer, "\n[", "\n- [")
+		}
+	}
+	return ret
+}
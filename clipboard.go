@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/atotto/clipboard"
+)
+
+// the clipboard library only handles text, images are read with the
+// platform tools
+const windowsClipboardImageScript = `Add-Type -AssemblyName System.Windows.Forms, System.Drawing
+$img = [Windows.Forms.Clipboard]::GetImage()
+if ($img) {
+	$ms = New-Object IO.MemoryStream
+	$img.Save($ms, [Drawing.Imaging.ImageFormat]::Png)
+	[Convert]::ToBase64String($ms.ToArray())
+}`
+
+// readClipboardImage returns the clipboard image as PNG, or nil when the
+// clipboard holds no image or no tool to read it is installed
+func readClipboardImage() ([]byte, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		// fails when the clipboard has no image
+		out, err := exec.Command("osascript", "-e", "the clipboard as «class PNGf»").Output()
+		if err != nil {
+			return nil, nil
+		}
+		return parseAppleScriptData(string(out))
+	case "windows":
+		out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsClipboardImageScript).Output()
+		if err != nil {
+			return nil, err
+		}
+		encoded := strings.TrimSpace(string(out))
+		if encoded == "" {
+			return nil, nil
+		}
+		return base64.StdEncoding.DecodeString(encoded)
+	default:
+		if _, err := exec.LookPath("wl-paste"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+			types, err := exec.Command("wl-paste", "--list-types").Output()
+			if err != nil || !hasLine(types, "image/png") {
+				return nil, nil
+			}
+			return exec.Command("wl-paste", "--no-newline", "--type", "image/png").Output()
+		}
+		if _, err := exec.LookPath("xclip"); err == nil {
+			targets, err := exec.Command("xclip", "-selection", "clipboard", "-t", "TARGETS", "-o").Output()
+			if err != nil || !hasLine(targets, "image/png") {
+				return nil, nil
+			}
+			return exec.Command("xclip", "-selection", "clipboard", "-t", "image/png", "-o").Output()
+		}
+		return nil, nil
+	}
+}
+
+func hasLine(out []byte, line string) bool {
+	for _, l := range bytes.Split(out, []byte("\n")) {
+		if string(bytes.TrimSpace(l)) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAppleScriptData decodes osascript's «data PNGf89504E47...» output
+func parseAppleScriptData(out string) ([]byte, error) {
+	start := strings.Index(out, "«data PNGf")
+	end := strings.LastIndex(out, "»")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("unexpected osascript output")
+	}
+	return hex.DecodeString(out[start+len("«data PNGf") : end])
+}
+
+// readClipboard returns either the clipboard image as a data URL or its text
+func readClipboard() (text string, image string, err error) {
+	png, err := readClipboardImage()
+	if err != nil {
+		return "", "", err
+	}
+	if len(png) > 0 {
+		if caps := terminal(); caps.Stderr && !caps.CI {
+			showImage(os.Stderr, png, caps.Images, 40)
+		}
+		return "", "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+	}
+
+	text, err = clipboard.ReadAll()
+	return text, "", err
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+type ModelPricing struct {
+	Input  float64 `yaml:"input"`  // $ per 1M prompt tokens
+	Output float64 `yaml:"output"` // $ per 1M completion tokens
+
+	CachedInput float64 `yaml:"cached_input"` // $ per 1M prompt tokens read from the provider's cache, default input
+}
+
+type BudgetConfig struct {
+	DailyUSD float64 `yaml:"daily_usd"`
+	OnExceed string  `yaml:"on_exceed"` // warn|block
+}
+
+type LoggingConfig struct {
+	Dir   string `yaml:"dir"`   // a file per API request with the raw response, for debugging providers
+	Level string `yaml:"level"` // debug, info or warn (default) of the messages on stderr
+}
+
+type Config struct {
+	Provider string `yaml:"provider"` // set by llm config init, names the keyring entry of the API key
+	Model    string `yaml:"model"`
+	APIBase  string `yaml:"api_base"`
+	APIKey   string `yaml:"api_key"` // only when the system keyring is unavailable
+
+	Aliases map[string]string `yaml:"aliases"` // short names of models, for -m and llm serve
+
+	Pricing   map[string]ModelPricing    `yaml:"pricing"`
+	Budget    BudgetConfig               `yaml:"budget"`
+	Cache     CacheConfig                `yaml:"cache"`
+	Hooks     llmclient.Hooks            `yaml:"hooks"`
+	Memory    MemoryConfig               `yaml:"memory"`
+	Tasks     map[string]TaskPreset      `yaml:"tasks"`
+	Pipelines map[string][]PipelineStage `yaml:"pipelines"`
+	Contexts  map[string]ContextPreset   `yaml:"contexts"`
+	TUI       TUIConfig                  `yaml:"tui"`
+	History   HistoryConfig              `yaml:"history"`
+
+	InjectDatetime bool   `yaml:"inject_datetime"`
+	Lang           string `yaml:"lang"` // answer language, see --lang
+
+	ContextLayout map[string]string `yaml:"context_layout"` // per model, "default" for the others
+
+	ContextWindows map[string]int           `yaml:"context_windows"` // tokens per model, for --summarize-overflow
+	Requests       map[string]RequestConfig `yaml:"requests"`        // per model, "default" for the others
+	Summarize      SummarizeConfig          `yaml:"summarize"`
+
+	Instructions InstructionsConfig `yaml:"instructions"`
+	StackTrace   StackTraceConfig   `yaml:"stacktrace"`
+
+	LocalServers map[string]LocalServerConfig `yaml:"local_servers"` // started on demand
+
+	Notion NotionConfig `yaml:"notion"` // llm history export --format notion
+
+	Logging LoggingConfig `yaml:"logging"`
+}
+
+// applyLogDir makes the client log the API requests into --log-dir or
+// logging.dir
+func applyLogDir(cmd *cobra.Command) {
+	dir, _ := cmd.Flags().GetString("log-dir")
+	if !cmd.Flags().Changed("log-dir") && !isConfigCmd(cmd) {
+		if cfg, err := loadConfig(); err == nil {
+			dir = cfg.Logging.Dir
+		}
+	}
+	llmclient.TranscriptDir = expandLaunchArg(dir)
+}
+
+// resolveAlias returns the model an alias of the config stands for, other
+// names as they are
+func resolveAlias(cfg *Config, model string) string {
+	if cfg == nil {
+		return model
+	}
+	if target := cfg.Aliases[model]; target != "" {
+		return target
+	}
+	return model
+}
+
+// lookupModelKey finds the entry of a model in tables keyed by model names
+// or their prefixes: the exact name in the first table having it, else the
+// longest prefix in the first table having one
+func lookupModelKey[T any](model string, tables ...map[string]T) (key string, table int, ok bool) {
+	for i, t := range tables {
+		if _, ok := t[model]; ok {
+			return model, i, true
+		}
+	}
+
+	for i, t := range tables {
+		best := ""
+		for name := range t {
+			if strings.HasPrefix(model, name) && len(name) > len(best) {
+				best = name
+			}
+		}
+		if best != "" {
+			return best, i, true
+		}
+	}
+
+	return "", 0, false
+}
+
+func configFilePath() (string, error) {
+	configDir, err := historyDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "config.yaml"), nil
+}
+
+// loadConfig reads the config once per process, callers must not modify
+// the returned Config. Unknown keys are reported as warnings, yaml.v3
+// would silently ignore a typo like api_bse.
+var loadConfig = sync.OnceValues(func() (*Config, error) {
+	cfg, err := readConfig()
+	if err == nil {
+		warnUnknownConfigKeys()
+	}
+	return cfg, err
+})
+
+func warnUnknownConfigKeys() {
+	if node, err := readTeamConfig(); err == nil && node != nil {
+		for _, problem := range teamConfigProblems(node) {
+			slog.Warn("team config: " + problem)
+		}
+	}
+
+	configFile, err := configFilePath()
+	if err != nil {
+		return
+	}
+	data, err := readConfigFile()
+	if err != nil {
+		return
+	}
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Content) == 0 {
+		return
+	}
+	for _, problem := range unknownConfigKeys(doc.Content[0], reflect.TypeOf(Config{}), "") {
+		slog.Warn(configFile + ": " + problem)
+	}
+}
+
+// readConfig reads the config file, long running commands (serve) use it to
+// pick up changes without a restart
+func readConfig() (*Config, error) {
+	cfg := &Config{}
+
+	// the personal config overrides what the team shares
+	if err := applyTeamConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	data, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func readConfigFile() ([]byte, error) {
+	configFile, err := configFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// yamlFields maps the yaml keys of a config section to their types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	return fields
+}
+
+// similarKey returns the valid key closest to a misspelled one, or "" when
+// none is close enough to be a likely typo
+func similarKey(key string, fields map[string]reflect.Type) string {
+	best, bestDist := "", len(key)/3+1
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDist || d == bestDist && best != "" && name < best {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// unknownKeyMessage suggests the likely intended key, or lists the valid ones
+func unknownKeyMessage(prefix, key string, fields map[string]reflect.Type) string {
+	if similar := similarKey(key, fields); similar != "" {
+		return fmt.Sprintf("unknown key %q, did you mean %q?", joinKey(prefix, key), joinKey(prefix, similar))
+	}
+	in := ""
+	if prefix != "" {
+		in = " in " + prefix
+	}
+	return fmt.Sprintf("unknown key %q, valid keys%s: %s", joinKey(prefix, key), in, validKeys(fields))
+}
+
+func validKeys(fields map[string]reflect.Type) string {
+	var keys []string
+	for name := range fields {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// resolveConfigKey splits a dotted key like budget.daily_usd into the yaml
+// keys along its path and returns the type of the value. Map keys (model and
+// task names) may contain dots themselves, the shortest one leaving a valid
+// rest wins.
+func resolveConfigKey(t reflect.Type, segs []string, prefix string) ([]string, reflect.Type, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if len(segs) == 0 {
+		return nil, t, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := yamlFields(t)
+		ft, ok := fields[segs[0]]
+		if !ok {
+			return nil, nil, errors.New(unknownKeyMessage(prefix, segs[0], fields))
+		}
+		rest, vt, err := resolveConfigKey(ft, segs[1:], joinKey(prefix, segs[0]))
+		if err != nil {
+			return nil, nil, err
+		}
+		return append([]string{segs[0]}, rest...), vt, nil
+	case reflect.Map:
+		var firstErr error
+		for i := 1; i <= len(segs); i++ {
+			key := strings.Join(segs[:i], ".")
+			rest, vt, err := resolveConfigKey(t.Elem(), segs[i:], joinKey(prefix, key))
+			if err == nil {
+				return append([]string{key}, rest...), vt, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, nil, firstErr
+	default:
+		return nil, nil, fmt.Errorf("%s has no key %q", prefix, segs[0])
+	}
+}
+
+// mappingValue returns the value node of key in a yaml mapping
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// unknownConfigKeys walks the config file against the Config struct, yaml.v3
+// silently ignores unknown keys so a typo would just go unnoticed
+func unknownConfigKeys(node *yaml.Node, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var problems []string
+	if node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice {
+		// items of lists like pipelines.<name>
+		for i, item := range node.Content {
+			problems = append(problems, unknownConfigKeys(item, t.Elem(), joinKey(prefix, strconv.Itoa(i)))...)
+		}
+		return problems
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := yamlFields(t)
+			ft, ok := fields[key.Value]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("line %d: %s", key.Line, unknownKeyMessage(prefix, key.Value, fields)))
+				continue
+			}
+			problems = append(problems, unknownConfigKeys(value, ft, joinKey(prefix, key.Value))...)
+		case reflect.Map:
+			problems = append(problems, unknownConfigKeys(value, t.Elem(), joinKey(prefix, key.Value))...)
+		}
+	}
+
+	return problems
+}
+
+// configProblems lists syntax errors, unknown keys and invalid values of a
+// config file
+func configProblems(data []byte) []string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []string{err.Error()}
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	problems := unknownConfigKeys(doc.Content[0], reflect.TypeOf(Config{}), "")
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return append(problems, typeErr.Errors...)
+		}
+		return append(problems, err.Error())
+	}
+
+	oneOf := func(key, value string, allowed ...string) {
+		if value != "" && !slices.Contains(allowed, value) {
+			problems = append(problems, fmt.Sprintf("%s: invalid value %q, use %s", key, value, strings.Join(allowed, " or ")))
+		}
+	}
+	oneOf("budget.on_exceed", cfg.Budget.OnExceed, "warn", "block")
+	oneOf("history.fsync", cfg.History.Fsync, "never", "always")
+	oneOf("tui.renderer", cfg.TUI.Renderer, "go-term-markdown", "glamour")
+	oneOf("tui.status.spinner", cfg.TUI.Status.Spinner, statusSpinnerNames()...)
+
+	if cfg.Cache.TTL != "" {
+		if _, err := time.ParseDuration(cfg.Cache.TTL); err != nil {
+			problems = append(problems, fmt.Sprintf("cache.ttl: %s", err))
+		}
+	}
+	for model, layout := range cfg.ContextLayout {
+		if _, err := contextbuilder.ParseLayout(layout); err != nil {
+			problems = append(problems, fmt.Sprintf("context_layout.%s: %s", model, err))
+		}
+	}
+	for model, window := range cfg.ContextWindows {
+		if window <= 0 {
+			problems = append(problems, fmt.Sprintf("context_windows.%s: must be positive", model))
+		}
+	}
+	for model, rc := range cfg.Requests {
+		if rc.Retries < 0 {
+			problems = append(problems, fmt.Sprintf("requests.%s.retries: must not be negative", model))
+		}
+		if rc.RetryBackoff != "" {
+			if _, err := time.ParseDuration(rc.RetryBackoff); err != nil {
+				problems = append(problems, fmt.Sprintf("requests.%s.retry_backoff: %s", model, err))
+			}
+		}
+	}
+	if cfg.Summarize.ChunkTokens < 0 {
+		problems = append(problems, "summarize.chunk_tokens: must not be negative")
+	}
+	if cfg.StackTrace.Frames < 0 {
+		problems = append(problems, "stacktrace.frames: must not be negative")
+	}
+	for name, srv := range cfg.LocalServers {
+		if srv.APIBase == "" || (srv.LaunchCmd == "") == (srv.Binary == "") {
+			problems = append(problems, fmt.Sprintf("local_servers.%s: needs api_base and either launch_cmd or binary", name))
+		}
+		for key, value := range map[string]string{"startup_timeout": srv.StartupTimeout, "idle_shutdown": srv.IdleShutdown} {
+			if value != "" {
+				if _, err := time.ParseDuration(value); err != nil {
+					problems = append(problems, fmt.Sprintf("local_servers.%s.%s: %s", name, key, err))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// reloadConfig rereads and validates the config file for a running chat
+func reloadConfig() (*Config, error) {
+	data, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if problems := configProblems(data); len(problems) > 0 {
+		return nil, fmt.Errorf("config: %s", strings.Join(problems, "; "))
+	}
+	return readConfig()
+}
+
+func writeConfigFile(data []byte) error {
+	configFile, err := configFilePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configFile), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(configFile, data, 0o644)
+}
+
+// setConfigValue sets the value under keys in the yaml document, creating
+// missing sections and keeping comments and the order of existing keys
+func setConfigValue(doc *yaml.Node, keys []string, value *yaml.Node) {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+
+	node := doc.Content[0]
+	for i, key := range keys {
+		last := i == len(keys)-1
+
+		child := mappingValue(node, key)
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+		}
+
+		if last {
+			*child = *value
+			return
+		}
+		if child.Kind != yaml.MappingNode {
+			*child = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		node = child
+	}
+}
+
+// marshalYAML indents like the examples in the README
+func marshalYAML(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "config",
+		Short:   "Read, change and validate ~/.config/llmcli/config.yaml",
+		GroupID: "data",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get [key]",
+		Short: "Print a config value (e.g. budget.daily_usd, tasks.code), or the whole config",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := readConfigFile()
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				fmt.Print(string(data))
+				return nil
+			}
+
+			keys, _, err := resolveConfigKey(reflect.TypeOf(Config{}), strings.Split(args[0], "."), "")
+			if err != nil {
+				return err
+			}
+
+			var doc yaml.Node
+			if err := yaml.Unmarshal(data, &doc); err != nil {
+				return err
+			}
+
+			var node *yaml.Node
+			if len(doc.Content) > 0 {
+				node = doc.Content[0]
+			}
+			for _, key := range keys {
+				node = mappingValue(node, key)
+			}
+
+			// unset keys print nothing, the built-in default applies
+			if node == nil {
+				return nil
+			}
+			if node.Kind == yaml.ScalarNode {
+				fmt.Println(node.Value)
+				return nil
+			}
+
+			out, err := marshalYAML(node)
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(out))
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set <key> <value>",
+		Short: "Set a config value, non-string values are parsed as yaml (5, true, [a, b], {input: 1, output: 2})",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, vt, err := resolveConfigKey(reflect.TypeOf(Config{}), strings.Split(args[0], "."), "")
+			if err != nil {
+				return err
+			}
+
+			// strings are taken literally, "You are: strict" isn't a mapping
+			value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: args[1]}
+			var parsed yaml.Node
+			if vt.Kind() != reflect.String && yaml.Unmarshal([]byte(args[1]), &parsed) == nil && len(parsed.Content) > 0 {
+				value = parsed.Content[0]
+			}
+
+			data, err := readConfigFile()
+			if err != nil {
+				return err
+			}
+
+			var doc yaml.Node
+			if err := yaml.Unmarshal(data, &doc); err != nil {
+				return err
+			}
+			setConfigValue(&doc, keys, value)
+
+			out, err := marshalYAML(&doc)
+			if err != nil {
+				return err
+			}
+			if problems := configProblems(out); len(problems) > 0 {
+				return fmt.Errorf("not saved: %s", strings.Join(problems, "; "))
+			}
+
+			return writeConfigFile(out)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "edit",
+		Short: "Open the config in $VISUAL or $EDITOR and validate it afterwards",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, err := configFilePath()
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(configFile), 0o755); err != nil {
+				return err
+			}
+
+			editor := getFirstEnv("vi", "VISUAL", "EDITOR")
+			if runtime.GOOS == "windows" && editor == "vi" {
+				editor = "notepad"
+			}
+
+			// the editor may come with arguments, e.g. "code --wait"
+			fields := strings.Fields(editor)
+			edit := exec.Command(fields[0], append(fields[1:], configFile)...)
+			edit.Stdin, edit.Stdout, edit.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := edit.Run(); err != nil {
+				return err
+			}
+
+			data, err := readConfigFile()
+			if err != nil {
+				return err
+			}
+			return printConfigProblems(configFile, configProblems(data))
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "init",
+		Short: "Choose the provider, API key (stored in the system keyring), default model and history",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSetup(false)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "validate",
+		Short: "Check the config for syntax errors, unknown keys and invalid values",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, err := configFilePath()
+			if err != nil {
+				return err
+			}
+			data, err := readConfigFile()
+			if err != nil {
+				return err
+			}
+			if err := printConfigProblems(configFile, configProblems(data)); err != nil {
+				return err
+			}
+			fmt.Println(configFile + ": ok")
+			return nil
+		},
+	})
+
+	cmd.AddCommand(newConfigEffectiveCmd())
+
+	return cmd
+}
+
+func printConfigProblems(configFile string, problems []string) error {
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) in %s", len(problems), configFile)
+	}
+	return nil
+}
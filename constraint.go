@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// --grammar and --regex constrain the answer on servers supporting it
+// (grammar for llama.cpp, guided_regex for vLLM). The answer is checked here
+// as well and asked for again when it doesn't match, e.g. because the server
+// ignored the parameter.
+
+const constraintRetries = 2
+
+// outputConstraint adds the parameters to extra and returns the local check
+// of the answer, nil without constraints
+func outputConstraint(grammarFile, pattern string, extra map[string]interface{}) (func(string) error, error) {
+	var checks []func(string) error
+
+	if grammarFile != "" {
+		data, err := os.ReadFile(grammarFile)
+		if err != nil {
+			return nil, err
+		}
+		g, err := parseGBNF(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", grammarFile, err)
+		}
+		extra["grammar"] = string(data)
+		checks = append(checks, func(answer string) error {
+			if !g.Match(answer) {
+				return fmt.Errorf("the answer doesn't follow the grammar in %s", grammarFile)
+			}
+			return nil
+		})
+	}
+
+	if pattern != "" {
+		extra["guided_regex"] = pattern
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			// the server may understand more than Go's RE2 syntax
+			slog.Warn("the answer can't be checked against --regex here", "err", err)
+		} else {
+			checks = append(checks, func(answer string) error {
+				if !re.MatchString(answer) {
+					return fmt.Errorf("the answer doesn't match --regex %s", pattern)
+				}
+				return nil
+			})
+		}
+	}
+
+	if len(checks) == 0 {
+		return nil, nil
+	}
+	return func(answer string) error {
+		for _, check := range checks {
+			if err := check(answer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// jsonConstraint checks that -j answers are JSON at all
+func jsonConstraint(answer string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(answer), &value); err != nil {
+		return fmt.Errorf("the answer isn't valid JSON: %s", describeJSONError(answer, err))
+	}
+	return nil
+}
+
+// schemaConstraint checks answers against the -J schema
+func schemaConstraint(schema interface{}) func(string) error {
+	return func(answer string) error {
+		errs := validateJSONSchema(schema, answer)
+		if len(errs) == 0 {
+			return nil
+		}
+		if len(errs) > 10 {
+			errs = append(errs[:10], fmt.Sprintf("and %d more", len(errs)-10))
+		}
+		return fmt.Errorf("the answer doesn't match the JSON schema:\n- %s", strings.Join(errs, "\n- "))
+	}
+}
+
+// constrainOutput waits for the whole answer and repeats the request up to
+// retries times while check fails: with feedback the model is shown its
+// answer and the errors to fix them, otherwise it's asked again with another
+// seed
+func constrainOutput(check func(string) error, retries int, feedback bool) llmclient.Middleware {
+	if check == nil {
+		return nil
+	}
+	return func(next llmclient.Handler) llmclient.Handler {
+		return func(req *llmclient.Request) (*llmclient.Response, error) {
+			var usage llmclient.Usage
+
+			for attempt := 0; ; attempt++ {
+				resp, err := next(req)
+				if err != nil {
+					return nil, err
+				}
+
+				var output strings.Builder
+				for c := range resp.Chunks {
+					output.WriteString(c)
+				}
+				usage = llmclient.Usage{
+					PromptTokens:     usage.PromptTokens + resp.Usage.PromptTokens,
+					CompletionTokens: usage.CompletionTokens + resp.Usage.CompletionTokens,
+					TotalTokens:      usage.TotalTokens + resp.Usage.TotalTokens,
+					Estimated:        usage.Estimated || resp.Usage.Estimated,
+					CachedTokens:     usage.CachedTokens + resp.Usage.CachedTokens,
+				}
+
+				err = check(output.String())
+				if err == nil {
+					ch := make(chan string, 1)
+					ch <- output.String()
+					close(ch)
+					return &llmclient.Response{Chunks: ch, Usage: usage, Complete: resp.Complete}, nil
+				}
+				if attempt == retries {
+					if attempt > 0 {
+						err = fmt.Errorf("after %d attempts, %w", attempt+1, err)
+					}
+					return nil, err
+				}
+
+				slog.Warn(fmt.Sprintf("%s, asking again, attempt %d of %d", err, attempt+2, retries+1))
+				if feedback {
+					messages, _ := req.Body["messages"].([]interface{})
+					req.Body["messages"] = append(messages,
+						map[string]interface{}{"role": "assistant", "content": output.String()},
+						map[string]interface{}{"role": "user", "content": err.Error() + "\n\nAnswer again with the corrected JSON only."})
+					continue
+				}
+				// the same seed would give the same answer
+				if seed, ok := req.Body["seed"].(float64); ok {
+					req.Body["seed"] = seed + 1
+				} else if seed, ok := req.Body["seed"].(int); ok {
+					req.Body["seed"] = seed + 1
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ContextPreset is a named bundle of -f patterns and a system prompt, picked
+// with --context
+type ContextPreset struct {
+	Files  []string `yaml:"files"`
+	Prompt string   `yaml:"prompt"`
+}
+
+// applyContextPreset adds the files of the --context preset to -f and uses
+// its prompt unless -p was given
+func applyContextPreset(cmd *cobra.Command, cfg *Config) error {
+	name, _ := cmd.Flags().GetString("context")
+	if name == "" {
+		return nil
+	}
+
+	preset, ok := cfg.Contexts[name]
+	if !ok {
+		var names []string
+		for name := range cfg.Contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("unknown context %q, define it under contexts in the config", name)
+		}
+		return fmt.Errorf("unknown context %q, available: %s", name, strings.Join(names, ", "))
+	}
+
+	for _, pattern := range preset.Files {
+		if err := cmd.Flags().Set("files", pattern); err != nil {
+			return fmt.Errorf("context %s: %w", name, err)
+		}
+	}
+	if preset.Prompt != "" && !cmd.Flags().Changed("prompt") {
+		cmd.Flags().Set("prompt", preset.Prompt)
+	}
+
+	return nil
+}
+
+// lookupContextLayout returns the configured layout of the model, or the
+// default one
+func lookupContextLayout(cfg *Config, model string) string {
+	if layout, ok := cfg.ContextLayout[model]; ok {
+		return layout
+	}
+	return cfg.ContextLayout["default"]
+}
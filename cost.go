@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// defaultPricing in $ per 1M tokens, overridable via the pricing section of the config
+var defaultPricing = map[string]ModelPricing{
+	"gpt-3.5-turbo":      {Input: 0.5, Output: 1.5},
+	"gpt-4":              {Input: 30, Output: 60},
+	"gpt-4-turbo":        {Input: 10, Output: 30},
+	"gpt-4o":             {Input: 2.5, Output: 10},
+	"gpt-4o-mini":        {Input: 0.15, Output: 0.6},
+	"llama3-8b-8192":     {Input: 0.05, Output: 0.08},
+	"llama3-70b-8192":    {Input: 0.59, Output: 0.79},
+	"mixtral-8x7b-32768": {Input: 0.24, Output: 0.24},
+	"gemma-7b-it":        {Input: 0.07, Output: 0.07},
+}
+
+// lookupPricing matches the model exactly first, then by the longest known
+// prefix so that dated snapshots (gpt-4o-2024-05-13) get their family's price
+func lookupPricing(cfg *Config, model string) (ModelPricing, bool) {
+	tables := []map[string]ModelPricing{cfg.Pricing, defaultPricing}
+	key, table, ok := lookupModelKey(model, tables...)
+	if !ok {
+		return ModelPricing{}, false
+	}
+	return tables[table][key], true
+}
+
+func estimateCost(cfg *Config, model string, usage llmclient.Usage) (float64, bool) {
+	p, ok := lookupPricing(cfg, model)
+	if !ok {
+		return 0, false
+	}
+	cached := min(usage.CachedTokens, usage.PromptTokens)
+	cachedPrice := p.Input
+	if p.CachedInput > 0 {
+		cachedPrice = p.CachedInput
+	}
+	input := float64(usage.PromptTokens-cached)*p.Input + float64(cached)*cachedPrice
+	return (input + float64(usage.CompletionTokens)*p.Output) / 1e6, true
+}
+
+type usageRecord struct {
+	Model   string          `json:"model"`
+	Usage   llmclient.Usage `json:"usage"`
+	CostUSD float64         `json:"cost_usd"`
+}
+
+func recordUsage(session *Session, model string, usage llmclient.Usage, cost float64) error {
+	data := struct {
+		SID   string      `json:"sid"`
+		TS    int         `json:"ts"`
+		Usage usageRecord `json:"usage"`
+	}{
+		SID:   session.UUID,
+		TS:    int(time.Now().Unix()),
+		Usage: usageRecord{Model: model, Usage: usage, CostUSD: cost},
+	}
+	return dumpToHistory(session, data)
+}
+
+func dailySpend(day time.Time) (float64, error) {
+	y, m, d := day.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, day.Location()).Unix()
+	end := start + 24*60*60
+
+	var total float64
+	err := readHistory(func(rec historyRecord) error {
+		if rec.Usage != nil && int64(rec.TS) >= start && int64(rec.TS) < end {
+			total += rec.Usage.CostUSD
+		}
+		return nil
+	})
+
+	return total, err
+}
+
+// todaySpend is the spend of the day, read from the history on the first
+// request of a process (and again after midnight), then kept up to date by
+// usageReporter.Record. Spend of other processes running meanwhile isn't
+// seen.
+var todaySpend struct {
+	sync.Mutex
+	day    string // when it was read, empty before
+	amount float64
+}
+
+func spentToday() (float64, error) {
+	todaySpend.Lock()
+	defer todaySpend.Unlock()
+
+	now := time.Now()
+	if day := now.Format(time.DateOnly); todaySpend.day != day {
+		spent, err := dailySpend(now)
+		if err != nil {
+			return 0, err
+		}
+		todaySpend.day, todaySpend.amount = day, spent
+	}
+	return todaySpend.amount, nil
+}
+
+var errBudgetExceeded = errors.New("daily budget exceeded")
+
+func checkBudget(cfg *Config) error {
+	if cfg.Budget.DailyUSD <= 0 {
+		return nil
+	}
+
+	spent, err := spentToday()
+	if err != nil {
+		return err
+	}
+
+	if spent < cfg.Budget.DailyUSD {
+		return nil
+	}
+
+	msg := fmt.Sprintf("spent $%.4f of $%.2f today", spent, cfg.Budget.DailyUSD)
+	if cfg.Budget.OnExceed == "block" {
+		return fmt.Errorf("%w: %s (budget.on_exceed: block)", errBudgetExceeded, msg)
+	}
+
+	slog.Warn(fmt.Sprintf("%s: %s", errBudgetExceeded, msg))
+	return nil
+}
+
+func trackUsage(cfg *Config) bool {
+	return cfg.Budget.DailyUSD > 0
+}
+
+// usageReporter records the spend of each request into the history, its
+// Record method is the onUsage callback for llmChat
+type usageReporter struct {
+	cfg     *Config
+	session *Session
+	model   string
+	last    *llmclient.Usage // of the last answer, failed requests aside
+}
+
+func newUsageReporter(cfg *Config, session *Session, model string) *usageReporter {
+	return &usageReporter{cfg: cfg, session: session, model: model}
+}
+
+func (r *usageReporter) Record(usage llmclient.Usage) {
+	if usage.Error == "" {
+		r.last = &usage
+	}
+
+	cost, _ := estimateCost(r.cfg, r.model, usage)
+
+	// under the lock a record is either in the history read for the day or
+	// added here, never both
+	todaySpend.Lock()
+	defer todaySpend.Unlock()
+	if err := recordUsage(r.session, r.model, usage, cost); err != nil {
+		slog.Warn("recording the usage", "err", err)
+	}
+	if todaySpend.day == time.Now().Format(time.DateOnly) {
+		todaySpend.amount += cost
+	}
+}
+
+// Print reports the cost of the last request to stderr, call it once the
+// response channel is drained
+func (r *usageReporter) Print() {
+	if r.last == nil {
+		return
+	}
+
+	usage := *r.last
+	cost, known := estimateCost(r.cfg, r.model, usage)
+
+	approx := ""
+	if usage.Estimated {
+		approx = "~"
+	}
+
+	cached := ""
+	if usage.CachedTokens > 0 {
+		cached = fmt.Sprintf(", %d cached", usage.CachedTokens)
+	}
+
+	if known {
+		fmt.Fprintf(os.Stderr, "\ncost: %s$%.6f for %s (%s%d in%s / %s%d out tokens)\n", approx, cost, r.model, approx, usage.PromptTokens, cached, approx, usage.CompletionTokens)
+	} else {
+		fmt.Fprintf(os.Stderr, "\ncost: unknown, no pricing for %s (%s%d in%s / %s%d out tokens)\n", r.model, approx, usage.PromptTokens, cached, approx, usage.CompletionTokens)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// locale returns the user's locale from the environment, e.g. de_DE
+func locale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(name); v != "" && v != "C" && v != "POSIX" {
+			v, _, _ = strings.Cut(v, ".")
+			return v
+		}
+	}
+	return ""
+}
+
+// datetimeContext tells the model the current date so relative questions
+// ("this week", "today") aren't answered from its training cutoff
+func datetimeContext(now time.Time) string {
+	zone := now.Format("MST, UTC-07:00")
+	if name := now.Location().String(); name != "Local" && name != "UTC" {
+		zone = name + ", " + zone
+	}
+
+	ret := fmt.Sprintf("Current date and time: %s (timezone %s).", now.Format("Monday, 2006-01-02 15:04"), zone)
+	if l := locale(); l != "" {
+		ret += fmt.Sprintf(" User locale: %s.", l)
+	}
+
+	return ret
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// docTarget is a declaration whose doc comment can be replaced in place,
+// offsets are byte offsets into the source file
+type docTarget struct {
+	codeSymbol
+	declStart int
+	docStart  int // -1 when the declaration has no doc comment yet
+
+	directives []string // of the doc comment, kept when it's replaced
+}
+
+// isDirective tells compiler and tool directives in comments apart from
+// prose, replacing them would change the build
+func isDirective(comment string) bool {
+	return strings.HasPrefix(comment, "//go:") || strings.HasPrefix(comment, "//export ") || strings.HasPrefix(comment, "//line ")
+}
+
+func goDocTargets(src []byte) ([]docTarget, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+
+	target := func(name string, node ast.Node, doc *ast.CommentGroup) docTarget {
+		t := docTarget{
+			codeSymbol: codeSymbol{Name: name, Source: string(src[offset(node.Pos()):offset(node.End())])},
+			declStart:  offset(node.Pos()),
+			docStart:   -1,
+		}
+		if doc != nil {
+			t.docStart = offset(doc.Pos())
+			for _, c := range doc.List {
+				if isDirective(c.Text) {
+					t.directives = append(t.directives, c.Text)
+				}
+			}
+		}
+		return t
+	}
+
+	var ret []docTarget
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			name := d.Name.Name
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				name = receiverTypeName(d.Recv.List[0].Type) + "." + name
+			}
+			ret = append(ret, target(name, d, d.Doc))
+
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if d.Lparen.IsValid() {
+					ret = append(ret, target(ts.Name.Name, ts, ts.Doc))
+				} else {
+					ret = append(ret, target(ts.Name.Name, d, d.Doc))
+				}
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func lineStart(src []byte, offset int) int {
+	for offset > 0 && src[offset-1] != '\n' {
+		offset--
+	}
+	return offset
+}
+
+func formatDocComment(text string, indent string) string {
+	var ret strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if isDirective(strings.TrimSpace(line)) {
+			// the directives of the declaration are kept as they are
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "//"))
+		ret.WriteString(indent + "//")
+		if line != "" {
+			ret.WriteString(" " + line)
+		}
+		ret.WriteString("\n")
+	}
+	return ret.String()
+}
+
+// applyDocComments replaces or inserts doc comments keeping the rest of the
+// file byte-for-byte identical
+func applyDocComments(src []byte, targets []docTarget, docs map[string]string) string {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].declStart > targets[j].declStart })
+
+	out := string(src)
+	for _, t := range targets {
+		doc, ok := docs[t.Name]
+		if !ok || strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		declLine := lineStart(src, t.declStart)
+		indent := string(src[declLine:t.declStart])
+		if strings.TrimSpace(indent) != "" {
+			continue
+		}
+
+		from := declLine
+		if t.docStart >= 0 {
+			from = lineStart(src, t.docStart)
+		}
+
+		comment := formatDocComment(doc, indent)
+		for _, directive := range t.directives {
+			comment += indent + directive + "\n"
+		}
+		out = out[:from] + comment + out[declLine:]
+	}
+
+	return out
+}
+
+func newDocCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "doc",
+		Short:   "Insert or update doc comments for selected symbols and present the result as a patch",
+		GroupID: "code",
+		Args:    cobra.NoArgs,
+		RunE:    runDoc,
+	}
+
+	cmd.Flags().StringSliceP("files", "f", []string{}, "Go source files to document")
+	cmd.Flags().StringSlice("symbol", []string{}, "Only document these declarations (default: all)")
+	cmd.Flags().Bool("apply", false, "Write the changes instead of only printing the patch")
+
+	return cmd
+}
+
+func runDoc(cmd *cobra.Command, args []string) error {
+	files, _ := cmd.Flags().GetStringSlice("files")
+	symbolNames, _ := cmd.Flags().GetStringSlice("symbol")
+	apply, _ := cmd.Flags().GetBool("apply")
+
+	if len(files) == 0 {
+		return fmt.Errorf("at least one source file is required (-f)")
+	}
+
+	complete := newLLMCompleter(cmd)
+
+	var patches []filePatch
+
+	for _, file := range files {
+		if filepath.Ext(file) != ".go" {
+			return fmt.Errorf("%s: only Go files are supported", file)
+		}
+
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		targets, err := goDocTargets(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		if len(symbolNames) > 0 {
+			all := make([]codeSymbol, len(targets))
+			for i, t := range targets {
+				all[i] = t.codeSymbol
+			}
+			selected, err := selectSymbols(all, symbolNames)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+
+			var filtered []docTarget
+			for _, t := range targets {
+				for _, sym := range selected {
+					if sym.Name == t.Name {
+						filtered = append(filtered, t)
+						break
+					}
+				}
+			}
+			targets = filtered
+		}
+
+		if len(targets) == 0 {
+			slog.Warn(file + ": nothing to document")
+			continue
+		}
+
+		docs, err := generateDocComments(complete, file, src, targets)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		patches = append(patches, filePatch{Path: file, Old: string(src), New: applyDocComments(src, targets, docs)})
+	}
+
+	fmt.Print(formatPatches(patches))
+
+	if apply {
+		return applyFilePatches(patches)
+	}
+
+	return nil
+}
+
+func generateDocComments(complete llmCompleteFunc, file string, src []byte, targets []docTarget) (map[string]string, error) {
+	var symbols strings.Builder
+	for _, t := range targets {
+		fmt.Fprintf(&symbols, "- %s\n", t.Name)
+	}
+
+	messages := []llmclient.Message{
+		{
+			Role: "system",
+			Content: `You are an expert Go engineer writing doc comments.
+Follow Go conventions: the comment starts with the name of the declared identifier (the method name for methods), is a complete sentence and stays concise.
+Respond with a single JSON object in a fenced code block mapping each requested symbol name exactly as given to its comment text, without the leading "//".`,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Source file %s:\n```go\n%s\n```\n\nWrite doc comments for:\n%s", file, strings.TrimRight(string(src), "\n"), symbols.String()),
+		},
+	}
+
+	answer, err := complete(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := extractCodeBlock(answer)
+	if err != nil {
+		payload = answer
+	}
+
+	docs := map[string]string{}
+	if err := json.Unmarshal([]byte(payload), &docs); err != nil {
+		return nil, fmt.Errorf("unexpected model response: %w", err)
+	}
+
+	return docs, nil
+}
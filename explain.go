@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+const defaultStackFrames = 5
+
+type StackTraceConfig struct {
+	Frames int `yaml:"frames"`
+}
+
+type sourceRef struct {
+	Path string
+	Line int
+}
+
+var sourceRefPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`([\w./\\~-]+\.[A-Za-z0-9]+):(\d+)`),        // go, gcc, rustc, node: path:line[:col]
+	regexp.MustCompile(`File "([^"]+)", line (\d+)`),               // python tracebacks
+	regexp.MustCompile(`([\w./\\~-]+\.[A-Za-z0-9]+)\((\d+),\d+\)`), // tsc, msbuild: path(line,col)
+}
+
+// findSourceRefs extracts the file:line references of compiler and test
+// output in order of appearance
+func findSourceRefs(text string) []sourceRef {
+	type match struct {
+		pos int
+		ref sourceRef
+	}
+
+	var matches []match
+	for _, re := range sourceRefPatterns {
+		for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+			line, err := strconv.Atoi(text[m[4]:m[5]])
+			if err != nil || line <= 0 {
+				continue
+			}
+			matches = append(matches, match{m[0], sourceRef{Path: text[m[2]:m[3]], Line: line}})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].pos < matches[j].pos })
+
+	seen := map[sourceRef]bool{}
+	var ret []sourceRef
+	for _, m := range matches {
+		if !seen[m.ref] {
+			seen[m.ref] = true
+			ret = append(ret, m.ref)
+		}
+	}
+
+	return ret
+}
+
+func locateSourceFile(path string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	return filepath.Clean(path), true
+}
+
+// repoIndex maps paths reported by stack traces from other machines, CI
+// runners or containers (/home/runner/work/app/app/pkg/x.go) to files of the
+// current repository by their longest unique path suffix
+type repoIndex struct {
+	once  sync.Once
+	files []string
+}
+
+func (idx *repoIndex) Locate(path string) (string, bool) {
+	if p, ok := locateSourceFile(path); ok {
+		return p, true
+	}
+
+	idx.once.Do(func() {
+		idx.files, _ = contextbuilder.PathResolver{}.Resolve([]string{"."})
+	})
+
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i := range parts {
+		suffix := strings.Join(parts[i:], "/")
+		if suffix == "" {
+			continue
+		}
+
+		var found []string
+		for _, f := range idx.files {
+			f = filepath.ToSlash(f)
+			if f == suffix || strings.HasSuffix(f, "/"+suffix) {
+				found = append(found, f)
+			}
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return filepath.FromSlash(found[0]), true
+		default:
+			return "", false
+		}
+	}
+
+	return "", false
+}
+
+// isRepoPath filters out frames of the runtime and installed dependencies
+// that happen to exist on this machine too
+func isRepoPath(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(wd, abs)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+var stackTraceMarkers = []string{
+	"goroutine ",                        // go
+	"Traceback (most recent call last)", // python
+	"\n\tat ",                           // java, kotlin
+	"\n    at ",                         // node
+	"stack backtrace:",                  // rust
+}
+
+func isStackTrace(text string) bool {
+	for _, marker := range stackTraceMarkers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// stackFrames returns the references of a stack trace innermost frame first
+func stackFrames(text string) []sourceRef {
+	refs := findSourceRefs(text)
+
+	if strings.Contains(text, "Traceback (most recent call last)") {
+		for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+			refs[i], refs[j] = refs[j], refs[i]
+		}
+	}
+
+	return refs
+}
+
+type sourceWindow struct {
+	Path  string
+	From  int // 1-based, inclusive
+	Lines []string
+}
+
+// loadSourceWindows reads radius lines around every reference, windows in the
+// same file are merged when they overlap
+func loadSourceWindows(refs []sourceRef, index *repoIndex, radius int, maxFiles int) []sourceWindow {
+	var files []string
+	lines := map[string][]int{}
+
+	for _, ref := range refs {
+		path, ok := index.Locate(ref.Path)
+		if !ok {
+			continue
+		}
+		if _, ok := lines[path]; !ok {
+			if len(files) >= maxFiles {
+				continue
+			}
+			files = append(files, path)
+		}
+		lines[path] = append(lines[path], ref.Line)
+	}
+
+	var ret []sourceWindow
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		content := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+		sort.Ints(lines[path])
+
+		var cur *sourceWindow
+		for _, line := range lines[path] {
+			from, to := line-radius, line+radius
+			if from < 1 {
+				from = 1
+			}
+			if to > len(content) {
+				to = len(content)
+			}
+			if from > to {
+				continue
+			}
+
+			if cur != nil && from <= cur.From+len(cur.Lines) {
+				if to >= cur.From+len(cur.Lines) {
+					cur.Lines = content[cur.From-1 : to]
+				}
+				continue
+			}
+
+			ret = append(ret, sourceWindow{Path: path, From: from, Lines: content[from-1 : to]})
+			cur = &ret[len(ret)-1]
+		}
+	}
+
+	return ret
+}
+
+func formatSourceWindows(windows []sourceWindow) string {
+	var ret strings.Builder
+
+	for _, w := range windows {
+		fmt.Fprintf(&ret, "### %s (lines %d-%d)\n```%s\n", w.Path, w.From, w.From+len(w.Lines)-1, contextbuilder.FenceLanguages[filepath.Ext(w.Path)])
+		for i, line := range w.Lines {
+			fmt.Fprintf(&ret, "%5d| %s\n", w.From+i, line)
+		}
+		ret.WriteString("```\n\n")
+	}
+
+	return ret.String()
+}
+
+func newExplainErrorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "explain-error [question]",
+		Short:   "Explain a compiler/test error or stack trace read from stdin, loading the referenced source automatically",
+		GroupID: "code",
+		RunE:    runExplainError,
+	}
+
+	cmd.Flags().Int("window", 10, "Lines of source to include around each referenced line")
+	cmd.Flags().Int("max-files", 8, "Maximum number of referenced files to load")
+	cmd.Flags().Int("frames", defaultStackFrames, "For stack traces: how many of the innermost frames in this repository to include (config: stacktrace.frames)")
+
+	return cmd
+}
+
+func runExplainError(cmd *cobra.Command, args []string) error {
+	radius, _ := cmd.Flags().GetInt("window")
+	maxFiles, _ := cmd.Flags().GetInt("max-files")
+
+	if terminal().Stdin {
+		return fmt.Errorf("pipe the error output into llm explain-error, e.g. go build ./... 2>&1 | llm explain-error")
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	errorText := strings.TrimSpace(string(input))
+	if errorText == "" {
+		return fmt.Errorf("no error output on stdin")
+	}
+
+	index := &repoIndex{}
+
+	var refs []sourceRef
+	if isStackTrace(errorText) {
+		frames, _ := cmd.Flags().GetInt("frames")
+		if !cmd.Flags().Changed("frames") {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			if cfg.StackTrace.Frames > 0 {
+				frames = cfg.StackTrace.Frames
+			}
+		}
+
+		for _, ref := range stackFrames(errorText) {
+			if len(refs) >= frames {
+				break
+			}
+			if path, ok := index.Locate(ref.Path); ok && isRepoPath(path) {
+				refs = append(refs, ref)
+			}
+		}
+	} else {
+		refs = findSourceRefs(errorText)
+	}
+
+	windows := loadSourceWindows(refs, index, radius, maxFiles)
+
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Error output:\n```\n%s\n```\n\n", errorText)
+	if len(windows) > 0 {
+		prompt.WriteString("Referenced source code:\n\n")
+		prompt.WriteString(formatSourceWindows(windows))
+	}
+	if len(args) > 0 {
+		prompt.WriteString(strings.Join(args, " "))
+	}
+
+	messages := []llmclient.Message{
+		{
+			Role: "system",
+			Content: `You are an expert software engineer helping to fix a failing build or test.
+Explain the root cause of the error concisely, then give a concrete fix referring to the file and line, with corrected code where useful.`,
+		},
+		{Role: "user", Content: prompt.String()},
+	}
+
+	_, err = newLLMStreamer(cmd)(messages, os.Stdout)
+	fmt.Println()
+
+	return err
+}
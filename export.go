@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// llm history export writes sessions into notes systems. The obsidian format
+// is a folder with a note per session: front matter for Dataview and
+// search, a link to the daily note of the session's day and to an index
+// note listing every exported session, so both show the sessions among
+// their backlinks. Exporting again overwrites the notes of the same
+// sessions. The notion format creates a page per session under a page the
+// integration has been shared with, new pages on every export.
+
+type NotionConfig struct {
+	Token      string `yaml:"token"`       // integration secret, NOTION_TOKEN takes precedence
+	ParentPage string `yaml:"parent_page"` // id or URL of the page the sessions are created under
+}
+
+const (
+	obsidianIndexNote = "LLM sessions"
+
+	notionAPI     = "https://api.notion.com/v1"
+	notionVersion = "2022-06-28"
+	// limits of the API: characters of a text object, blocks per request
+	notionTextLimit  = 2000
+	notionBlockLimit = 100
+)
+
+func newHistoryExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [session-uuid-prefix]...",
+		Short: "Export sessions to an Obsidian vault folder or to Notion pages, all sessions if none are given",
+		Example: `  llm history export --format obsidian -o ~/vault/LLM --since 30d
+  llm history export --format notion --notion-page https://www.notion.so/AI-chats-0123456789abcdef0123456789abcdef j2WdwM`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			outDir, _ := cmd.Flags().GetString("out")
+			sinceFlag, _ := cmd.Flags().GetString("since")
+			notionPage, _ := cmd.Flags().GetString("notion-page")
+
+			since, err := parseSince(sinceFlag)
+			if err != nil {
+				return err
+			}
+			sessions, err := selectExportSessions(args, since)
+			if err != nil {
+				return err
+			}
+			if len(sessions) == 0 {
+				fmt.Fprintln(os.Stderr, "no sessions to export")
+				return nil
+			}
+
+			switch format {
+			case "obsidian":
+				return exportObsidian(sessions, outDir)
+			case "notion":
+				cfg, err := loadConfig()
+				if err != nil {
+					return err
+				}
+				token := os.Getenv("NOTION_TOKEN")
+				if token == "" {
+					token = cfg.Notion.Token
+				}
+				if notionPage == "" {
+					notionPage = cfg.Notion.ParentPage
+				}
+				if token == "" || notionPage == "" {
+					return fmt.Errorf("the notion export needs an integration token (NOTION_TOKEN or notion.token) and a parent page (--notion-page or notion.parent_page)")
+				}
+				return exportNotion(sessions, token, notionPage)
+			}
+			return fmt.Errorf("unknown format %q, use obsidian or notion", format)
+		},
+	}
+
+	cmd.Flags().String("format", "obsidian", "obsidian (a folder of notes) or notion (pages under --notion-page)")
+	cmd.Flags().StringP("out", "o", ".", "Folder of the obsidian notes, e.g. in a vault, created if missing")
+	cmd.Flags().String("since", "", "Only sessions started since a duration ago (24h, 7d) or a date (2024-05-01)")
+	cmd.Flags().String("notion-page", "", "Id or URL of the Notion page to create the sessions under, default notion.parent_page")
+
+	return cmd
+}
+
+// selectExportSessions returns the sessions matching the prefixes, all of
+// them without any, oldest first. Sessions without a question are left out.
+func selectExportSessions(prefixes []string, since time.Time) ([]*sessionTranscript, error) {
+	var ret []*sessionTranscript
+	if len(prefixes) > 0 {
+		for _, prefix := range prefixes {
+			s, err := findSessionTranscript(prefix)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, s)
+		}
+	} else {
+		sessions, err := loadSessionTranscripts()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			ret = append(ret, s)
+		}
+	}
+
+	filtered := ret[:0]
+	for _, s := range ret {
+		if s.Start.Before(since) || sessionTitle(s) == "" {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].order < filtered[j].order })
+	return filtered, nil
+}
+
+// sessionTitle is the first line of the first question, shortened
+func sessionTitle(s *sessionTranscript) string {
+	for _, msg := range s.Messages {
+		if msg.Role != "user" {
+			continue
+		}
+		for _, line := range strings.Split(msg.Content, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				return truncateRunes(line, 60)
+			}
+		}
+	}
+	return ""
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(r[:n-1])) + "…"
+}
+
+// characters Obsidian doesn't allow in note names, or that break links
+var unsafeNoteName = regexp.MustCompile(`[\\/:*?"<>|#^\[\]]+`)
+
+// obsidianNoteName is unique per session and keeps the notes in order
+func obsidianNoteName(s *sessionTranscript) string {
+	title := strings.Join(strings.Fields(unsafeNoteName.ReplaceAllString(sessionTitle(s), " ")), " ")
+	title = strings.TrimRight(title, ".")
+	return fmt.Sprintf("%s %s %s", s.Start.Format("2006-01-02 1504"), title, unsafeNoteName.ReplaceAllString(s.SID[:min(8, len(s.SID))], "-"))
+}
+
+func yamlString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func formatObsidianNote(s *sessionTranscript, embed func(msg, image int, data []byte, ext string) (string, error)) (string, error) {
+	var b strings.Builder
+	day := s.Start.Format(time.DateOnly)
+
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: %s\n", yamlString(sessionTitle(s)))
+	fmt.Fprintf(&b, "llm_session: %s\n", yamlString(s.SID))
+	fmt.Fprintf(&b, "date: %s\n", s.Start.Format(time.RFC3339))
+	if s.Model != "" {
+		fmt.Fprintf(&b, "model: %s\n", yamlString(s.Model))
+	}
+	b.WriteString("tags: [llm]\n")
+	b.WriteString("---\n\n")
+	fmt.Fprintf(&b, "Session of [[%s]], see [[%s]]\n\n", day, obsidianIndexNote)
+
+	for i, msg := range s.Messages {
+		content := strings.TrimRight(msg.Content, " \t\r\n")
+		switch msg.Role {
+		case "system":
+			b.WriteString("> [!note]- System prompt\n")
+			for _, line := range strings.Split(content, "\n") {
+				fmt.Fprintf(&b, "> %s\n", line)
+			}
+			b.WriteString("\n")
+			continue
+		case "user":
+			b.WriteString("## User\n\n")
+		case "assistant":
+			b.WriteString("## Assistant\n\n")
+		default:
+			fmt.Fprintf(&b, "## %s\n\n", msg.Role)
+		}
+
+		if content != "" {
+			b.WriteString(content + "\n\n")
+		}
+		for j, image := range msg.Images {
+			data, ext, ok, err := decodeImageDataURL(image)
+			if !ok {
+				fmt.Fprintf(&b, "![](%s)\n\n", image)
+				continue
+			}
+			if err != nil {
+				return "", fmt.Errorf("session %s, message %d, image %d: %w", s.SID, i+1, j+1, err)
+			}
+			name, err := embed(i+1, j+1, data, ext)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "![[%s]]\n\n", name)
+		}
+		if msg.Interrupted {
+			b.WriteString("*(interrupted)*\n\n")
+		}
+	}
+	return b.String(), nil
+}
+
+// exportObsidian writes a note per session into outDir, the attached
+// images into its attachments folder, and rebuilds the index note
+func exportObsidian(sessions []*sessionTranscript, outDir string) error {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return err
+	}
+
+	for _, s := range sessions {
+		name := obsidianNoteName(s)
+		embed := func(msg, image int, data []byte, ext string) (string, error) {
+			dir := filepath.Join(outDir, "attachments")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return "", err
+			}
+			file := fmt.Sprintf("%s %02d-%d.%s", name, msg, image, ext)
+			return file, os.WriteFile(filepath.Join(dir, file), data, 0o644)
+		}
+
+		note, err := formatObsidianNote(s, embed)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(outDir, name+".md")
+		if err := os.WriteFile(path, []byte(note), 0o644); err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+
+	return writeObsidianIndex(outDir)
+}
+
+type obsidianIndexEntry struct {
+	name, title, date, model string
+}
+
+// writeObsidianIndex lists the session notes found in outDir, earlier
+// exports included, newest first
+func writeObsidianIndex(outDir string) error {
+	paths, err := filepath.Glob(filepath.Join(outDir, "*.md"))
+	if err != nil {
+		return err
+	}
+
+	var entries []obsidianIndexEntry
+	for _, path := range paths {
+		entry, ok := readObsidianFrontMatter(path)
+		if !ok {
+			continue
+		}
+		entry.name = strings.TrimSuffix(filepath.Base(path), ".md")
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].date > entries[j].date })
+
+	var b strings.Builder
+	b.WriteString("---\ntags: [llm]\n---\n")
+	day := ""
+	for _, e := range entries {
+		if d, _, _ := strings.Cut(e.date, "T"); d != day {
+			day = d
+			fmt.Fprintf(&b, "\n## [[%s]]\n\n", day)
+		}
+		// brackets and pipes in the title would end the link
+		alias := strings.Join(strings.Fields(strings.NewReplacer("[", " ", "]", " ", "|", " ").Replace(e.title)), " ")
+		line := fmt.Sprintf("- [[%s|%s]]", e.name, alias)
+		if e.model != "" {
+			line += " · " + e.model
+		}
+		b.WriteString(line + "\n")
+	}
+	return os.WriteFile(filepath.Join(outDir, obsidianIndexNote+".md"), []byte(b.String()), 0o644)
+}
+
+// readObsidianFrontMatter reads what the index needs from a note written by
+// the export, ok is false for the other notes of the folder
+func readObsidianFrontMatter(path string) (entry obsidianIndexEntry, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return entry, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != "---" {
+		return entry, false
+	}
+	for scanner.Scan() && scanner.Text() != "---" {
+		key, value, _ := strings.Cut(scanner.Text(), ": ")
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		switch key {
+		case "llm_session":
+			ok = true
+		case "title":
+			entry.title = value
+		case "date":
+			entry.date = value
+		case "model":
+			entry.model = value
+		}
+	}
+	return entry, ok
+}
+
+type notionBlock map[string]interface{}
+
+func notionText(s string) []interface{} {
+	return []interface{}{map[string]interface{}{"type": "text", "text": map[string]interface{}{"content": s}}}
+}
+
+// notionTextBlocks makes blocks of the given type out of text, split at
+// line ends into pieces the API accepts
+func notionTextBlocks(kind string, text string, extra map[string]interface{}) []notionBlock {
+	var ret []notionBlock
+	var cur []rune
+	flush := func() {
+		if len(cur) > 0 {
+			ret = append(ret, notionBlock{"type": kind, kind: withRichText(strings.TrimSuffix(string(cur), "\n"), extra)})
+			cur = nil
+		}
+	}
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		r := []rune(line)
+		if len(cur)+len(r) > notionTextLimit {
+			flush()
+		}
+		for len(r) > notionTextLimit {
+			cur = r[:notionTextLimit]
+			flush()
+			r = r[notionTextLimit:]
+		}
+		cur = append(cur, r...)
+	}
+	flush()
+	return ret
+}
+
+func withRichText(s string, extra map[string]interface{}) map[string]interface{} {
+	ret := map[string]interface{}{"rich_text": notionText(s)}
+	for k, v := range extra {
+		ret[k] = v
+	}
+	return ret
+}
+
+// notionContentBlocks turns markdown into paragraphs and code blocks, the
+// rest of the markdown stays as it is written
+func notionContentBlocks(content string) []notionBlock {
+	var ret []notionBlock
+	var text, code strings.Builder
+	inCode := false
+
+	flushText := func() {
+		for _, paragraph := range strings.Split(text.String(), "\n\n") {
+			if paragraph = strings.Trim(paragraph, "\n"); strings.TrimSpace(paragraph) != "" {
+				ret = append(ret, notionTextBlocks("paragraph", paragraph, nil)...)
+			}
+		}
+		text.Reset()
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inCode {
+				ret = append(ret, notionTextBlocks("code", strings.TrimSuffix(code.String(), "\n"), map[string]interface{}{"language": "plain text"})...)
+				code.Reset()
+			} else {
+				flushText()
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			code.WriteString(line + "\n")
+		} else {
+			text.WriteString(line + "\n")
+		}
+	}
+	// an unterminated fence, e.g. of an interrupted answer
+	text.WriteString(code.String())
+	flushText()
+	return ret
+}
+
+func notionSessionBlocks(s *sessionTranscript) []notionBlock {
+	info := fmt.Sprintf("llm session %s, %s", s.SID, s.Start.Format(time.DateTime))
+	if s.Model != "" {
+		info += ", " + s.Model
+	}
+	ret := notionTextBlocks("paragraph", info, nil)
+
+	for _, msg := range s.Messages {
+		content := strings.TrimRight(msg.Content, " \t\r\n")
+		switch msg.Role {
+		case "system":
+			ret = append(ret, notionTextBlocks("quote", "System prompt: "+content, nil)...)
+			continue
+		case "user":
+			ret = append(ret, notionTextBlocks("heading_2", "User", nil)...)
+		case "assistant":
+			ret = append(ret, notionTextBlocks("heading_2", "Assistant", nil)...)
+		default:
+			ret = append(ret, notionTextBlocks("heading_2", msg.Role, nil)...)
+		}
+		ret = append(ret, notionContentBlocks(content)...)
+		for _, image := range msg.Images {
+			if _, _, ok, _ := decodeImageDataURL(image); ok {
+				// uploads need the file API, only links can be embedded
+				ret = append(ret, notionTextBlocks("paragraph", "(attached image, see llm history attachments)", nil)...)
+			} else {
+				ret = append(ret, notionBlock{"type": "image", "image": map[string]interface{}{"type": "external", "external": map[string]interface{}{"url": image}}})
+			}
+		}
+		if msg.Interrupted {
+			ret = append(ret, notionTextBlocks("paragraph", "(interrupted)", nil)...)
+		}
+	}
+	return ret
+}
+
+var notionIDPattern = regexp.MustCompile(`[0-9a-fA-F]{32}$|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// notionPageID takes the id out of a page URL, which ends with it
+func notionPageID(page string) (string, error) {
+	page, _, _ = strings.Cut(page, "?")
+	id := notionIDPattern.FindString(strings.TrimRight(page, "/"))
+	if id == "" {
+		return "", fmt.Errorf("%q isn't a Notion page id or URL", page)
+	}
+	return id, nil
+}
+
+type notionClient struct {
+	token  string
+	client *http.Client
+}
+
+// do sends a request to the API, waiting out rate limiting
+func (c *notionClient) do(method, path string, body interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, notionAPI+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Notion-Version", notionVersion)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < 5 {
+			wait, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil || wait < 1 {
+				wait = 1
+			}
+			time.Sleep(time.Duration(wait) * time.Second)
+			continue
+		}
+
+		var ret map[string]interface{}
+		json.Unmarshal(respBody, &ret)
+		if resp.StatusCode != http.StatusOK {
+			if msg, ok := ret["message"].(string); ok {
+				return nil, fmt.Errorf("notion: %s", msg)
+			}
+			return nil, fmt.Errorf("notion: %s: %s", resp.Status, respBody)
+		}
+		return ret, nil
+	}
+}
+
+// exportNotion creates a page per session under the parent page and prints
+// their URLs
+func exportNotion(sessions []*sessionTranscript, token, parentPage string) error {
+	parentID, err := notionPageID(parentPage)
+	if err != nil {
+		return err
+	}
+	c := &notionClient{token: token, client: &http.Client{Timeout: 30 * time.Second}}
+
+	for _, s := range sessions {
+		blocks := notionSessionBlocks(s)
+		first := blocks[:min(len(blocks), notionBlockLimit)]
+		title := fmt.Sprintf("%s %s", s.Start.Format("2006-01-02 15:04"), sessionTitle(s))
+
+		page, err := c.do("POST", "/pages", map[string]interface{}{
+			"parent": map[string]interface{}{"page_id": parentID},
+			"properties": map[string]interface{}{
+				"title": map[string]interface{}{"title": notionText(title)},
+			},
+			"children": first,
+		})
+		if err != nil {
+			return fmt.Errorf("session %s: %w", s.SID, err)
+		}
+		pageID, _ := page["id"].(string)
+
+		for rest := blocks[len(first):]; len(rest) > 0; {
+			batch := rest[:min(len(rest), notionBlockLimit)]
+			if _, err := c.do("PATCH", "/blocks/"+pageID+"/children", map[string]interface{}{"children": batch}); err != nil {
+				return fmt.Errorf("session %s: %w", s.SID, err)
+			}
+			rest = rest[len(batch):]
+		}
+
+		if url, ok := page["url"].(string); ok {
+			fmt.Println(url)
+		}
+	}
+	return nil
+}
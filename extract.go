@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// llm extract --schema fills a JSON schema from documents. The schema goes
+// out as response_format and every answer is validated locally, invalid ones
+// are sent back with the errors. Documents larger than a chunk are extracted
+// part by part concurrently, the parts are merged here (objects key by key,
+// arrays concatenated without duplicates, the first value of a scalar wins)
+// and only when the merged document doesn't match the schema the model is
+// asked to merge them.
+
+const extractSystemText = "You extract structured data from documents. Answer with a single JSON document matching the JSON schema below and nothing else. Take the values from the document, keeping its wording; don't invent anything, leave out or set to null what the document doesn't contain."
+
+func newExtractCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "extract --schema schema.json [-f document]... [instructions]",
+		Short: "Extract a JSON document matching a schema from files or stdin, long inputs in chunks",
+		Example: `  llm extract --schema invoice.schema.json -f invoice.txt
+  pdftotext contract.pdf - | llm extract --schema parties.json "only the signing parties"`,
+		GroupID: "chat",
+		RunE:    runExtract,
+	}
+
+	cmd.Flags().String("schema", "", "JSON schema file of the document to extract (required)")
+	cmd.Flags().StringSliceP("files", "f", []string{}, "Documents to extract from, stdin if none")
+	cmd.Flags().Int("chunk-tokens", 0, "Size of the parts of a long input, default two thirds of the model's context window, at most 24000")
+	cmd.Flags().IntP("concurrency", "P", 4, "Number of parts extracted at once")
+	cmd.Flags().Int("retries", 2, "How many times an answer not matching the schema is sent back to be fixed")
+	cmd.Flags().IntP("max_tokens", "N", 4096, "Max amount of tokens in each response")
+
+	return cmd
+}
+
+type extractor struct {
+	cfg        *Config
+	model      string
+	schemaText string
+	request    func(messages []llmclient.Message, usage func(llmclient.Usage)) (<-chan string, error)
+
+	mu          sync.Mutex
+	usage       *usageReporter
+	total       llmclient.Usage
+	cost        float64
+	costUnknown bool
+}
+
+func (e *extractor) record(u llmclient.Usage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.usage.Record(u)
+	e.total.PromptTokens += u.PromptTokens
+	e.total.CompletionTokens += u.CompletionTokens
+	e.total.TotalTokens += u.TotalTokens
+	e.total.Estimated = e.total.Estimated || u.Estimated
+	if cost, known := estimateCost(e.cfg, e.model, u); known {
+		e.cost += cost
+	} else {
+		e.costUnknown = true
+	}
+}
+
+// ask returns the decoded answer, constrainOutput made sure it matches the
+// schema
+func (e *extractor) ask(user string) (interface{}, error) {
+	messages := []llmclient.Message{
+		{Role: "system", Content: extractSystemText + "\n\n```json\n" + e.schemaText + "\n```"},
+		{Role: "user", Content: user},
+	}
+	ch, err := e.request(messages, e.record)
+	if err != nil {
+		return nil, err
+	}
+	var answer strings.Builder
+	for content := range ch {
+		answer.WriteString(content)
+	}
+
+	var ret interface{}
+	if err := json.Unmarshal([]byte(answer.String()), &ret); err != nil {
+		return nil, fmt.Errorf("the answer isn't JSON: %w", err)
+	}
+	return ret, nil
+}
+
+func (e *extractor) printCost() {
+	approx := ""
+	if e.total.Estimated {
+		approx = "~"
+	}
+	line := fmt.Sprintf("extract: %s%d in / %s%d out tokens", approx, e.total.PromptTokens, approx, e.total.CompletionTokens)
+	if e.costUnknown {
+		line += fmt.Sprintf(", cost unknown, no pricing for %s", e.model)
+	} else {
+		line += fmt.Sprintf(", cost %s$%.6f", approx, e.cost)
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// mergeExtractions combines the extractions of two parts of a document
+func mergeExtractions(a, b interface{}) interface{} {
+	switch av := a.(type) {
+	case nil:
+		return b
+	case string:
+		if av == "" {
+			return b
+		}
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			for k, v := range bv {
+				av[k] = mergeExtractions(av[k], v)
+			}
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+		items:
+			for _, item := range bv {
+				for _, have := range av {
+					if reflect.DeepEqual(have, item) {
+						continue items
+					}
+				}
+				av = append(av, item)
+			}
+			return av
+		}
+	}
+	return a
+}
+
+func readExtractInput(files []string) (string, error) {
+	if len(files) == 0 {
+		if terminal().Stdin {
+			return "", fmt.Errorf("give the documents with -f or on stdin")
+		}
+		data, err := io.ReadAll(os.Stdin)
+		return string(data), err
+	}
+
+	paths, err := contextbuilder.PathResolver{}.Resolve(files)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 1 {
+		data, err := os.ReadFile(paths[0])
+		return string(data), err
+	}
+	var b strings.Builder
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "=== %s\n\n%s\n\n", path, data)
+	}
+	return b.String(), nil
+}
+
+func runExtract(cmd *cobra.Command, args []string) error {
+	schemaPath, _ := cmd.Flags().GetString("schema")
+	files, _ := cmd.Flags().GetStringSlice("files")
+	chunkTokens, _ := cmd.Flags().GetInt("chunk-tokens")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	retries, _ := cmd.Flags().GetInt("retries")
+	maxTokens, _ := cmd.Flags().GetInt("max_tokens")
+
+	modelname := getModelName(cmd)
+	seed, _ := cmd.Flags().GetInt("seed")
+	temperature, _ := cmd.Flags().GetFloat64("temperature")
+	apiKey, apiBase := configuredAPI(cmd)
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	printCost, _ := cmd.Flags().GetBool("cost")
+
+	if schemaPath == "" {
+		return fmt.Errorf("--schema is required")
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	data, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return err
+	}
+	var schema interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return fmt.Errorf("%s: %w", schemaPath, err)
+	}
+	schemaText, _ := json.MarshalIndent(schema, "", "  ")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	input, err := readExtractInput(files)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(input) == "" {
+		return fmt.Errorf("the input is empty")
+	}
+	cache, err := openResponseCache(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
+	if chunkTokens <= 0 {
+		chunkTokens = defaultChunkTokens
+		if window := resolveModelLimits(cfg, apiKey, apiBase, modelname).Context; window > 0 {
+			chunkTokens = min(window*2/3-llmclient.EstimateTokens(string(schemaText))-maxTokens, maxChunkTokens)
+		}
+		if chunkTokens < 1000 {
+			return fmt.Errorf("the context window of %s leaves no room for the input, lower --max_tokens or set --chunk-tokens", modelname)
+		}
+	}
+
+	extra := map[string]interface{}{
+		"max_tokens": maxTokens,
+		"response_format": map[string]interface{}{
+			"type":        "json_schema",
+			"json_schema": map[string]interface{}{"name": "extraction", "schema": schema},
+		},
+	}
+	session := newSession()
+	e := &extractor{
+		cfg:        cfg,
+		model:      modelname,
+		schemaText: string(schemaText),
+		usage:      newUsageReporter(cfg, session, modelname),
+		request: func(messages []llmclient.Message, usage func(llmclient.Usage)) (<-chan string, error) {
+			middlewares := append([]llmclient.Middleware{constrainOutput(schemaConstraint(schema), retries, true)}, requestMiddlewares(cfg, modelname)...)
+			return llmclient.Chat(messages, modelname, seed, temperature, nil, apiKey, apiBase, false, extra, verbose, usage, cache, cfg.Hooks, middlewares...)
+		},
+	}
+	if printCost {
+		defer e.printCost()
+	}
+
+	instructions := strings.TrimSpace(strings.Join(args, " "))
+	prompt := func(part string) string {
+		if instructions == "" {
+			return part
+		}
+		return instructions + "\n\n" + part
+	}
+
+	chunks := splitChunks(input, chunkTokens*4)
+	if len(chunks) == 1 {
+		doc, err := e.ask(prompt("Document:\n\n" + input))
+		if err != nil {
+			return err
+		}
+		return printExtraction(doc)
+	}
+
+	fmt.Fprintf(os.Stderr, "extract: the input is ~%d tokens, extracting from %d parts\n", llmclient.EstimateTokens(input), len(chunks))
+	docs := make([]interface{}, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			docs[i], errs[i] = e.ask(prompt(fmt.Sprintf("Part %d of %d of the document, extract what this part contains:\n\n%s", i+1, len(chunks), chunk)))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("part %d of %d: %w", i+1, len(chunks), err)
+		}
+	}
+
+	var merged interface{}
+	for _, doc := range docs {
+		merged = mergeExtractions(merged, doc)
+	}
+	mergedText, _ := json.Marshal(merged)
+	if err := schemaConstraint(schema)(string(mergedText)); err == nil {
+		return printExtraction(merged)
+	}
+
+	// e.g. a maxItems or a single value found differently in several parts
+	fmt.Fprintln(os.Stderr, "extract: the merged parts don't match the schema, asking the model to merge them")
+	var b strings.Builder
+	for i, doc := range docs {
+		part, _ := json.Marshal(doc)
+		fmt.Fprintf(&b, "Part %d of %d:\n%s\n\n", i+1, len(docs), part)
+	}
+	doc, err := e.ask(prompt("These are the extractions from the parts of one document. Merge them into the document the whole would give, resolving duplicates and conflicts.\n\n" + b.String()))
+	if err != nil {
+		return err
+	}
+	return printExtraction(doc)
+}
+
+func printExtraction(doc interface{}) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
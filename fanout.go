@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+type fanOutTarget struct {
+	Model   string
+	Session *Session
+	Usage   *usageReporter
+	Api     func(ctx context.Context, messages []Message) (<-chan string, error)
+}
+
+type fanOutResult struct {
+	chunks chan string
+	answer strings.Builder
+	err    error
+}
+
+// runFanOut sends the same conversation to every target concurrently. Answers
+// are streamed section by section in the order the models were given, later
+// sections are buffered while the earlier ones are still printing.
+func runFanOut(targets []fanOutTarget, messages []Message, compare bool, printCost bool) error {
+	results := make([]*fanOutResult, len(targets))
+
+	for i, target := range targets {
+		res := &fanOutResult{chunks: make(chan string, 1<<14)}
+		results[i] = res
+
+		go func(target fanOutTarget) {
+			defer close(res.chunks)
+
+			ch, err := target.Api(context.Background(), messages)
+			if err != nil {
+				res.err = err
+				return
+			}
+			for content := range ch {
+				res.chunks <- content
+			}
+		}(target)
+	}
+
+	headerStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("171"))
+
+	var firstErr error
+
+	for i, target := range targets {
+		res := results[i]
+
+		if !compare {
+			fmt.Printf("%s\n\n", headerStyle.Render("## "+target.Model))
+		}
+
+		for content := range res.chunks {
+			res.answer.WriteString(content)
+			if !compare {
+				fmt.Print(content)
+			}
+		}
+
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !compare {
+				fmt.Printf("error: %s", withErrorHint(res.err))
+			}
+		}
+
+		if !compare {
+			fmt.Print("\n\n")
+			if printCost {
+				target.Usage.Print()
+			}
+		}
+
+		for _, msg := range messages {
+			dumpMessageToHistory(target.Session, msg)
+		}
+		if res.err == nil {
+			dumpMessageToHistory(target.Session, *NewMessage("assistant", res.answer.String()))
+		}
+	}
+
+	if compare {
+		width := 160 // columns stay readable when redirected to a file
+		if terminal().Stdout {
+			width = terminal().Width
+		}
+		fmt.Println(formatComparison(targets, results, width))
+		if printCost {
+			for _, target := range targets {
+				target.Usage.Print()
+			}
+		}
+	}
+
+	return firstErr
+}
+
+func formatComparison(targets []fanOutTarget, results []*fanOutResult, width int) string {
+	const gap = 3
+
+	colWidth := (width - gap*(len(targets)-1)) / len(targets)
+	if colWidth < 20 {
+		colWidth = 20
+	}
+
+	headerStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("171"))
+	colStyle := lipgloss.NewStyle().Width(colWidth)
+	sep := strings.Repeat(" ", gap)
+
+	var cols []string
+	for i, target := range targets {
+		body := strings.TrimSpace(results[i].answer.String())
+		if results[i].err != nil {
+			body = "error: " + results[i].err.Error()
+		}
+
+		col := colStyle.Render(headerStyle.Render(target.Model) + "\n" + strings.Repeat("─", colWidth) + "\n" + body)
+		if i > 0 {
+			cols = append(cols, sep)
+		}
+		cols = append(cols, col)
+	}
+
+	return lipgloss.JoinHorizontal(lipgloss.Top, cols...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+const defaultFollowPrompt = "Summarize the new log lines, point out errors and anything unusual."
+
+// followBatches groups the lines of a never-ending input into batches of
+// every lines, a partial batch is flushed after interval without a full one
+// and when the input ends
+func followBatches(r io.Reader, every int, interval time.Duration) <-chan []string {
+	lines := make(chan string)
+	batches := make(chan []string)
+
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	go func() {
+		defer close(batches)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var batch []string
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					if len(batch) > 0 {
+						batches <- batch
+					}
+					return
+				}
+				batch = append(batch, line)
+				if len(batch) >= every {
+					batches <- batch
+					batch = nil
+					ticker.Reset(interval)
+				}
+			case <-ticker.C:
+				if len(batch) > 0 {
+					batches <- batch
+					batch = nil
+				}
+			}
+		}
+	}()
+
+	return batches
+}
+
+// runFollow sends every batch of new input lines together with the previous
+// analysis, so the model reports on what changed instead of starting over
+func runFollow(r io.Reader, every int, interval time.Duration, prompt string, systemPrompt string, llmApi func(context.Context, []Message) (<-chan string, error), llmHistory func(Message) error) error {
+	if strings.TrimSpace(prompt) == "" {
+		prompt = defaultFollowPrompt
+	}
+
+	headerStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("171"))
+
+	var previous string
+	for batch := range followBatches(r, every, interval) {
+		var content strings.Builder
+		content.WriteString(prompt)
+		if previous != "" {
+			fmt.Fprintf(&content, "\n\nYour analysis of the preceding lines:\n%s", previous)
+		}
+		fmt.Fprintf(&content, "\n\nNew lines:\n```\n%s\n```", strings.Join(batch, "\n"))
+
+		messages := []Message{}
+		if strings.TrimSpace(systemPrompt) != "" {
+			messages = append(messages, *NewMessage("system", systemPrompt))
+		}
+		userMsg := NewMessage("user", content.String())
+		messages = append(messages, *userMsg)
+		llmHistory(*userMsg)
+
+		fmt.Printf("%s\n\n", headerStyle.Render(fmt.Sprintf("## %s, %d new lines", time.Now().Format("15:04:05"), len(batch))))
+
+		ch, err := llmApi(context.Background(), messages)
+		if err != nil {
+			return err
+		}
+
+		var answer strings.Builder
+		for chunk := range ch {
+			answer.WriteString(chunk)
+			fmt.Print(chunk)
+		}
+		fmt.Print("\n\n")
+
+		previous = answer.String()
+		llmHistory(*NewMessage("assistant", previous))
+	}
+
+	return nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// a recognizer for llama.cpp GBNF grammars, to check locally that an answer
+// generated with --grammar follows it. Supports literals, character classes,
+// ".", rule references, grouping, alternatives and the * + ? {m,n}
+// repetitions. Like llama.cpp it doesn't support left recursion.
+
+type gbnfKind int
+
+const (
+	gbnfLiteral gbnfKind = iota
+	gbnfClass
+	gbnfAny
+	gbnfRef
+	gbnfSeq
+	gbnfAlt
+	gbnfRepeat
+)
+
+type gbnfRange struct{ lo, hi rune }
+
+type gbnfNode struct {
+	kind     gbnfKind
+	literal  []rune
+	ranges   []gbnfRange
+	negated  bool
+	ref      string
+	children []*gbnfNode
+	min, max int // of gbnfRepeat, max -1 for unbounded
+}
+
+type gbnfGrammar struct {
+	rules map[string]*gbnfNode
+}
+
+type gbnfParser struct {
+	src []rune
+	pos int
+}
+
+func parseGBNF(src string) (*gbnfGrammar, error) {
+	p := &gbnfParser{src: []rune(src)}
+	g := &gbnfGrammar{rules: map[string]*gbnfNode{}}
+
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.src) {
+			break
+		}
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("expected a rule name")
+		}
+		p.skipSpace(true)
+		if !p.consume("::=") {
+			return nil, p.errorf("expected ::= after %s", name)
+		}
+		body, err := p.alternatives()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := g.rules[name]; ok {
+			return nil, fmt.Errorf("grammar: rule %s is defined twice", name)
+		}
+		g.rules[name] = body
+	}
+
+	if _, ok := g.rules["root"]; !ok {
+		return nil, fmt.Errorf("grammar: no root rule")
+	}
+	for name, rule := range g.rules {
+		if missing := g.undefinedRef(rule); missing != "" {
+			return nil, fmt.Errorf("grammar: rule %s refers to undefined rule %s", name, missing)
+		}
+	}
+	return g, nil
+}
+
+func (g *gbnfGrammar) undefinedRef(n *gbnfNode) string {
+	if n.kind == gbnfRef {
+		if _, ok := g.rules[n.ref]; !ok {
+			return n.ref
+		}
+	}
+	for _, c := range n.children {
+		if missing := g.undefinedRef(c); missing != "" {
+			return missing
+		}
+	}
+	return ""
+}
+
+func (p *gbnfParser) errorf(format string, args ...interface{}) error {
+	line := 1 + strings.Count(string(p.src[:p.pos]), "\n")
+	return fmt.Errorf("grammar: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips blanks and comments, newlines only with newlines set as
+// they end a rule
+func (p *gbnfParser) skipSpace(newlines bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' || c == '\r':
+			if !newlines {
+				return
+			}
+			p.pos++
+		case c == ' ' || c == '\t':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *gbnfParser) consume(s string) bool {
+	if strings.HasPrefix(string(p.src[p.pos:min(p.pos+len(s), len(p.src))]), s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *gbnfParser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] == '-' || p.src[p.pos] == '_' || unicode.IsLetter(p.src[p.pos]) || unicode.IsDigit(p.src[p.pos])) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+// atRuleStart tells if a new rule (name ::=) begins at the position
+func (p *gbnfParser) atRuleStart() bool {
+	save := p.pos
+	defer func() { p.pos = save }()
+	if p.name() == "" {
+		return false
+	}
+	p.skipSpace(false)
+	return p.consume("::=")
+}
+
+// alternatives parses a rule body or a group, a rule ends at a newline
+// followed by the next rule, a group at ")"
+func (p *gbnfParser) alternatives() (*gbnfNode, error) {
+	alt := &gbnfNode{kind: gbnfAlt}
+	seq := &gbnfNode{kind: gbnfSeq}
+
+	for {
+		p.skipSpace(false)
+		if p.pos < len(p.src) && (p.src[p.pos] == '\n' || p.src[p.pos] == '\r') {
+			// a body may continue on the next lines
+			p.skipSpace(true)
+			if p.pos >= len(p.src) || p.atRuleStart() {
+				break
+			}
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] == ')' {
+			break
+		}
+
+		if p.src[p.pos] == '|' {
+			p.pos++
+			alt.children = append(alt.children, seq)
+			seq = &gbnfNode{kind: gbnfSeq}
+			continue
+		}
+
+		item, err := p.item()
+		if err != nil {
+			return nil, err
+		}
+		seq.children = append(seq.children, item)
+	}
+
+	alt.children = append(alt.children, seq)
+	return alt, nil
+}
+
+func (p *gbnfParser) item() (*gbnfNode, error) {
+	var n *gbnfNode
+
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		p.pos++
+		var lit []rune
+		for {
+			if p.pos >= len(p.src) {
+				return nil, p.errorf("unterminated string")
+			}
+			if p.src[p.pos] == '"' {
+				p.pos++
+				break
+			}
+			r, err := p.char()
+			if err != nil {
+				return nil, err
+			}
+			lit = append(lit, r)
+		}
+		n = &gbnfNode{kind: gbnfLiteral, literal: lit}
+
+	case c == '[':
+		p.pos++
+		n = &gbnfNode{kind: gbnfClass}
+		if p.pos < len(p.src) && p.src[p.pos] == '^' {
+			n.negated = true
+			p.pos++
+		}
+		for {
+			if p.pos >= len(p.src) {
+				return nil, p.errorf("unterminated character class")
+			}
+			if p.src[p.pos] == ']' {
+				p.pos++
+				break
+			}
+			lo, err := p.char()
+			if err != nil {
+				return nil, err
+			}
+			hi := lo
+			if p.pos+1 < len(p.src) && p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+				p.pos++
+				if hi, err = p.char(); err != nil {
+					return nil, err
+				}
+			}
+			n.ranges = append(n.ranges, gbnfRange{lo, hi})
+		}
+
+	case c == '.':
+		p.pos++
+		n = &gbnfNode{kind: gbnfAny}
+
+	case c == '(':
+		p.pos++
+		group, err := p.alternatives()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace(true)
+		if !p.consume(")") {
+			return nil, p.errorf("expected )")
+		}
+		n = group
+
+	default:
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("unexpected %q", c)
+		}
+		n = &gbnfNode{kind: gbnfRef, ref: name}
+	}
+
+	// repetitions
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '*':
+			n = &gbnfNode{kind: gbnfRepeat, children: []*gbnfNode{n}, min: 0, max: -1}
+		case '+':
+			n = &gbnfNode{kind: gbnfRepeat, children: []*gbnfNode{n}, min: 1, max: -1}
+		case '?':
+			n = &gbnfNode{kind: gbnfRepeat, children: []*gbnfNode{n}, min: 0, max: 1}
+		case '{':
+			end := slices.Index(p.src[p.pos:], '}')
+			if end < 0 {
+				return nil, p.errorf("unterminated {m,n}")
+			}
+			spec := string(p.src[p.pos+1 : p.pos+end])
+			lo, hi, found := strings.Cut(spec, ",")
+			m, err := strconv.Atoi(strings.TrimSpace(lo))
+			if err != nil {
+				return nil, p.errorf("invalid repetition {%s}", spec)
+			}
+			upper := m
+			if found {
+				upper = -1
+				if hi = strings.TrimSpace(hi); hi != "" {
+					if upper, err = strconv.Atoi(hi); err != nil || upper < m {
+						return nil, p.errorf("invalid repetition {%s}", spec)
+					}
+				}
+			}
+			n = &gbnfNode{kind: gbnfRepeat, children: []*gbnfNode{n}, min: m, max: upper}
+			p.pos += end
+		default:
+			return n, nil
+		}
+		p.pos++
+	}
+	return n, nil
+}
+
+// char reads a possibly escaped character of a string or class
+func (p *gbnfParser) char() (rune, error) {
+	c := p.src[p.pos]
+	p.pos++
+	if c != '\\' {
+		return c, nil
+	}
+	if p.pos >= len(p.src) {
+		return 0, p.errorf("unterminated escape")
+	}
+	c = p.src[p.pos]
+	p.pos++
+	digits := 0
+	switch c {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	default:
+		return c, nil
+	}
+	if p.pos+digits > len(p.src) {
+		return 0, p.errorf("invalid escape")
+	}
+	v, err := strconv.ParseUint(string(p.src[p.pos:p.pos+digits]), 16, 32)
+	if err != nil {
+		return 0, p.errorf("invalid escape")
+	}
+	p.pos += digits
+	return rune(v), nil
+}
+
+// Match tells if the whole text is generated by the root rule
+func (g *gbnfGrammar) Match(text string) bool {
+	m := &gbnfMatcher{g: g, input: []rune(text), memo: map[gbnfMemoKey][]int{}}
+	for _, end := range m.match(&gbnfNode{kind: gbnfRef, ref: "root"}, 0) {
+		if end == len(m.input) {
+			return true
+		}
+	}
+	return false
+}
+
+type gbnfMemoKey struct {
+	rule string
+	pos  int
+}
+
+type gbnfMatcher struct {
+	g     *gbnfGrammar
+	input []rune
+	memo  map[gbnfMemoKey][]int
+}
+
+// match returns the sorted positions n can end at when starting at pos
+func (m *gbnfMatcher) match(n *gbnfNode, pos int) []int {
+	switch n.kind {
+	case gbnfLiteral:
+		if pos+len(n.literal) > len(m.input) {
+			return nil
+		}
+		for i, r := range n.literal {
+			if m.input[pos+i] != r {
+				return nil
+			}
+		}
+		return []int{pos + len(n.literal)}
+
+	case gbnfClass:
+		if pos >= len(m.input) {
+			return nil
+		}
+		in := false
+		for _, r := range n.ranges {
+			if m.input[pos] >= r.lo && m.input[pos] <= r.hi {
+				in = true
+				break
+			}
+		}
+		if in == n.negated {
+			return nil
+		}
+		return []int{pos + 1}
+
+	case gbnfAny:
+		if pos >= len(m.input) {
+			return nil
+		}
+		return []int{pos + 1}
+
+	case gbnfRef:
+		key := gbnfMemoKey{n.ref, pos}
+		if ends, ok := m.memo[key]; ok {
+			return ends
+		}
+		m.memo[key] = nil // left recursion matches nothing
+		ends := m.match(m.g.rules[n.ref], pos)
+		m.memo[key] = ends
+		return ends
+
+	case gbnfSeq:
+		cur := []int{pos}
+		for _, c := range n.children {
+			var next []int
+			for _, p := range cur {
+				next = append(next, m.match(c, p)...)
+			}
+			if cur = uniqueSorted(next); len(cur) == 0 {
+				return nil
+			}
+		}
+		return cur
+
+	case gbnfAlt:
+		var ends []int
+		for _, c := range n.children {
+			ends = append(ends, m.match(c, pos)...)
+		}
+		return uniqueSorted(ends)
+
+	case gbnfRepeat:
+		var ends []int
+		if n.min == 0 {
+			ends = append(ends, pos)
+		}
+		cur := []int{pos}
+		seen := map[int]bool{}
+		for i := 1; n.max < 0 || i <= n.max; i++ {
+			var next []int
+			for _, p := range cur {
+				for _, end := range m.match(n.children[0], p) {
+					// beyond the minimum, empty matches and positions
+					// reached before don't lead anywhere new
+					if i <= n.min || (end > p && !seen[end]) {
+						next = append(next, end)
+					}
+				}
+			}
+			if cur = uniqueSorted(next); len(cur) == 0 {
+				break
+			}
+			if i >= n.min {
+				for _, p := range cur {
+					seen[p] = true
+				}
+				ends = append(ends, cur...)
+			}
+		}
+		return uniqueSorted(ends)
+	}
+	return nil
+}
+
+func uniqueSorted(ns []int) []int {
+	if len(ns) < 2 {
+		return ns
+	}
+	sort.Ints(ns)
+	ret := ns[:1]
+	for _, n := range ns[1:] {
+		if n != ret[len(ret)-1] {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
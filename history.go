@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+)
+
+func historyDirPath() (string, error) {
+	configDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, ".config/llmcli"), nil
+}
+
+func historyFilePath() (string, error) {
+	historyDir, err := historyDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(historyDir, "history.jsonl"), nil
+}
+
+func dumpMessageToHistory(session *Session, msg Message) error {
+	data := struct {
+		ID      string  `json:"uuid"`
+		SID     string  `json:"sid"`
+		TS      int     `json:"ts"`
+		Message Message `json:"msg"`
+	}{
+		ID:      msg.UUID,
+		SID:     session.UUID,
+		TS:      int(time.Now().Unix()),
+		Message: msg,
+	}
+
+	return dumpToHistory(session, data)
+}
+
+// historyRecord is the union of the records written by markChatStart and the
+// per-message history callback
+type historyRecord struct {
+	UUID         string       `json:"uuid"`
+	SID          string       `json:"sid"`
+	TS           int          `json:"ts"`
+	Msg          *Message     `json:"msg"`
+	Usage        *usageRecord `json:"usage"`
+	UserMsg      string       `json:"user_msg"`
+	SystemPrompt string       `json:"system_prompt"`
+	Model        string       `json:"model"`
+}
+
+func (r historyRecord) isSessionStart() bool {
+	return r.Msg == nil && r.Usage == nil && r.SID != ""
+}
+
+func readHistory(fn func(rec historyRecord) error) error {
+	if err := syncHistory(); err != nil {
+		slog.Warn("reading the history without the latest records", "err", err)
+	}
+
+	historyFile, err := historyFilePath()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(historyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f, false); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+type sessionTranscript struct {
+	SID          string
+	Model        string
+	Start        time.Time
+	UserMsg      string
+	SystemPrompt string
+	Messages     []Message
+	order        int // of the first record in the history
+}
+
+func loadSessionTranscripts() (map[string]*sessionTranscript, error) {
+	sessions := map[string]*sessionTranscript{}
+
+	getSession := func(sid string, ts int) *sessionTranscript {
+		s, ok := sessions[sid]
+		if !ok {
+			s = &sessionTranscript{SID: sid, Start: time.Unix(int64(ts), 0), order: len(sessions)}
+			sessions[sid] = s
+		}
+		return s
+	}
+
+	err := readHistory(func(rec historyRecord) error {
+		if rec.SID == "" {
+			return nil
+		}
+
+		if rec.Usage != nil {
+			return nil
+		}
+
+		s := getSession(rec.SID, rec.TS)
+
+		if rec.isSessionStart() {
+			s.Model = rec.Model
+			s.UserMsg = rec.UserMsg
+			s.SystemPrompt = rec.SystemPrompt
+			return nil
+		}
+
+		if rec.Msg.Role == "__sys__" {
+			var op struct {
+				Sysop string `json:"sysop"`
+				ID    string `json:"id"`
+			}
+			if json.Unmarshal([]byte(rec.Msg.Content), &op) == nil && op.Sysop == "remove_msg" {
+				for i, msg := range s.Messages {
+					if msg.UUID == op.ID {
+						s.Messages = append(s.Messages[:i], s.Messages[i+1:]...)
+						break
+					}
+				}
+			}
+			return nil
+		}
+
+		// streamed answers are logged once complete, a later record for the same
+		// uuid supersedes the earlier one
+		for i, msg := range s.Messages {
+			if msg.UUID == rec.Msg.UUID {
+				s.Messages[i] = *rec.Msg
+				return nil
+			}
+		}
+		s.Messages = append(s.Messages, *rec.Msg)
+
+		return nil
+	})
+
+	// the system prompt is only in the session start, so is the question of
+	// pipe mode, which records just the answer
+	for _, s := range sessions {
+		var head []Message
+		if len(strings.TrimSpace(s.SystemPrompt)) > 0 {
+			head = append(head, Message{Role: "system", Content: s.SystemPrompt})
+		}
+		if len(s.UserMsg) > 0 && (len(s.Messages) == 0 || s.Messages[0].Role != "user") {
+			head = append(head, Message{Role: "user", Content: s.UserMsg})
+		}
+		s.Messages = append(head, s.Messages...)
+	}
+
+	return sessions, err
+}
+
+func findSessionTranscript(prefix string) (*sessionTranscript, error) {
+	sessions, err := loadSessionTranscripts()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*sessionTranscript
+	for sid, s := range sessions {
+		if strings.HasPrefix(sid, prefix) {
+			matches = append(matches, s)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no session matches %q", prefix)
+	case 1:
+		return matches[0], nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Start.Before(matches[j].Start) })
+
+	var ids []string
+	for _, s := range matches {
+		ids = append(ids, fmt.Sprintf("  %s  %s", s.SID, s.Start.Format(time.DateTime)))
+	}
+	return nil, fmt.Errorf("%q is ambiguous, matching sessions:\n%s", prefix, strings.Join(ids, "\n"))
+}
+
+// lastSessionTranscript returns the session started last, what -F follows
+// up on
+func lastSessionTranscript() (*sessionTranscript, error) {
+	sessions, err := loadSessionTranscripts()
+	if err != nil {
+		return nil, err
+	}
+	var ret *sessionTranscript
+	for _, s := range sessions {
+		if ret == nil || s.order > ret.order {
+			ret = s
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("no session in the history to follow up on")
+	}
+	return ret, nil
+}
+
+var roleStyles = map[string]lipgloss.Style{
+	"system":    lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("244")),
+	"user":      lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("39")),
+	"assistant": lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("171")),
+}
+
+func formatTranscript(s *sessionTranscript, raw bool, renderMarkdown bool, width int) string {
+	var ret strings.Builder
+
+	if !raw {
+		header := fmt.Sprintf("session %s  %s", s.SID, s.Start.Format(time.DateTime))
+		if s.Model != "" {
+			header += "  " + s.Model
+		}
+		ret.WriteString(lipgloss.NewStyle().Faint(true).Render(header) + "\n\n")
+	}
+
+	for _, msg := range s.Messages {
+		content := strings.TrimRight(msg.Content, " \t\r\n")
+		role := strings.ToUpper(msg.Role)
+
+		if raw {
+			fmt.Fprintf(&ret, "### %s:\n%s\n\n", role, content)
+			continue
+		}
+
+		if style, ok := roleStyles[msg.Role]; ok {
+			role = style.Render(role)
+		}
+		if renderMarkdown {
+			content = strings.TrimRight(mdRenderer.Render(content, width, 0), " \t\r\n")
+		}
+
+		fmt.Fprintf(&ret, "%s\n%s\n\n", role, content)
+	}
+
+	return ret.String()
+}
+
+func newHistoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "history",
+		Short:   "Inspect the chat history",
+		GroupID: "data",
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show <session-uuid-prefix>",
+		Short: "Print the transcript of a past session",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			raw, _ := cmd.Flags().GetBool("raw")
+			renderMarkdown, _ := cmd.Flags().GetBool("markdown")
+			// the default was decided before --plain was read
+			if !cmd.Flags().Changed("markdown") {
+				renderMarkdown = terminal().Markdown()
+			}
+
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			if err := setMarkdownRenderer(cfg); err != nil {
+				return err
+			}
+
+			s, err := findSessionTranscript(args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(formatTranscript(s, raw, renderMarkdown, terminal().Width))
+			return nil
+		},
+	}
+
+	showCmd.Flags().Bool("raw", false, "Plain text output without colors or markdown rendering")
+	showCmd.Flags().Bool("markdown", terminal().Markdown(), "Render messages as markdown")
+
+	attachmentsCmd := &cobra.Command{
+		Use:   "attachments <session-uuid-prefix>",
+		Short: "Save the images attached to the messages of a past session as files",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			outDir, _ := cmd.Flags().GetString("out")
+
+			s, err := findSessionTranscript(args[0])
+			if err != nil {
+				return err
+			}
+
+			n, err := saveAttachments(s, outDir)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fmt.Fprintf(os.Stderr, "session %s has no attached images\n", s.SID)
+			}
+			return nil
+		},
+	}
+
+	attachmentsCmd.Flags().StringP("out", "o", ".", "Directory to save the images to, created if missing")
+
+	cmd.AddCommand(showCmd)
+	cmd.AddCommand(attachmentsCmd)
+	cmd.AddCommand(newHistoryExportCmd())
+
+	return cmd
+}
+
+var imageExtensions = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// decodeImageDataURL returns the bytes and the file extension of a data URL
+// image, ok is false for a link
+func decodeImageDataURL(image string) (data []byte, ext string, ok bool, err error) {
+	header, payload, found := strings.Cut(image, ",")
+	if !found || !strings.HasPrefix(header, "data:") || !strings.HasSuffix(header, ";base64") {
+		return nil, "", false, nil
+	}
+
+	mime := strings.TrimSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+	ext, known := imageExtensions[mime]
+	if !known {
+		ext = "bin"
+	}
+
+	data, err = base64.StdEncoding.DecodeString(payload)
+	return data, ext, true, err
+}
+
+// saveAttachments writes the data URL images of the session into outDir as
+// <message number>-<role>-<image number>.<ext> and prints their paths
+func saveAttachments(s *sessionTranscript, outDir string) (int, error) {
+	n := 0
+	for i, msg := range s.Messages {
+		for j, image := range msg.Images {
+			data, ext, ok, err := decodeImageDataURL(image)
+			if !ok {
+				// a link to an image, nothing to extract
+				fmt.Fprintf(os.Stderr, "message %d: skipping %s\n", i+1, image)
+				continue
+			}
+			if err != nil {
+				return n, fmt.Errorf("message %d, image %d: %w", i+1, j+1, err)
+			}
+
+			if n == 0 {
+				if err := os.MkdirAll(outDir, 0o755); err != nil {
+					return n, err
+				}
+			}
+			path := filepath.Join(outDir, fmt.Sprintf("%02d-%s-%d.%s", i+1, msg.Role, j+1, ext))
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				return n, err
+			}
+			fmt.Println(path)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type HistoryConfig struct {
+	Enabled *bool  `yaml:"enabled"` // default true
+	Fsync   string `yaml:"fsync"`   // never (default, the OS decides) or always
+}
+
+// historyWriter appends history records in the background so a slow disk
+// doesn't delay sending messages. Records queued while a write is in
+// progress go out together in the next one, as a single write under an
+// exclusive lock so parallel llm processes never interleave partial lines.
+// While writes fail, queueing a record and syncing return the error of the
+// latest one, closing reports them all. The records of a failed write are
+// lost.
+type historyWriter struct {
+	records chan []byte
+	syncs   chan chan struct{}
+	done    chan struct{}
+	fsync   bool
+
+	f   *os.File
+	buf bytes.Buffer
+
+	mu       sync.Mutex
+	lastErr  error // of the latest write
+	failure  error // the latest failed write
+	failures int
+}
+
+func startHistoryWriter() *historyWriter {
+	w := &historyWriter{
+		records: make(chan []byte, 256),
+		syncs:   make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if cfg, err := loadConfig(); err == nil {
+		w.fsync = cfg.History.Fsync == "always"
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *historyWriter) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case rec, ok := <-w.records:
+			if !ok {
+				w.flush()
+				if w.f != nil {
+					w.f.Close()
+				}
+				return
+			}
+			w.write(rec)
+			// drain what queued up meanwhile before touching the disk
+			for pending := len(w.records); pending > 0; pending-- {
+				w.write(<-w.records)
+			}
+			w.flush()
+		case ack := <-w.syncs:
+			for pending := len(w.records); pending > 0; pending-- {
+				w.write(<-w.records)
+			}
+			w.flush()
+			close(ack)
+		}
+	}
+}
+
+func (w *historyWriter) write(rec []byte) {
+	w.buf.Write(rec)
+}
+
+func (w *historyWriter) flush() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	defer w.buf.Reset()
+
+	err := w.append(w.buf.Bytes())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastErr = err
+	if err != nil {
+		w.failure = err
+		w.failures++
+	}
+}
+
+func (w *historyWriter) err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lastErr != nil {
+		return fmt.Errorf("history: %w", w.lastErr)
+	}
+	return nil
+}
+
+// closeErr sums up the failed writes, once all are done
+func (w *historyWriter) closeErr() error {
+	switch {
+	case w.failures == 1:
+		return fmt.Errorf("history: %w", w.failure)
+	case w.failures > 1:
+		return fmt.Errorf("history: %d writes failed, the latest: %w", w.failures, w.failure)
+	}
+	return nil
+}
+
+func (w *historyWriter) append(data []byte) error {
+	if w.f == nil {
+		historyFile, err := historyFilePath()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(historyFile), 0o755); err != nil {
+			return err
+		}
+		w.f, err = os.OpenFile(historyFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := lockFile(w.f, true); err != nil {
+		return err
+	}
+	defer unlockFile(w.f)
+
+	if _, err := w.f.Write(data); err != nil {
+		return err
+	}
+	if w.fsync {
+		return w.f.Sync()
+	}
+
+	return nil
+}
+
+// historyOut holds the writer, records are queued under the read lock so
+// closing waits for the sends in progress. Once closed, records of
+// goroutines still running (a cancelled --race request, the chat after
+// quitting) are refused.
+var historyOut struct {
+	sync.RWMutex
+	w      *historyWriter
+	closed bool
+}
+
+var errHistoryClosed = errors.New("history: already closed, record dropped")
+
+// appendHistory queues a newline terminated JSON record, the error is of
+// the records written before
+func appendHistory(rec []byte) error {
+	if cfg, err := loadConfig(); err == nil && cfg.History.Enabled != nil && !*cfg.History.Enabled {
+		return nil
+	}
+
+	historyOut.Lock()
+	if historyOut.w == nil && !historyOut.closed {
+		historyOut.w = startHistoryWriter()
+	}
+	historyOut.Unlock()
+
+	historyOut.RLock()
+	defer historyOut.RUnlock()
+	w := historyOut.w
+	if w == nil {
+		return errHistoryClosed
+	}
+	w.records <- rec
+	return w.err()
+}
+
+// syncHistory waits until the records queued so far are written, so reading
+// the history sees them
+func syncHistory() error {
+	historyOut.RLock()
+	defer historyOut.RUnlock()
+
+	if w := historyOut.w; w != nil {
+		ack := make(chan struct{})
+		w.syncs <- ack
+		<-ack
+		return w.err()
+	}
+	return nil
+}
+
+// closeHistory writes the pending records, call it before exiting
+func closeHistory() error {
+	historyOut.Lock()
+	defer historyOut.Unlock()
+
+	historyOut.closed = true
+	if w := historyOut.w; w != nil {
+		close(w.records)
+		<-w.done
+		historyOut.w = nil
+		return w.closeErr()
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+var defaultInstructionFiles = []string{"AGENTS.md", "LLM.md", ".cursorrules"}
+
+type InstructionsConfig struct {
+	Files []string `yaml:"files"` // looked up in the repository root, an empty list disables them
+}
+
+// findRepoRoot returns the closest directory containing .git, or the working
+// directory outside of a repository
+func findRepoRoot() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for dir := wd; ; {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return wd, nil
+		}
+		dir = parent
+	}
+}
+
+type instructionFile struct {
+	Path    string
+	Name    string
+	Content string
+}
+
+// projectInstructionFiles reads the project convention files (AGENTS.md and
+// the like) of the current repository, empty ones are skipped
+func projectInstructionFiles(cfg *Config) ([]instructionFile, error) {
+	files := cfg.Instructions.Files
+	if files == nil {
+		files = defaultInstructionFiles
+	}
+
+	root, err := findRepoRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []instructionFile
+	for _, name := range files {
+		path := filepath.Join(root, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if strings.TrimSpace(string(data)) == "" {
+			continue
+		}
+		ret = append(ret, instructionFile{Path: path, Name: name, Content: string(data)})
+	}
+
+	return ret, nil
+}
+
+func formatProjectInstructions(files []instructionFile) string {
+	var ret strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&ret, "Project instructions (%s):\n%s\n\n", f.Name, strings.TrimSpace(f.Content))
+	}
+	return strings.TrimSpace(ret.String())
+}
+
+// loadProjectInstructions returns the project convention files formatted for
+// the system prompt
+func loadProjectInstructions(cfg *Config) (string, error) {
+	files, err := projectInstructionFiles(cfg)
+	if err != nil {
+		return "", err
+	}
+	return formatProjectInstructions(files), nil
+}
+
+const maxSystemPromptSize = 256 << 10
+
+// loadSystemPrompt resolves -p @path (a file) and -p - (stdin), @@ escapes
+// a prompt starting with @. fromStdin reports that stdin was used up.
+func loadSystemPrompt(value string) (prompt string, fromStdin bool, err error) {
+	var data []byte
+
+	switch {
+	case value == "-":
+		if terminal().Stdin {
+			fmt.Fprintln(os.Stderr, "Reading the system prompt from stdin, end it with Ctrl-D")
+		}
+		data, err = io.ReadAll(io.LimitReader(os.Stdin, maxSystemPromptSize+1))
+		if err != nil {
+			return "", true, fmt.Errorf("reading the system prompt from stdin: %w", err)
+		}
+		fromStdin = true
+	case strings.HasPrefix(value, "@@"):
+		return value[1:], false, nil
+	case strings.HasPrefix(value, "@"):
+		path := value[1:]
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", false, fmt.Errorf("system prompt file: %w", err)
+		}
+		if info.IsDir() {
+			return "", false, fmt.Errorf("system prompt file %s is a directory", path)
+		}
+		if info.Size() > maxSystemPromptSize {
+			return "", false, fmt.Errorf("system prompt file %s is larger than %d KiB", path, maxSystemPromptSize>>10)
+		}
+		if data, err = os.ReadFile(path); err != nil {
+			return "", false, err
+		}
+	default:
+		return value, false, nil
+	}
+
+	if len(data) > maxSystemPromptSize {
+		return "", fromStdin, fmt.Errorf("the system prompt is larger than %d KiB", maxSystemPromptSize>>10)
+	}
+	return strings.TrimSpace(string(data)), fromStdin, nil
+}
+
+// appendSystemPrompt adds a section to the system prompt
+func appendSystemPrompt(systemPrompt string, section string) string {
+	if section == "" {
+		return systemPrompt
+	}
+	if strings.TrimSpace(systemPrompt) == "" {
+		return section
+	}
+	return systemPrompt + "\n\n" + section
+}
+
+// withSystemSection adds a section to the system message of a request,
+// creating one when there is none
+func withSystemSection(messages []llmclient.Message, section string) []llmclient.Message {
+	if section == "" {
+		return messages
+	}
+
+	if len(messages) > 0 && messages[0].Role == "system" {
+		ret := append([]llmclient.Message{}, messages...)
+		ret[0].Content = appendSystemPrompt(ret[0].Content, section)
+		return ret
+	}
+
+	return append([]llmclient.Message{{Role: "system", Content: section}}, messages...)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// validation of answers against the -J schema, covering the keywords used
+// for structured output: type, enum, const, the number, string, array and
+// object constraints, allOf/anyOf/oneOf/not, if/then/else and local $refs.
+// Unknown keywords (format, ...) are ignored.
+
+type schemaValidator struct {
+	root interface{}
+	errs []string
+}
+
+// validateJSONSchema returns the violations of the answer, one per line
+func validateJSONSchema(schema interface{}, answer string) []string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(answer), &value); err != nil {
+		return []string{"not valid JSON: " + describeJSONError(answer, err)}
+	}
+	v := &schemaValidator{root: schema}
+	v.validate(schema, value, "")
+	return v.errs
+}
+
+// describeJSONError adds the line and column of a syntax error, the offset
+// alone is no help in a long answer
+func describeJSONError(text string, err error) string {
+	var syntax *json.SyntaxError
+	if !errors.As(err, &syntax) {
+		return err.Error()
+	}
+	// the offset is past the offending byte
+	at := min(max(int(syntax.Offset)-1, 0), len(text))
+	before := text[:at]
+	line := strings.Count(before, "\n") + 1
+	column := len(before) - strings.LastIndex(before, "\n")
+	return fmt.Sprintf("line %d, column %d: %s, near %q", line, column, err, text[max(at-20, 0):min(at+20, len(text))])
+}
+
+func (v *schemaValidator) errorf(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+// valid checks value against schema without reporting
+func (v *schemaValidator) valid(schema, value interface{}, path string) bool {
+	sub := &schemaValidator{root: v.root}
+	sub.validate(schema, value, path)
+	return len(sub.errs) == 0
+}
+
+func (v *schemaValidator) resolve(ref string) (interface{}, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	cur := v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref[1:], "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if cur, ok = c[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			cur = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func jsonType(value interface{}) string {
+	switch x := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == math.Trunc(x) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (v *schemaValidator) validate(schema, value interface{}, path string) {
+	if b, ok := schema.(bool); ok {
+		if !b {
+			v.errorf(path, "no value is allowed here")
+		}
+		return
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		if target, ok := v.resolve(ref); ok {
+			v.validate(target, value, path)
+		} else {
+			v.errorf(path, "the schema refers to unknown %s", ref)
+		}
+	}
+
+	if t, ok := s["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, x := range t {
+				if x, ok := x.(string); ok {
+					types = append(types, x)
+				}
+			}
+		}
+		actual := jsonType(value)
+		matched := false
+		for _, want := range types {
+			if want == actual || (want == "number" && actual == "integer") {
+				matched = true
+			}
+		}
+		if !matched && len(types) > 0 {
+			v.errorf(path, "expected %s, got %s", strings.Join(types, " or "), actual)
+			return
+		}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+			}
+		}
+		if !found {
+			allowed, _ := json.Marshal(enum)
+			v.errorf(path, "must be one of %s", allowed)
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		want, _ := json.Marshal(c)
+		v.errorf(path, "must be %s", want)
+	}
+
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, ok := s[key].([]interface{})
+		if !ok {
+			continue
+		}
+		n := 0
+		for _, sub := range subs {
+			if key == "allOf" {
+				v.validate(sub, value, path)
+			} else if v.valid(sub, value, path) {
+				n++
+			}
+		}
+		if key == "anyOf" && n == 0 {
+			v.errorf(path, "matches none of the anyOf schemas")
+		}
+		if key == "oneOf" && n != 1 {
+			v.errorf(path, "matches %d of the oneOf schemas instead of exactly one", n)
+		}
+	}
+	if not, ok := s["not"]; ok && v.valid(not, value, path) {
+		v.errorf(path, "must not match the \"not\" schema")
+	}
+	if cond, ok := s["if"]; ok {
+		if v.valid(cond, value, path) {
+			if then, ok := s["then"]; ok {
+				v.validate(then, value, path)
+			}
+		} else if els, ok := s["else"]; ok {
+			v.validate(els, value, path)
+		}
+	}
+
+	switch x := value.(type) {
+	case float64:
+		v.validateNumber(s, x, path)
+	case string:
+		v.validateString(s, x, path)
+	case []interface{}:
+		v.validateArray(s, x, path)
+	case map[string]interface{}:
+		v.validateObject(s, x, path)
+	}
+}
+
+func (v *schemaValidator) validateNumber(s map[string]interface{}, x float64, path string) {
+	if lo, ok := s["minimum"].(float64); ok {
+		if exclusive, _ := s["exclusiveMinimum"].(bool); exclusive && x <= lo {
+			v.errorf(path, "must be greater than %v", lo)
+		} else if x < lo {
+			v.errorf(path, "must be at least %v", lo)
+		}
+	}
+	if hi, ok := s["maximum"].(float64); ok {
+		if exclusive, _ := s["exclusiveMaximum"].(bool); exclusive && x >= hi {
+			v.errorf(path, "must be less than %v", hi)
+		} else if x > hi {
+			v.errorf(path, "must be at most %v", hi)
+		}
+	}
+	if lo, ok := s["exclusiveMinimum"].(float64); ok && x <= lo {
+		v.errorf(path, "must be greater than %v", lo)
+	}
+	if hi, ok := s["exclusiveMaximum"].(float64); ok && x >= hi {
+		v.errorf(path, "must be less than %v", hi)
+	}
+	if m, ok := s["multipleOf"].(float64); ok && m > 0 {
+		if q := x / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.errorf(path, "must be a multiple of %v", m)
+		}
+	}
+}
+
+func (v *schemaValidator) validateString(s map[string]interface{}, x string, path string) {
+	n := float64(utf8.RuneCountInString(x))
+	if lo, ok := s["minLength"].(float64); ok && n < lo {
+		v.errorf(path, "must be at least %v characters long", lo)
+	}
+	if hi, ok := s["maxLength"].(float64); ok && n > hi {
+		v.errorf(path, "must be at most %v characters long", hi)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		// patterns Go can't compile aren't checked
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(x) {
+			v.errorf(path, "must match the pattern %s", pattern)
+		}
+	}
+}
+
+func (v *schemaValidator) validateArray(s map[string]interface{}, x []interface{}, path string) {
+	n := float64(len(x))
+	if lo, ok := s["minItems"].(float64); ok && n < lo {
+		v.errorf(path, "must have at least %v items", lo)
+	}
+	if hi, ok := s["maxItems"].(float64); ok && n > hi {
+		v.errorf(path, "must have at most %v items", hi)
+	}
+	if unique, _ := s["uniqueItems"].(bool); unique {
+		for i := range x {
+			for j := i + 1; j < len(x); j++ {
+				if reflect.DeepEqual(x[i], x[j]) {
+					v.errorf(path, "items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+
+	// tuples are prefixItems, or items as a list in older drafts
+	prefix, _ := s["prefixItems"].([]interface{})
+	rest, restOK := s["items"], true
+	if list, ok := s["items"].([]interface{}); ok {
+		prefix = list
+		rest, restOK = s["additionalItems"]
+	}
+	for i, item := range x {
+		itemPath := path + "/" + strconv.Itoa(i)
+		if i < len(prefix) {
+			v.validate(prefix[i], item, itemPath)
+		} else if restOK && rest != nil {
+			v.validate(rest, item, itemPath)
+		}
+	}
+
+	if contains, ok := s["contains"]; ok {
+		found := false
+		for i, item := range x {
+			if v.valid(contains, item, path+"/"+strconv.Itoa(i)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.errorf(path, "must contain an item matching the \"contains\" schema")
+		}
+	}
+}
+
+func (v *schemaValidator) validateObject(s map[string]interface{}, x map[string]interface{}, path string) {
+	n := float64(len(x))
+	if lo, ok := s["minProperties"].(float64); ok && n < lo {
+		v.errorf(path, "must have at least %v properties", lo)
+	}
+	if hi, ok := s["maxProperties"].(float64); ok && n > hi {
+		v.errorf(path, "must have at most %v properties", hi)
+	}
+
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, ok := x[name]; !ok {
+					v.errorf(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+
+	props, _ := s["properties"].(map[string]interface{})
+	patternProps, _ := s["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+
+	// sorted for stable messages
+	names := make([]string, 0, len(x))
+	for name := range x {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propPath := path + "/" + strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+		matched := false
+		if sub, ok := props[name]; ok {
+			v.validate(sub, x[name], propPath)
+			matched = true
+		}
+		for pattern, sub := range patternProps {
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(name) {
+				v.validate(sub, x[name], propPath)
+				matched = true
+			}
+		}
+		if matched || !hasAdditional {
+			continue
+		}
+		if b, ok := additional.(bool); ok && !b {
+			v.errorf(path, "unexpected property %q", name)
+		} else {
+			v.validate(additional, x[name], propPath)
+		}
+	}
+}
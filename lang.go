@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// --lang de (config: lang) asks for answers in a language and checks the
+// beginning of the answer with a small detector: stopwords for languages in
+// Latin script, the script for the others. An answer starting in another
+// language is dropped and asked for again, once.
+
+var languageNames = map[string]string{
+	"ar": "Arabic", "cs": "Czech", "de": "German", "el": "Greek", "en": "English",
+	"es": "Spanish", "fi": "Finnish", "fr": "French", "he": "Hebrew", "hi": "Hindi",
+	"hu": "Hungarian", "it": "Italian", "ja": "Japanese", "ko": "Korean", "nl": "Dutch",
+	"pl": "Polish", "pt": "Portuguese", "ru": "Russian", "sv": "Swedish", "th": "Thai",
+	"tr": "Turkish", "uk": "Ukrainian", "zh": "Chinese",
+}
+
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "of", "to", "in", "that", "it", "for", "with", "this", "you", "not", "be", "on", "as", "can", "was", "have"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "mit", "den", "von", "sie", "es", "auf", "für", "sich", "auch", "dem", "wird"},
+	"fr": {"le", "la", "les", "et", "est", "des", "une", "un", "du", "que", "pas", "pour", "dans", "qui", "sur", "avec", "ce", "vous", "sont", "il"},
+	"es": {"el", "la", "los", "las", "y", "es", "de", "que", "en", "un", "una", "por", "con", "para", "no", "se", "del", "lo", "como", "más"},
+	"it": {"il", "la", "di", "che", "è", "e", "per", "un", "una", "non", "sono", "con", "del", "della", "gli", "le", "si", "da", "come", "anche"},
+	"pt": {"o", "a", "os", "as", "de", "que", "e", "é", "um", "uma", "para", "com", "não", "do", "da", "em", "por", "se", "mais", "você"},
+	"nl": {"de", "het", "een", "en", "is", "van", "dat", "niet", "op", "te", "met", "zijn", "voor", "je", "die", "ook", "er", "maar", "wordt", "aan"},
+	"pl": {"i", "w", "nie", "na", "się", "to", "jest", "z", "że", "do", "jak", "ale", "co", "o", "tak", "są", "dla", "od", "czy", "może"},
+	"sv": {"och", "är", "att", "det", "som", "en", "ett", "på", "för", "med", "inte", "av", "till", "den", "har", "om", "du", "kan", "vi", "de"},
+}
+
+var codeSpanRe = regexp.MustCompile("(?s)```.*?(```|$)|`[^`\n]*`")
+
+// languageSample is how much of the answer is looked at
+const languageSample = 400
+
+// detectLanguage returns the language of text and whether it's sure
+func detectLanguage(text string) (string, bool) {
+	text = codeSpanRe.ReplaceAllString(text, " ")
+
+	var letters, latin int
+	scripts := map[string]int{}
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		case unicode.Is(unicode.Cyrillic, r):
+			scripts["ru"]++
+			if strings.ContainsRune("іїєґІЇЄҐ", r) {
+				scripts["uk"] += 100
+			}
+		case unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r):
+			scripts["ja"] += 10 // kanji are counted as Han
+		case unicode.Is(unicode.Han, r):
+			scripts["zh"]++
+		case unicode.Is(unicode.Hangul, r):
+			scripts["ko"]++
+		case unicode.Is(unicode.Arabic, r):
+			scripts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			scripts["he"]++
+		case unicode.Is(unicode.Greek, r):
+			scripts["el"]++
+		case unicode.Is(unicode.Devanagari, r):
+			scripts["hi"]++
+		case unicode.Is(unicode.Thai, r):
+			scripts["th"]++
+		}
+	}
+	if letters < 20 {
+		return "", false
+	}
+
+	if latin*2 < letters {
+		if scripts["uk"] >= 100 {
+			return "uk", true
+		}
+		best := ""
+		for lang, n := range scripts {
+			if lang != "uk" && (best == "" || n > scripts[best]) {
+				best = lang
+			}
+		}
+		return best, best != ""
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	hits := map[string]int{}
+	for _, w := range words {
+		for lang, stopwords := range languageStopwords {
+			for _, s := range stopwords {
+				if w == s {
+					hits[lang]++
+					break
+				}
+			}
+		}
+	}
+	best, second := "", 0
+	for lang, n := range hits {
+		if best == "" || n > hits[best] {
+			if best != "" {
+				second = max(second, hits[best])
+			}
+			best = lang
+		} else {
+			second = max(second, n)
+		}
+	}
+	return best, best != "" && hits[best] >= 4 && hits[best] >= 2*second
+}
+
+func languageName(lang string) string {
+	if name, ok := languageNames[strings.ToLower(lang)]; ok {
+		return name
+	}
+	return lang
+}
+
+func languageInstruction(lang string) string {
+	return fmt.Sprintf("Always answer in %s, whatever the language of the question or the provided context. Code and identifiers stay as they are.", languageName(lang))
+}
+
+// enforceLanguage holds back the beginning of the answer until its language
+// is known. An answer in another language is cancelled and asked for again,
+// the second answer is passed on as is.
+func enforceLanguage(lang string) llmclient.Middleware {
+	lang = strings.ToLower(lang)
+	if lang == "" {
+		return nil
+	}
+	return func(next llmclient.Handler) llmclient.Handler {
+		return func(req *llmclient.Request) (*llmclient.Response, error) {
+			parent := req.Context
+			if parent == nil {
+				parent = context.Background()
+			}
+			ctx, cancel := context.WithCancel(parent)
+			req.Context = ctx
+
+			resp, err := next(req)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			var head strings.Builder
+			for head.Len() < languageSample {
+				c, ok := <-resp.Chunks
+				if !ok {
+					break
+				}
+				head.WriteString(c)
+			}
+
+			detected, sure := detectLanguage(head.String())
+			if !sure || detected == lang || languageNames[lang] == "" {
+				ch := make(chan string)
+				out := &llmclient.Response{Chunks: ch}
+				go func() {
+					defer cancel()
+					if head.Len() > 0 {
+						ch <- head.String()
+					}
+					for c := range resp.Chunks {
+						ch <- c
+					}
+					out.Usage, out.Complete = resp.Usage, resp.Complete
+					close(ch)
+				}()
+				return out, nil
+			}
+
+			cancel()
+			go func() {
+				for range resp.Chunks {
+				}
+			}()
+
+			slog.Warn(fmt.Sprintf("the answer is in %s instead of %s, asking again", languageName(detected), languageName(lang)))
+			messages, _ := req.Body["messages"].([]interface{})
+			req.Body["messages"] = append(messages, map[string]interface{}{"role": "user", "content": fmt.Sprintf("Answer in %s.", languageName(lang))})
+			req.Context = parent
+			return next(req)
+		}
+	}
+}
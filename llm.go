@@ -2,61 +2,44 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"net/url"
+	"log/slog"
 	"os"
-	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"slices"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/atotto/clipboard"
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
-	"github.com/mattn/go-isatty"
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/mattn/go-runewidth"
 	"github.com/spf13/cobra"
-	markdown "github.com/vlanse/go-term-markdown"
 )
 
 var TEXTINPUT_PLACEHOLDER = "Type a message and press Enter to send..."
 
-func is_interactive(fd uintptr) bool {
-	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
-}
-
-type LLMChatRequestBasic struct {
-	Model       string                 `json:"model"`
-	Seed        int                    `json:"seed"`
-	Temperature float64                `json:"temperature"`
-	Stream      bool                   `json:"stream"`
-	Messages    []LLMMessage           `json:"messages"`
-	Extra       map[string]interface{} `json:"-"`
-}
+var newContentStyle = lipgloss.NewStyle().Reverse(true)
 
 type Message struct {
-	UUID    string `json:"uuid"`
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-type LLMMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	UUID        string   `json:"uuid"`
+	Role        string   `json:"role"`
+	Content     string   `json:"content"`
+	Images      []string `json:"images,omitempty"`
+	Interrupted bool     `json:"interrupted,omitempty"` // the answer was cancelled while streaming
 }
 
 func NewMessage(role, content string) *Message {
@@ -69,331 +52,26 @@ func NewMessage(role, content string) *Message {
 	}
 }
 
-func resolveLLMApi(apiKey string, apiBase string) (string, string, error) {
-	if apiKey == "" {
-		apiKey = os.Getenv("OPENAI_API_KEY")
-	}
-
-	if apiKey == "" && strings.Contains(apiBase, "api.openai.com") {
-		return "", "", fmt.Errorf("must provide OpenAI API key")
-	}
-
-	url := os.Getenv("OPENAI_API_BASE")
-	if url == "" {
-		url = apiBase
-	}
-	url = strings.TrimSuffix(url, "/")
-
-	return apiKey, url, nil
-}
-
-func urlJoin(base, rel string) (string, error) {
-	baseURL, err := url.Parse(base)
-	if err != nil {
-		return "", err
-	}
-
-	relURL, err := url.Parse(rel)
-	if err != nil {
-		return "", err
-	}
-
-	if relURL.Scheme != "" && relURL.Host != "" {
-		return rel, nil
-	}
-
-	joinedPath := path.Join(baseURL.Path, relURL.Path)
-
-	result := &url.URL{
-		Scheme: baseURL.Scheme,
-		User:   baseURL.User,
-		Host:   baseURL.Host,
-		Path:   joinedPath,
-	}
-
-	return result.String(), nil
-}
-
-func llmChat(
-	messages []LLMMessage,
-	model string,
-	seed int,
-	temperature float64,
-	postprocess func(string) string,
-	apiKey string,
-	apiBase string,
-	stream bool,
-	extra map[string]interface{},
-	verbose bool,
-) (<-chan string, error) {
-	apiKey, apiBase, err := resolveLLMApi(apiKey, apiBase)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	headers := http.Header{
-		"Authorization": {"Bearer " + apiKey},
-		"Content-Type":  {"application/json"},
-	}
-
-	req := LLMChatRequestBasic{
-		Model:       model,
-		Seed:        seed,
-		Temperature: temperature,
-		Stream:      stream,
-		Messages:    messages,
-	}
-
-	mergedData := map[string]interface{}{}
-
-	reqJson, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(reqJson, &mergedData)
-	if err != nil {
-		return nil, err
-	}
-
-	for k, v := range extra {
-		mergedData[k] = v
-	}
-
-	jsonData, err := json.Marshal(mergedData)
-	if err != nil {
-		return nil, err
-	}
-
-	var client *http.Client
-
-	if verbose {
-		client = &http.Client{
-			Transport: &loggingTransport{},
-		}
-	} else {
-		client = &http.Client{}
-	}
-
-	if verbose {
-		fmt.Printf("REQ: %s\n", jsonData)
-	}
-
-	var resp *http.Response
-
-	chatUrl, err := urlJoin(apiBase, "/chat/completions")
-	if err != nil {
-		return nil, err
-	}
-
-	if stream {
-		headers.Set("Accept", "text/event-stream")
-		httpReq, err := http.NewRequest("POST", chatUrl, bytes.NewBuffer(jsonData))
-		if err != nil {
-			return nil, err
-		}
-		httpReq.Header = headers
-		resp, err = client.Do(httpReq)
-
-		if err != nil {
-			return nil, err
-		}
-
-		ch := make(chan string)
-
-		go func() {
-			scanner := bufio.NewScanner(resp.Body)
-			scanner.Split(bufio.ScanLines)
-
-			for scanner.Scan() {
-				line := scanner.Text()
-
-				if err != nil {
-					if err != io.EOF {
-						fmt.Println(err)
-					}
-					break
-				}
-
-				line = strings.TrimSpace(line)
-
-				if strings.HasPrefix(line, "data: ") {
-
-					var resp struct {
-						Choices []struct {
-							Delta struct {
-								Content string `json:"content"`
-							} `json:"delta"`
-							FinishReason *string `json:"finish_reason"`
-							Index        int     `json:"index"`
-						} `json:"choices"`
-						Created int    `json:"created"`
-						ID      string `json:"id"`
-						Model   string `json:"model"`
-						Object  string `json:"object"`
-						Usage   struct {
-							CompletionTokens int `json:"completion_tokens"`
-							PromptTokens     int `json:"prompt_tokens"`
-							TotalTokens      int `json:"total_tokens"`
-						} `json:"usage,omitempty"` // add omitempty to avoid error when usage is not present
-					}
-
-					err := json.Unmarshal([]byte(line[6:]), &resp)
-
-					if err != nil {
-						fmt.Println(err)
-						continue
-					}
-
-					if resp.Choices[0].Delta.Content != "" {
-						content := resp.Choices[0].Delta.Content
-						if postprocess != nil {
-							content = postprocess(content)
-						}
-						ch <- content
-					} else {
-						if resp.Choices[0].FinishReason != nil && len(*resp.Choices[0].FinishReason) > 0 {
-							close(ch)
-							return
-						} else {
-							if verbose {
-								fmt.Println("Unexpected end of chat completion stream:", line)
-							}
-						}
-					}
-				}
-			}
-
-			close(ch)
-
-			resp.Body.Close()
-		}()
-
-		return ch, nil
-	}
-
-	httpReq, err := http.NewRequest("POST", chatUrl, bytes.NewBuffer(jsonData))
-
-	if err != nil {
-		return nil, err
-	}
-
-	httpReq.Header = headers
-
-	resp, err = client.Do(httpReq)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	var respBody struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
-	if err != nil {
-		return nil, err
-	}
-
-	content := respBody.Choices[0].Message.Content
-	if postprocess != nil {
-		content = postprocess(content)
-	}
-
-	ch := make(chan string, 1) // create a buffered channel with capacity 1
-	ch <- content
-	close(ch)
-
-	return ch, nil
-}
-
-type Model struct {
-	ID   string                 `json:"id"`
-	Meta map[string]interface{} `json:"meta"`
-}
-
-type ModelList struct {
-	Object string  `json:"object"`
-	Data   []Model `json:"data"`
-}
-
-func getModelList(apiKey string, apiBase string, timeout time.Duration) ([]Model, error) {
+// prefetchModelList fetches the model list in the background, off the
+// startup path of chat and pipe mode. The returned function waits for it.
+func prefetchModelList(apiKey string, apiBase string, timeout time.Duration) func() ([]llmclient.Model, error) {
+	var models []llmclient.Model
+	var err error
+	done := make(chan struct{})
 
-	url, err := urlJoin(apiBase, "models")
-	if err != nil {
-		return nil, err
-	}
-
-	headers := http.Header{
-		"Authorization": {"Bearer " + apiKey},
-		"Content-Type":  {"application/json"},
-	}
-
-	client := &http.Client{
-		Timeout: timeout, // set the timeout for the client
-	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header = headers
+	go func() {
+		defer close(done)
+		models, err = llmclient.ListModels(apiKey, apiBase, timeout)
+	}()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	return func() ([]llmclient.Model, error) {
+		<-done
+		return models, err
 	}
-	defer resp.Body.Close()
-
-	var modelList ModelList
-	err = json.NewDecoder(resp.Body).Decode(&modelList)
-	if err != nil {
-		return nil, err
-	}
-
-	return modelList.Data, nil
 }
 
 func putTextIntoClipboard(text string) error {
-	var cmd *exec.Cmd
-	switch runtime.GOOS {
-	case "darwin": // macOS
-		cmd := exec.Command("pbcopy")
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return err
-		}
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Start()
-		if err != nil {
-			return err
-		}
-		_, err = stdin.Write([]byte(text))
-		if err != nil {
-			return err
-		}
-		err = stdin.Close()
-		if err != nil {
-			return err
-		}
-		err = cmd.Wait()
-		if err != nil {
-			return err
-		}
-		return nil
-	case "linux":
-		cmd = exec.Command("xclip", "-selection", "clipboard", text)
-		return cmd.Run()
-	case "windows":
-		cmd = exec.Command("clip", text)
-		return cmd.Run()
-	default:
-		return errors.New("unsupported OS")
-	}
+	return clipboard.WriteAll(text)
 }
 
 type Session struct {
@@ -410,75 +88,163 @@ func generateUUID() string {
 	u := make([]byte, 16)
 	_, err := rand.Read(u)
 	if err != nil {
-		return fmt.Sprintf("%s", time.Now().UnixMilli())
+		return fmt.Sprintf("%d", time.Now().UnixMilli())
 	}
 	return base64.URLEncoding.EncodeToString(u)
 }
 
 func dumpToHistory(session *Session, data interface{}) error {
-	configDir, err := os.UserHomeDir()
-	if err != nil {
-		return err
-	}
-	historyDir := filepath.Join(configDir, ".config/llmcli")
-
-	if _, err := os.Stat(historyDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(historyDir, 0o755); err != nil {
-			return err
-		}
-	}
-	historyFile := filepath.Join(historyDir, "history.jsonl")
-	f, err := os.OpenFile(historyFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	jsonString := string(jsonData) + "\n"
-	_, err = f.WriteString(jsonString)
-	return err
+	return appendHistory(append(jsonData, '\n'))
 }
 
 func main() {
 	rootCmd := &cobra.Command{
-		Use:   "llm-chat",
+		Use:   "llm [message]",
 		Short: "LLM Chat CLI tool",
+		Args:  cobra.ArbitraryArgs,
 		RunE:  runLLMChat,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if needsSetup(cmd) {
+				return runSetup(true)
+			}
+			applyPlainOutput(cmd)
+			applyLogDir(cmd)
+			return applyLogLevel(cmd)
+		},
+
+		SilenceErrors: true, // reported by main
+		SilenceUsage:  true,
 	}
 
-	var is_terminal bool = is_interactive(os.Stdout.Fd())
-
-	rootCmd.Flags().StringP("model", "m", "", "LLM model: OPENAI_API_MODEL,GROQ_API_MODEL,LLM_MODEL from env or gpt-3.5-turbo")
-	rootCmd.Flags().BoolP("chat", "c", false, "Launch chat mode")
-	rootCmd.Flags().BoolP("chat-send", "C", false, "Launch chat mode and send the first message right away")
-	rootCmd.Flags().StringP("prompt", "p", "", "System prompt")
-	rootCmd.Flags().IntP("seed", "s", 1337, "Random seed")
-	rootCmd.Flags().Float64P("temperature", "t", 0.0, "Temperature")
-	rootCmd.Flags().IntP("max_tokens", "N", 4096, "Max amount of tokens in response")
-	rootCmd.Flags().Float64P("frequency_penalty", "Q", 0.0, "Frequency penalty between -2.0 and 2.0")
-	rootCmd.Flags().Float64P("presence_penalty", "Y", 0.0, "Presence penalty between -2.0 and 2.0")
-	rootCmd.Flags().BoolP("json", "j", false, "json mode")
-	rootCmd.Flags().StringP("json-schema", "J", "", "json schema (compatible with llama.cpp and tabbyAPI, not compatible with OpenAI)")
-	rootCmd.Flags().StringP("stop", "X", "", "Stop sequences (a single word or a json array)")
-	rootCmd.Flags().Float64P("top_p", "", 1.0, "Top-P sampling setting, defaults to 1.0")
-	rootCmd.Flags().StringP("api-params", "A", "{}", "Additional LLM API parameters expressed as json, take precedence over provided CLI arguments")
-	rootCmd.Flags().StringP("api-key", "k", "", "OpenAI API key")
-	rootCmd.Flags().StringP("api-base", "b", "https://api.openai.com/v1/", "OpenAI API base URL")
-	rootCmd.Flags().BoolP("stream", "S", is_terminal, "Stream output")
-	rootCmd.Flags().BoolP("verbose", "v", false, "http & debug logging")
-	rootCmd.Flags().StringSliceP("files", "f", []string{}, "List of files and directories to include in context")
-	rootCmd.Flags().StringP("context-format", "i", "md", "Context (files) input template format (md|xml)")
-	rootCmd.Flags().BoolP("debug", "D", false, "Output prompt & system msg")
-
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	lipgloss.SetColorProfile(terminal().Colors)
+	runewidth.DefaultCondition.EastAsianWidth = terminal().WideAmbiguous
+
+	addPersistentLLMFlags(rootCmd)
+	addChatFlags(rootCmd, terminal().Stdout)
+
+	askCmd := &cobra.Command{
+		Use:     "ask [message]",
+		Short:   "Ask a one-shot question, the message is taken from the arguments and stdin (same as llm <message>)",
+		GroupID: "chat",
+		RunE:    runLLMChat,
+	}
+	addChatFlags(askCmd, terminal().Stdout)
+
+	chatCmd := &cobra.Command{
+		Use:     "chat [message]",
+		Short:   "Open the interactive chat, optionally with a first message (same as llm -c)",
+		GroupID: "chat",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.Flags().Set("chat", "true")
+			return runLLMChat(cmd, args)
+		},
+	}
+	addChatFlags(chatCmd, terminal().Stdout)
+
+	rootCmd.AddGroup(
+		&cobra.Group{ID: "chat", Title: "Chat:"},
+		&cobra.Group{ID: "code", Title: "Code:"},
+		&cobra.Group{ID: "data", Title: "History, memory and configuration:"},
+	)
+
+	rootCmd.AddCommand(askCmd)
+	rootCmd.AddCommand(chatCmd)
+	rootCmd.AddCommand(newTestsCmd())
+	rootCmd.AddCommand(newDocCmd())
+	rootCmd.AddCommand(newRenameCmd())
+	rootCmd.AddCommand(newExplainErrorCmd())
+	rootCmd.AddCommand(newBatchCmd())
+	rootCmd.AddCommand(newPipeCmd())
+	rootCmd.AddCommand(newExtractCmd())
+	rootCmd.AddCommand(newHistoryCmd())
+	rootCmd.AddCommand(newStatsCmd())
+	rootCmd.AddCommand(newCacheCmd())
+	rootCmd.AddCommand(newMemoryCmd())
+	rootCmd.AddCommand(newServeCmd())
+	rootCmd.AddCommand(newConfigCmd())
+	rootCmd.AddCommand(newSyncCmd())
+	rootCmd.AddCommand(newLocalServerCmd())
+
+	cmd, err := rootCmd.ExecuteC()
+	if err := closeHistory(); err != nil {
+		slog.Warn("records of this run weren't saved", "err", err)
+	}
+
+	if err != nil {
+		code := 1
+		// a failed --check exits with 1, errors then with 2
+		if criterion, _ := cmd.Flags().GetString("check"); criterion != "" {
+			code = 2
+		}
+		var exit *exitError
+		if errors.As(err, &exit) {
+			code = exit.code
+			err = exit.err
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, withErrorHint(err))
+		}
+		os.Exit(code)
 	}
 }
 
+// addChatFlags registers the flags of the chat and one-shot modes, shared by
+// the root command, ask and chat
+func addChatFlags(cmd *cobra.Command, is_terminal bool) {
+	cmd.Flags().BoolP("chat", "c", false, "Launch chat mode")
+	cmd.Flags().BoolP("chat-send", "C", false, "Launch chat mode and send the first message right away")
+	cmd.Flags().BoolP("follow-up", "F", false, "Ask in the context and conversation of the previous invocation (from the history), its files and stdin aren't read again")
+	cmd.Flags().Bool("repl", false, "Chat at a plain prompt instead of the full screen interface, answers are printed as raw markdown (for SSH and dumb terminals)")
+	cmd.Flags().StringP("prompt", "p", "", "System prompt, @path reads it from a file and - from stdin")
+	cmd.Flags().IntP("max_tokens", "N", 4096, "Max amount of tokens in response")
+	cmd.Flags().Float64P("frequency_penalty", "Q", 0.0, "Frequency penalty between -2.0 and 2.0")
+	cmd.Flags().Float64P("presence_penalty", "Y", 0.0, "Presence penalty between -2.0 and 2.0")
+	cmd.Flags().BoolP("json", "j", false, "json mode")
+	cmd.Flags().StringP("json-schema", "J", "", "json schema (compatible with llama.cpp and tabbyAPI, not compatible with OpenAI)")
+	cmd.Flags().Int("json-retries", 2, "With -j or -J: how many times the model is asked to fix an answer that isn't JSON or doesn't match the schema, the command fails if it still doesn't")
+	cmd.Flags().StringP("stop", "X", "", "Stop sequences (a single word or a json array)")
+	cmd.Flags().String("grammar", "", "GBNF grammar file constraining the answer (llama.cpp), the answer is checked and asked for again when it doesn't follow it")
+	cmd.Flags().String("regex", "", "Regular expression the whole answer must match (vLLM guided_regex), checked like --grammar")
+	cmd.Flags().String("lang", "", "Language of the answers, e.g. de (default from config), an answer in another language is asked for again once")
+	cmd.Flags().Float64P("top_p", "", 1.0, "Top-P sampling setting, defaults to 1.0")
+	cmd.Flags().StringP("api-params", "A", "{}", "Additional LLM API parameters expressed as json, take precedence over provided CLI arguments")
+	cmd.Flags().BoolP("stream", "S", is_terminal, "Stream output")
+	cmd.Flags().StringSliceP("files", "f", []string{}, "List of files and directories to include in context")
+	cmd.Flags().StringP("context-format", "i", "md", "Context (files) input template format (md|xml)")
+	cmd.Flags().Bool("cache-context", false, "Mark the system prompt and the earlier messages for the provider's prompt cache (Anthropic cache_control), the cached tokens are shown with --cost (config: requests.<model>.cache_context)")
+	cmd.Flags().Bool("cite", false, "Number the context files and have the model cite them as [n], the cited paths are listed below the answer")
+	cmd.Flags().BoolP("clipboard", "x", false, "Include the clipboard text in the user message, or attach the clipboard image (screenshot)")
+	cmd.Flags().Bool("screenshot", false, "Select a screen region and attach it as an image (also: @screen in the message)")
+	cmd.Flags().String("stdin-format", "text", "Preprocess piped input: text (as is), diff (per-file sections), log (collapse repeats, keep the latest lines), csv (schema and sample rows), json (pretty-print or schema) or auto")
+	cmd.Flags().Int("stdin-max-tokens", 8000, "With --stdin-format log or json: approximate size limit of the preprocessed input")
+	cmd.Flags().Bool("summarize-overflow", false, "When the input doesn't fit in the model's context window, summarize it in chunks and ask the question about the summaries")
+	cmd.Flags().String("summary-model", "", "With --summarize-overflow: model for the chunk summaries (config: summarize.model, default the main model)")
+	cmd.Flags().String("context-layout", "", "Order of the user message parts, e.g. files,stdin,clipboard,prompt; files listed here move from the system prompt into the message (config: context_layout)")
+	cmd.Flags().String("context", "", "Named context from the config, adds its files to -f and its prompt as -p unless given")
+	cmd.Flags().String("prefill", "", "Start the answer with this text for the model to continue, e.g. '```json' (chat: /prefill)")
+	cmd.Flags().Bool("actions", false, "After a one-shot answer on a terminal, offer keys to copy it, save it, retry or follow up in the chat for three seconds (config: tui.actions)")
+	cmd.Flags().Bool("vt", false, "Print the time to the first token and tokens per second to stderr, with the GPU use (nvidia-smi) and llama.cpp /metrics of a server on this machine")
+	cmd.Flags().Duration("deadline", 0, "Stop the answer when the time since the start is up, e.g. 30s; what arrived is printed, marked truncated on stderr and the exit status is 124")
+	cmd.Flags().String("save-to", "", "Also write the answer to this file, followed by a footer listing the model and the context sources with their hashes")
+	cmd.Flags().String("check", "", "Judge the answer against a criterion (statement or yes/no question) with a second request, exit status 0 if it holds, 1 if not, 2 on errors")
+	cmd.Flags().String("judge-model", "", "With --check: model judging the answer, default the main model")
+	cmd.Flags().BoolP("debug", "D", false, "Output prompt & system msg")
+	cmd.Flags().String("race", "", "Also ask this fast model and print its answer right away, the -m model's answer follows; Enter keeps the fast answer and cancels the other")
+	cmd.Flags().StringSlice("models", []string{}, "Send a one-shot query to several models concurrently, each recorded as its own session")
+	cmd.Flags().Bool("compare", false, "With --models: wait for all answers and print them side by side")
+	cmd.Flags().String("task", "", "Task preset bundling temperature, system prompt and reasoning settings: code|write|chat|extract or one from the config")
+	cmd.Flags().String("reasoning-effort", "", "Reasoning effort for reasoning models: minimal|low|medium|high")
+	cmd.Flags().String("verbosity", "", "Answer verbosity for models supporting it: low|medium|high")
+	cmd.Flags().Bool("watch", false, "With -f: ask again whenever one of the files changes, clearing the screen")
+	cmd.Flags().Bool("follow", false, "Keep reading a piped stdin (e.g. tail -f) and analyze the new lines in batches")
+	cmd.Flags().Int("every", 100, "With --follow: number of new lines per batch")
+	cmd.Flags().Duration("interval", 30*time.Second, "With --follow: send an incomplete batch after this long")
+}
+
 func markChatStart(session *Session, userMsg, systemPrompt, model string, seed int, temperature float64, apiBase string, maxTokens int, frequencyPenalty, presencePenalty float64, jsonMode bool, stopSequences interface{}, topP float64, apiParams string, jsonSchema string) error {
 	data := struct {
 		SID              string      `json:"sid"`
@@ -496,7 +262,7 @@ func markChatStart(session *Session, userMsg, systemPrompt, model string, seed i
 		StopSequences    interface{} `json:"stop_sequences"`
 		TopP             float64     `json:"top_p"`
 		APIParams        string      `json:"api_params"`
-		JsonSchema       string      `json:"api_params"`
+		JsonSchema       string      `json:"json_schema"`
 	}{
 		SID:              session.UUID,
 		TS:               int(time.Now().Unix()),
@@ -529,23 +295,51 @@ func getFirstEnv(fallback string, envVars ...string) string {
 }
 
 func runLLMChat(cmd *cobra.Command, args []string) error {
+	if watch, _ := cmd.Flags().GetBool("watch"); watch {
+		return runWatch(cmd, args)
+	}
+	start := time.Now()
+
 	session := newSession()
 
-	modelname, _ := cmd.Flags().GetString("model")
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
 
-	if len(modelname) == 0 {
-		modelname = getFirstEnv("gpt-3.5-turbo", "OPENAI_API_MODEL", "GROQ_API_MODEL", "LLM_MODEL")
+	if err := applyContextPreset(cmd, cfg); err != nil {
+		return err
 	}
+	if err := applyTaskPreset(cmd, cfg); err != nil {
+		return err
+	}
+
+	modelname := getModelName(cmd)
 
 	seed, _ := cmd.Flags().GetInt("seed")
 	temperature, _ := cmd.Flags().GetFloat64("temperature")
-	apiKey, _ := cmd.Flags().GetString("api-key")
-	apiBase, _ := cmd.Flags().GetString("api-base")
+	apiKey, apiBase := configuredAPI(cmd)
 	stream, _ := cmd.Flags().GetBool("stream")
 	verbose, _ := cmd.Flags().GetBool("verbose")
 	chat, _ := cmd.Flags().GetBool("chat")
 	chat_send, _ := cmd.Flags().GetBool("chat-send")
-	systemPrompt, _ := cmd.Flags().GetString("prompt")
+	// the full screen TUI is no good for screen readers
+	repl, _ := cmd.Flags().GetBool("repl")
+	repl = repl || plainOutput
+	promptFlag, _ := cmd.Flags().GetString("prompt")
+	systemPrompt, promptFromStdin, err := loadSystemPrompt(promptFlag)
+	if err != nil {
+		return err
+	}
+	saveTo, _ := cmd.Flags().GetString("save-to")
+	prov := newProvenance(saveTo, session, modelname, seed)
+	if systemPrompt != "" {
+		path := ""
+		if strings.HasPrefix(promptFlag, "@") && !strings.HasPrefix(promptFlag, "@@") {
+			path = promptFlag[1:]
+		}
+		prov.addText("system_prompt", path, systemPrompt)
+	}
 	debug, _ := cmd.Flags().GetBool("debug")
 	maxTokens, _ := cmd.Flags().GetInt("max_tokens")
 	frequencyPenalty, _ := cmd.Flags().GetFloat64("frequency_penalty")
@@ -554,6 +348,29 @@ func runLLMChat(cmd *cobra.Command, args []string) error {
 	topP, _ := cmd.Flags().GetFloat64("top_p")
 	apiParams, _ := cmd.Flags().GetString("api-params")
 	jsonSchema, _ := cmd.Flags().GetString("json-schema")
+	printCost, _ := cmd.Flags().GetBool("cost")
+	fanOutModels, _ := cmd.Flags().GetStringSlice("models")
+	compare, _ := cmd.Flags().GetBool("compare")
+	raceModel, _ := cmd.Flags().GetString("race")
+	follow, _ := cmd.Flags().GetBool("follow")
+	followEvery, _ := cmd.Flags().GetInt("every")
+	followInterval, _ := cmd.Flags().GetDuration("interval")
+	reasoningEffort, _ := cmd.Flags().GetString("reasoning-effort")
+	verbosity, _ := cmd.Flags().GetString("verbosity")
+	prefill, _ := cmd.Flags().GetString("prefill")
+	grammarFile, _ := cmd.Flags().GetString("grammar")
+	pattern, _ := cmd.Flags().GetString("regex")
+	jsonRetries, _ := cmd.Flags().GetInt("json-retries")
+	lang, _ := cmd.Flags().GetString("lang")
+	cacheContext, _ := cmd.Flags().GetBool("cache-context")
+	followUp, _ := cmd.Flags().GetBool("follow-up")
+	if followUp {
+		for _, name := range []string{"files", "prompt", "clipboard", "screenshot", "chat", "chat-send", "repl", "follow", "models", "race"} {
+			if cmd.Flags().Changed(name) {
+				return fmt.Errorf("-F reuses the previous context, it can't be combined with --%s", name)
+			}
+		}
+	}
 
 	stopSequences, _ := cmd.Flags().GetString("stop")
 	var stopSeqInterface interface{}
@@ -561,34 +378,210 @@ func runLLMChat(cmd *cobra.Command, args []string) error {
 		var stopSeqArray []string
 		err := json.Unmarshal([]byte(stopSequences), &stopSeqArray)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("--stop: %w", err)
 		}
 		stopSeqInterface = stopSeqArray
 	} else {
 		stopSeqInterface = stopSequences
 	}
 
+	layoutSpec, _ := cmd.Flags().GetString("context-layout")
+	if layoutSpec == "" {
+		layoutSpec = lookupContextLayout(cfg, modelname)
+	}
+	layout, err := contextbuilder.ParseLayout(layoutSpec)
+	if err != nil {
+		return err
+	}
+
+	var fileContext, systemFiles string
+	var citeSources []string
+	if files, _ := cmd.Flags().GetStringSlice("files"); len(files) > 0 {
+		contextFormat, _ := cmd.Flags().GetString("context-format")
+		paths, err := contextbuilder.PathResolver{}.Resolve(files)
+		if err != nil {
+			return err
+		}
+		if cite, _ := cmd.Flags().GetBool("cite"); cite {
+			fileContext, err = contextbuilder.FormatFilesNumbered(paths, contextFormat)
+			for _, path := range paths {
+				citeSources = append(citeSources, filepath.ToSlash(path))
+			}
+			systemPrompt = appendSystemPrompt(systemPrompt, citeSystemText)
+		} else {
+			fileContext, err = contextbuilder.FormatFiles(paths, contextFormat)
+		}
+		if err != nil {
+			return err
+		}
+		prov.addFiles(paths)
+		if !slices.Contains(layout, "files") {
+			systemPrompt = appendSystemPrompt(systemPrompt, fileContext)
+			systemFiles = fileContext
+		}
+	}
+
+	if cfg.InjectDatetime {
+		systemPrompt = appendSystemPrompt(systemPrompt, datetimeContext(time.Now()))
+		prov.addItems("datetime", 1)
+	}
+
+	if cfg.Memory.Enabled {
+		facts, err := loadMemory()
+		if err != nil {
+			return err
+		}
+		systemPrompt = withMemory(systemPrompt, facts)
+		prov.addItems("memory", len(facts))
+	}
+
+	if noInstructions, _ := cmd.Flags().GetBool("no-instructions"); !noInstructions {
+		instructions, err := projectInstructionFiles(cfg)
+		if err != nil {
+			return err
+		}
+		for _, f := range instructions {
+			prov.addText("instructions", f.Path, f.Content)
+		}
+		systemPrompt = appendSystemPrompt(systemPrompt, formatProjectInstructions(instructions))
+	}
+
+	if lang == "" {
+		lang = cfg.Lang
+	}
+	if lang != "" {
+		systemPrompt = appendSystemPrompt(systemPrompt, languageInstruction(lang))
+	}
+
 	messages := make([]Message, 0)
 
 	if len(strings.TrimSpace(systemPrompt)) > 0 {
 		messages = append(messages, *NewMessage("system", systemPrompt))
 	}
 
+	stdinFormat, _ := cmd.Flags().GetString("stdin-format")
+	stdinMaxTokens, _ := cmd.Flags().GetInt("stdin-max-tokens")
+	if !slices.Contains(contextbuilder.StdinFormats, stdinFormat) {
+		return fmt.Errorf("unknown --stdin-format %q, use %s", stdinFormat, strings.Join(contextbuilder.StdinFormats, ", "))
+	}
+
 	var usermsg string = ""
 
+	screenshot, _ := cmd.Flags().GetBool("screenshot")
 	for _, arg := range args {
+		if arg == screenToken {
+			screenshot = true
+			continue
+		}
 		if len(usermsg) > 0 {
 			usermsg += " "
 		}
 		usermsg += arg
 	}
+	question := usermsg
+
+	// -F continues the last session, its system prompt already has the files
+	var followUpMessages []Message
+	if followUp {
+		if len(usermsg) == 0 {
+			return fmt.Errorf("-F needs a question, e.g. llm -F \"and what about windows?\"")
+		}
+		prev, err := lastSessionTranscript()
+		if err != nil {
+			return err
+		}
+		if !cmd.Flags().Changed("model") && prev.Model != "" {
+			modelname = prev.Model
+		}
+		systemPrompt = prev.SystemPrompt
+		messages = messages[:0]
+		for _, msg := range prev.Messages {
+			messages = append(messages, msg)
+			if msg.Role != "system" {
+				followUpMessages = append(followUpMessages, msg)
+			}
+		}
+	}
+
+	var clipboardText string
+	var images []string
+	if useClipboard, _ := cmd.Flags().GetBool("clipboard"); useClipboard {
+		var clipboardImage string
+		clipboardText, clipboardImage, err = readClipboard()
+		if err != nil {
+			return fmt.Errorf("reading the clipboard: %w", err)
+		}
+		if clipboardImage != "" {
+			images = append(images, clipboardImage)
+			prov.addText("clipboard_image", "", clipboardImage)
+		}
+		if clipboardText != "" {
+			prov.addText("clipboard", "", clipboardText)
+		}
+		// the clipboard goes last unless the layout places it
+		if layout != nil && !slices.Contains(layout, "clipboard") {
+			layout = append(layout, "clipboard")
+		}
+	}
+
+	if screenshot {
+		if chat || chat_send || follow {
+			return fmt.Errorf("--screenshot only works in a one-shot query")
+		}
+		image, err := screenshotImage()
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+		prov.addText("screenshot", "", image)
+	}
 
 	// Read from stdin if available
 	stat, _ := os.Stdin.Stat()
+	// stdin already gave the system prompt with -p -
+	piped := (stat.Mode()&os.ModeCharDevice) == 0 && !promptFromStdin && !followUp
 	var first = false
-	if (stat.Mode() & os.ModeCharDevice) == 0 {
+	if follow {
+		if promptFromStdin {
+			return fmt.Errorf("--follow reads stdin, the system prompt can't come from it (-p -)")
+		}
+		if !piped {
+			return fmt.Errorf("--follow needs piped input, e.g. tail -f app.log | llm --follow")
+		}
+		if len(fanOutModels) > 0 || chat || chat_send {
+			return fmt.Errorf("--follow can't be combined with --models or chat mode")
+		}
+		if followEvery <= 0 || followInterval <= 0 {
+			return fmt.Errorf("--every and --interval must be positive")
+		}
+		if stdinFormat != "text" {
+			return fmt.Errorf("--stdin-format can't be combined with --follow")
+		}
+	} else if piped && (layout != nil || stdinFormat != "text") {
+		piped, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		stdinText, err := contextbuilder.FormatStdin(string(piped), stdinFormat, stdinMaxTokens*4)
+		if err != nil {
+			return err
+		}
+		prov.addStdin(string(piped), stdinFormat, len(stdinText))
+		// without a layout the question is followed by stdin, as below
+		order := layout
+		if order == nil {
+			order = []string{"prompt", "stdin"}
+		}
+		usermsg = contextbuilder.Compose(order, map[string]string{
+			"files":     fileContext,
+			"stdin":     stdinText,
+			"clipboard": clipboardText,
+			"prompt":    usermsg,
+		})
+	} else if piped {
 		// stdin is a pipe or a file, read from it
 		scanner := bufio.NewScanner(os.Stdin)
+		var input strings.Builder
 		for scanner.Scan() {
 			if first {
 				usermsg += " "
@@ -596,37 +589,65 @@ func runLLMChat(cmd *cobra.Command, args []string) error {
 			}
 			usermsg += scanner.Text()
 			usermsg += " "
+			input.WriteString(scanner.Text() + "\n")
 		}
+		prov.addStdin(input.String(), stdinFormat, input.Len())
+	} else if layout != nil {
+		usermsg = contextbuilder.Compose(layout, map[string]string{"files": fileContext, "clipboard": clipboardText, "prompt": usermsg})
 	}
 
-	apiKey, apiBase, err := resolveLLMApi(apiKey, apiBase)
-	if err != nil {
-		log.Fatal(err)
+	if layout == nil && clipboardText != "" {
+		usermsg = contextbuilder.Compose([]string{"prompt", "clipboard"}, map[string]string{"prompt": usermsg, "clipboard": clipboardText})
 	}
 
-	timeout := 1 * time.Second // set a 10-second timeout
-	models, err := getModelList(apiKey, apiBase, timeout)
+	apiKey, apiBase, err = llmclient.ResolveAPI(apiKey, apiBase)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	timeout := 1 * time.Second // set a 10-second timeout
+	modelList := prefetchModelList(apiKey, apiBase, timeout)
 	if verbose {
+		models, err := modelList()
+		if err != nil {
+			slog.Warn("listing the models", "err", err)
+		}
 		for _, model := range models {
-			fmt.Println(model.ID, model.Meta)
+			slog.Debug("listed model", "id", model.ID, "meta", model.Meta)
 		}
 	}
 
 	if debug {
 		fmt.Printf("PROMPT: \"%s\"\nSYSTEM MESSAGE: \"%s\"", usermsg, systemPrompt)
+		// a dry run looks up the window whatever the size
+		tokens := messagesTokens(append(messages, *NewMessage("user", usermsg)))
+		fmt.Printf("\nTOKENS: ~%d", tokens)
+		if share := contextShare(resolveModelLimits(cfg, apiKey, apiBase, modelname), modelname, tokens); share != "" {
+			fmt.Printf(", %s", share)
+		}
 		return nil
 	}
 
-	markChatStart(session, usermsg, systemPrompt, modelname, seed, temperature, apiBase, maxTokens, frequencyPenalty, presencePenalty, jsonMode, stopSeqInterface, topP, apiParams, jsonSchema)
+	if len(fanOutModels) > 0 && (len(usermsg) == 0 || chat || chat_send) {
+		return fmt.Errorf("--models is only supported for one-shot queries")
+	}
+	if raceModel != "" && (len(usermsg) == 0 || chat || chat_send || follow || len(fanOutModels) > 0) {
+		return fmt.Errorf("--race only works in a one-shot query to a single model")
+	}
+
+	if len(fanOutModels) == 0 && raceModel == "" {
+		markChatStart(session, usermsg, systemPrompt, modelname, seed, temperature, apiBase, maxTokens, frequencyPenalty, presencePenalty, jsonMode, stopSeqInterface, topP, apiParams, jsonSchema)
+		// the session holds the whole conversation for another -F
+		for _, msg := range followUpMessages {
+			dumpMessageToHistory(session, msg)
+		}
+	}
 
 	var extra map[string]interface{}
 
 	apiParamsMap := map[string]interface{}{}
 	if err := json.Unmarshal([]byte(apiParams), &apiParamsMap); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("--api-params: %w", err)
 	}
 
 	extra = map[string]interface{}{
@@ -648,148 +669,406 @@ func runLLMChat(cmd *cobra.Command, args []string) error {
 	default:
 	}
 
+	if reasoningEffort != "" {
+		extra["reasoning_effort"] = reasoningEffort
+	}
+	if verbosity != "" {
+		extra["verbosity"] = verbosity
+	}
+
+	if stream && (printCost || trackUsage(cfg)) {
+		extra["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	var checkSchema func(string) error
 	if len(jsonSchema) > 0 {
 		jsonSchemaObj := map[string]interface{}{}
 		if err := json.Unmarshal([]byte(jsonSchema), &jsonSchemaObj); err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("--json-schema: %w", err)
 		}
 		extra["json_schema"] = jsonSchemaObj
+		checkSchema = schemaConstraint(jsonSchemaObj)
 	} else if jsonMode {
 		extra["response_format"] = map[string]interface{}{"type": "json_object"}
+		checkSchema = jsonConstraint
+	}
+
+	checkOutput, err := outputConstraint(grammarFile, pattern, extra)
+	if err != nil {
+		return err
 	}
 
 	for k, v := range apiParamsMap {
 		extra[k] = v
 	}
 
-	llmApiFunc := func(messages []Message) (<-chan string, error) {
-		filteredMessages := make([]LLMMessage, len(messages))
-		for i, msg := range messages {
-			filteredMessages[i] = LLMMessage{
-				Role:    msg.Role,
-				Content: msg.Content,
+	tuiMode := !follow && (len(usermsg) == 0 || chat || chat_send || repl)
+	if len(images) > 0 && (tuiMode || follow) {
+		return fmt.Errorf("images (clipboard, screenshot) can only be asked about in a one-shot query, e.g. llm -x \"what does this error mean?\"")
+	}
+	criterion, _ := cmd.Flags().GetString("check")
+	if criterion != "" && (tuiMode || follow || len(fanOutModels) > 0 || raceModel != "") {
+		return fmt.Errorf("--check only works in a one-shot query to a single model")
+	}
+	if saveTo != "" && (tuiMode || follow || len(fanOutModels) > 0 || raceModel != "") {
+		return fmt.Errorf("--save-to only works in a one-shot query to a single model")
+	}
+	deadline, _ := cmd.Flags().GetDuration("deadline")
+	if deadline > 0 && (tuiMode || follow || len(fanOutModels) > 0 || raceModel != "") {
+		return fmt.Errorf("--deadline only works in a one-shot query to a single model")
+	}
+	summarizeOverflow, _ := cmd.Flags().GetBool("summarize-overflow")
+	if summarizeOverflow && (tuiMode || follow || len(fanOutModels) > 0 || raceModel != "") {
+		return fmt.Errorf("--summarize-overflow only works in a one-shot query to a single model")
+	}
+	usage := newUsageReporter(cfg, session, modelname)
+
+	var cache *llmclient.Cache
+	if !tuiMode && !follow {
+		cache, err = openResponseCache(cmd, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	newLLMApiFunc := func(cfg *Config, modelname string, usage *usageReporter) func(ctx context.Context, messages []Message) (<-chan string, error) {
+		return func(ctx context.Context, messages []Message) (<-chan string, error) {
+			filteredMessages := make([]llmclient.Message, len(messages))
+			for i, msg := range messages {
+				filteredMessages[i] = llmclient.Message{
+					Role:    msg.Role,
+					Content: msg.Content,
+					Images:  msg.Images,
+				}
+			}
+			if cacheContext || lookupRequestConfig(cfg, modelname).CacheContext {
+				markCacheBreakpoints(filteredMessages)
 			}
+			middlewares := append([]llmclient.Middleware{llmclient.WithContext(ctx), constrainOutput(checkOutput, constraintRetries, false), constrainOutput(checkSchema, jsonRetries, true), enforceLanguage(lang)}, requestMiddlewares(cfg, modelname)...)
+			return llmclient.Chat(filteredMessages, modelname, seed, temperature, nil, apiKey, apiBase, stream, extra, verbose, usage.Record, cache, cfg.Hooks, middlewares...)
 		}
-		return llmChat(filteredMessages, modelname, seed, temperature, nil, apiKey, apiBase, stream, extra, verbose)
 	}
 
+	llmApiFunc := newLLMApiFunc(cfg, modelname, usage)
+
 	llmHistoryFunc := func(msg Message) error {
-		data := struct {
-			ID      string  `json:"uuid"`
-			SID     string  `json:"sid"`
-			TS      int     `json:"ts"`
-			Message Message `json:"msg"`
-		}{
-			ID:      msg.UUID,
-			SID:     session.UUID,
-			TS:      int(time.Now().Unix()),
-			Message: msg,
-		}
+		return dumpMessageToHistory(session, msg)
+	}
 
-		return dumpToHistory(session, data)
+	restoreTitle := pushWindowTitle(windowTitle(modelname, question))
+	defer restoreTitle()
+
+	if follow {
+		return runFollow(os.Stdin, followEvery, followInterval, usermsg, systemPrompt, withPrefill(llmApiFunc, prefill), llmHistoryFunc)
+	}
+
+	if tuiMode && repl {
+		state := &replState{
+			messages:   messages,
+			system:     len(messages),
+			modelname:  modelname,
+			llmApi:     llmApiFunc,
+			historyApi: llmHistoryFunc,
+			prefill:    prefill,
+			sources:    citeSources,
+			status:     newStatusLine(statusConfig()),
+			newApi: func(model string) (func(ctx context.Context, messages []Message) (<-chan string, error), error) {
+				cfg, err := reloadConfig()
+				if err != nil {
+					return nil, err
+				}
+				return newLLMApiFunc(cfg, model, newUsageReporter(cfg, session, model)), nil
+			},
+		}
+		return runREPL(state, usermsg)
 	}
 
-	if len(usermsg) == 0 || chat || chat_send {
+	// the full screen chat, also opened by the action bar of a one-shot
+	// answer to follow up on it
+	systemMessages := append([]Message{}, messages...)
+	runChat := func(messages []Message, initialTextareaValue string, sendRightAway bool) error {
+		// only the TUI renders markdown, with glamour this queries the terminal
+		if err := setMarkdownRenderer(cfg); err != nil {
+			return err
+		}
 
-		var initialTextareaValue = ""
+		// pricing, budget and hooks can be changed without leaving the chat,
+		// the system prompt and markdown renderer stay as they were
+		reloadApiFunc := func() (func(ctx context.Context, messages []Message) (<-chan string, error), error) {
+			cfg, err := reloadConfig()
+			if err != nil {
+				return nil, err
+			}
+			return newLLMApiFunc(cfg, modelname, newUsageReporter(cfg, session, modelname)), nil
+		}
 
-		if len(usermsg) > 0 {
-			initialTextareaValue = usermsg
+		// more tabs start over with the same system prompt, each recorded as
+		// its own session
+		tabMessages := systemMessages
+		newTab := func(model string) chatTuiState {
+			s := newSession()
+			markChatStart(s, "", systemPrompt, model, seed, temperature, apiBase, maxTokens, frequencyPenalty, presencePenalty, jsonMode, stopSeqInterface, topP, apiParams, jsonSchema)
+			reload := func() (func(ctx context.Context, messages []Message) (<-chan string, error), error) {
+				cfg, err := reloadConfig()
+				if err != nil {
+					return nil, err
+				}
+				return newLLMApiFunc(cfg, model, newUsageReporter(cfg, s, model)), nil
+			}
+			history := func(msg Message) error {
+				return dumpMessageToHistory(s, msg)
+			}
+			tab := initialModel(*s, model, append([]Message{}, tabMessages...), history, newLLMApiFunc(cfg, model, newUsageReporter(cfg, s, model)), reload, "", false)
+			tab.citeSources = citeSources
+			return tab
 		}
 
-		p := tea.NewProgram(initialModel(*session, messages, llmHistoryFunc, llmApiFunc, initialTextareaValue, chat_send), // use the full size of the terminal in its "alternate screen buffer"
+		model := initialModel(*session, modelname, messages, llmHistoryFunc, llmApiFunc, reloadApiFunc, initialTextareaValue, sendRightAway)
+		model.prefill = prefill // for the first answer only
+		model.citeSources = citeSources
+
+		p := tea.NewProgram(newChatTabs(model, newTab), // use the full size of the terminal in its "alternate screen buffer"
 			tea.WithMouseCellMotion())
 
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				p.Send(reloadConfigMsg{})
+			}
+		}()
+
 		if _, err := p.Run(); err != nil {
-			log.Println(err)
 			return err
 		}
 
 		return nil
 	}
 
-	if len(usermsg) > 0 {
-		messages = append(messages, *NewMessage("user", usermsg))
+	if tuiMode {
+		return runChat(messages, usermsg, chat_send)
 	}
 
-	ch, err := llmApiFunc(messages)
+	if len(usermsg) > 0 {
+		userMsg := NewMessage("user", usermsg)
+		userMsg.Images = images
+		messages = append(messages, *userMsg)
+		// the session start has the text only, keep the images for llm
+		// history attachments
+		if (len(images) > 0 && len(fanOutModels) == 0) || followUp {
+			llmHistoryFunc(*userMsg)
+		}
+	}
 
-	if err != nil {
-		fmt.Println(err)
-		return err
+	if len(fanOutModels) > 0 {
+		var targets []fanOutTarget
+		for _, model := range fanOutModels {
+			s := newSession()
+			markChatStart(s, usermsg, systemPrompt, model, seed, temperature, apiBase, maxTokens, frequencyPenalty, presencePenalty, jsonMode, stopSeqInterface, topP, apiParams, jsonSchema)
+			u := newUsageReporter(cfg, s, model)
+			targets = append(targets, fanOutTarget{Model: model, Session: s, Usage: u, Api: withPrefill(newLLMApiFunc(cfg, model, u), prefill)})
+		}
+		return runFanOut(targets, messages, compare, printCost)
 	}
 
-	for content := range ch {
-		fmt.Print(content)
+	if raceModel != "" {
+		var targets []fanOutTarget
+		for _, model := range []string{raceModel, modelname} {
+			s := newSession()
+			markChatStart(s, usermsg, systemPrompt, model, seed, temperature, apiBase, maxTokens, frequencyPenalty, presencePenalty, jsonMode, stopSeqInterface, topP, apiParams, jsonSchema)
+			u := newUsageReporter(cfg, s, model)
+			targets = append(targets, fanOutTarget{Model: model, Session: s, Usage: u, Api: withPrefill(newLLMApiFunc(cfg, model, u), prefill)})
+		}
+		return runRace(targets[0], targets[1], messages, printCost)
 	}
 
-	return nil
-}
+	var limits modelLimits
+	if summarizeOverflow || messagesTokens(messages)+maxTokens > modelLimitsThreshold {
+		limits = resolveModelLimits(cfg, apiKey, apiBase, modelname)
+	}
 
-type loggingTransport struct{}
+	if summarizeOverflow {
+		window := limits.Context
+		if window == 0 {
+			slog.Warn(fmt.Sprintf("the context window of %s is unknown, set context_windows.%s in the config for --summarize-overflow", modelname, modelname))
+		} else {
+			summaryModel, _ := cmd.Flags().GetString("summary-model")
+			if summaryModel == "" {
+				summaryModel = cfg.Summarize.Model
+			}
+			if summaryModel == "" {
+				summaryModel = modelname
+			}
+			s := newOverflowSummarizer(cfg, summaryModel, seed, apiKey, apiBase, verbose, cache, newUsageReporter(cfg, session, summaryModel))
+			fitted, err := s.fitContextWindow(messages, question, systemFiles, window, maxTokens)
+			if err != nil {
+				return err
+			}
+			if prov != nil && messagesTokens(fitted) != messagesTokens(messages) {
+				prov.Summarized = true
+			}
+			messages = fitted
+		}
+	}
+	if _, ok := apiParamsMap["max_tokens"]; !ok {
+		extra["max_tokens"] = fitAnswerLength(limits, modelname, messagesTokens(messages), maxTokens, cmd.Flags().Changed("max_tokens"), summarizeOverflow)
+	}
 
-func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	fmt.Printf(">>> %s %s %s\n", req.Method, req.URL, req.Proto)
-	for k, v := range req.Header {
-		fmt.Printf(">>> %s: %s\n", k, v)
+	ctx := cmd.Context()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, start.Add(deadline))
+		defer cancel()
 	}
 
-	// Read and log the request body
-	reqBody, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		return nil, err
+	printTimingInfo, _ := cmd.Flags().GetBool("vt")
+	timing := &answerTiming{start: time.Now()}
+	timingBase := apiBase
+	if _, srv, ok := lookupLocalServer(cfg, modelname, apiBase); ok {
+		timingBase = srv.APIBase
+	}
+	var gpus *gpuMonitor
+	if printTimingInfo && isLocalAPI(timingBase) {
+		gpus = startGPUMonitor(time.Second)
 	}
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(reqBody)) // Reset req.Body
 
-	var jsonData interface{}
-	err = json.Unmarshal(reqBody, &jsonData)
+	var answer strings.Builder
+	ch, err := withPrefill(llmApiFunc, prefill)(ctx, messages)
+	if err != nil && ctx.Err() == nil {
+		gpus.stop()
+		return err
+	}
 	if err == nil {
-		jsonBytes, _ := json.MarshalIndent(jsonData, "", "  ")
-		fmt.Printf(">>> %s\n", jsonBytes)
-	} else {
-		fmt.Printf(">>> %s\n", reqBody)
+		for content := range ch {
+			timing.chunk()
+			fmt.Print(content)
+			answer.WriteString(content)
+		}
+	}
+	timing.end = time.Now()
+	// a late answer is cut, what arrived counts
+	truncated := deadline > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if truncated {
+		fmt.Println()
+		fmt.Fprintf(os.Stderr, "[truncated: deadline of %s reached]\n", deadline)
+		prov.markTruncated()
 	}
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
-	if err != nil {
-		return nil, err
+	// recorded for -F, a retry replaces it
+	answerMsg := NewMessage("assistant", answer.String())
+	answerMsg.Interrupted = truncated
+	if answer.Len() > 0 {
+		llmHistoryFunc(*answerMsg)
 	}
 
-	fmt.Printf("<<< %s %s %s\n", resp.Status, resp.Proto, resp.Status)
-	for k, v := range resp.Header {
-		fmt.Printf("<<< %s: %s\n", k, v)
+	saved := answer.String()
+	if footer := citationFooter(answer.String(), citeSources); footer != "" {
+		fmt.Printf("\n\n%s\n", footer)
+		saved += "\n\n" + footer
+	}
+	if err := saveAnswer(saveTo, saved, prov); err != nil {
+		return err
 	}
 
-	// Read and log the response body
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if printCost {
+		usage.Print()
 	}
-	resp.Body = ioutil.NopCloser(bytes.NewBuffer(respBody)) // Reset resp.Body
-	defer resp.Body.Close()                                 // Close the response body
 
-	var jsonDataResp interface{}
-	err = json.Unmarshal(respBody, &jsonDataResp)
-	if err == nil {
-		jsonBytes, _ := json.MarshalIndent(jsonDataResp, "", "  ")
-		fmt.Printf("<<< %s\n", jsonBytes)
-	} else {
-		fmt.Printf("<<< %s\n", respBody)
+	if printTimingInfo {
+		if !printCost {
+			fmt.Fprintln(os.Stderr)
+		}
+		completion, estimated := llmclient.EstimateTokens(answer.String()), true
+		if usage.last != nil {
+			completion, estimated = usage.last.CompletionTokens, usage.last.Estimated
+		}
+		timing.print(completion, estimated, stream)
+		printGPUSamples(gpus.stop())
+		if isLocalAPI(timingBase) {
+			printServerMetrics(scrapeServerMetrics(timingBase))
+		}
+	}
+
+	showActions, _ := cmd.Flags().GetBool("actions")
+	if (showActions || cfg.TUI.Actions) && !truncated && criterion == "" && actionBarAvailable() {
+		actions := &answerActions{
+			answer: saved,
+			retry: func() (string, error) {
+				// another seed, the cached answer would come back otherwise
+				seed++
+				var again strings.Builder
+				ch, err := withPrefill(llmApiFunc, prefill)(cmd.Context(), messages)
+				if err != nil {
+					return "", err
+				}
+				for content := range ch {
+					fmt.Print(content)
+					again.WriteString(content)
+				}
+				answerMsg.Content = again.String()
+				llmHistoryFunc(*answerMsg)
+				ret := again.String()
+				if footer := citationFooter(ret, citeSources); footer != "" {
+					fmt.Printf("\n\n%s\n", footer)
+					ret += "\n\n" + footer
+				}
+				if printCost {
+					usage.Print()
+				}
+				return ret, nil
+			},
+			followUp: func() error {
+				// the answer began with it already
+				prefill = ""
+				return runChat(append(messages, *answerMsg), "", false)
+			},
+		}
+		if err := actions.run(); err != nil {
+			return err
+		}
+	}
+
+	if truncated {
+		// judging an unfinished answer would be meaningless
+		return &exitError{code: 124}
 	}
 
-	return resp, nil
+	if criterion != "" {
+		fmt.Println()
+		judgeModel, _ := cmd.Flags().GetString("judge-model")
+		if judgeModel == "" {
+			judgeModel = modelname
+		}
+		judgeUsage := newUsageReporter(cfg, session, judgeModel)
+		verdict, err := judgeResponse(cfg, judgeModel, seed, apiKey, apiBase, verbose, judgeUsage, usermsg, answer.String(), criterion)
+		if err != nil {
+			return err
+		}
+		if printCost {
+			judgeUsage.Print()
+		}
+		printVerdict(verdict)
+		if !verdict.Pass {
+			return &exitError{code: 1}
+		}
+	}
+
+	return nil
 }
 
 type chatTuiState struct {
 	spin           bool
 	streaming      bool
-	spinner        spinner.Model
+	status         statusLine
 	viewport       viewport.Model
 	textarea       textarea.Model
 	llmMessages    []Message
-	llmApi         func(messages []Message) (<-chan string, error)
+	llmApi         func(ctx context.Context, messages []Message) (<-chan string, error)
+	reloadApi      func() (func(ctx context.Context, messages []Message) (<-chan string, error), error)
 	historyApi     func(Message) error
 	session        Session
+	modelname      string
 	ch             <-chan string
 	err            error
 	renderMarkdown bool
@@ -797,6 +1076,49 @@ type chatTuiState struct {
 	mdPaddingWidth int
 	shift          bool
 	sendRightAway  bool
+	transcript     *transcriptCache
+	newContent     bool               // streamed while scrolled up
+	prefill        string             // the beginning of the next answer, see /prefill
+	citeSources    []string           // paths of the files numbered by --cite
+	cancel         context.CancelFunc // of the request in flight
+	queue          []string           // typed while an answer streams, sent one by one after it
+	id             int                // of the tab, see chatTabs
+}
+
+// transcriptCache holds the formatted messages before the last one, only the
+// last message changes while an answer streams in
+type transcriptCache struct {
+	count    int
+	lastUUID string
+	width    int
+	markdown bool
+	text     string
+}
+
+// renderTranscript formats the conversation, reusing the formatted earlier
+// messages as long as they and the layout are unchanged
+func (m chatTuiState) renderTranscript(suffix string) string {
+	msgs := m.llmMessages
+	if len(msgs) == 0 {
+		return ""
+	}
+
+	c := m.transcript
+	prefix := msgs[:len(msgs)-1]
+
+	valid := c.count <= len(prefix) && c.width == m.viewportWidth && c.markdown == m.renderMarkdown &&
+		(c.count == 0 || prefix[c.count-1].UUID == c.lastUUID)
+	if !valid {
+		*c = transcriptCache{width: m.viewportWidth, markdown: m.renderMarkdown}
+	}
+
+	if c.count < len(prefix) {
+		c.text += formatMessageLog(withCitationFooters(prefix[c.count:], m.citeSources), m.renderMarkdown, m.viewportWidth, m.mdPaddingWidth, "", "", true)
+		c.count = len(prefix)
+		c.lastUUID = prefix[len(prefix)-1].UUID
+	}
+
+	return c.text + formatMessageLog(withCitationFooters(msgs[len(msgs)-1:], m.citeSources), m.renderMarkdown, m.viewportWidth, m.mdPaddingWidth, suffix, "", true)
 }
 
 func getLastMsg(m chatTuiState) (Message, error) {
@@ -806,7 +1128,7 @@ func getLastMsg(m chatTuiState) (Message, error) {
 	return m.llmMessages[len(m.llmMessages)-1], nil
 }
 
-func initialModel(session Session, messages []Message, llmHistoryApi func(Message) error, llmApi func(messages []Message) (<-chan string, error), initialTextareaValue string, sendRightAway bool) chatTuiState {
+func initialModel(session Session, modelname string, messages []Message, llmHistoryApi func(Message) error, llmApi func(ctx context.Context, messages []Message) (<-chan string, error), reloadApi func() (func(ctx context.Context, messages []Message) (<-chan string, error), error), initialTextareaValue string, sendRightAway bool) chatTuiState {
 	ta := textarea.New()
 	ta.Placeholder = "Type a message..."
 	ta.Focus()
@@ -825,13 +1147,13 @@ func initialModel(session Session, messages []Message, llmHistoryApi func(Messag
 
 	ta.SetValue(initialTextareaValue)
 
+	caps := terminal()
+
 	if len(messages) > 0 {
-		vp.SetContent(formatMessageLog(messages, true, 80, 0, "", "", true))
+		vp.SetContent(formatMessageLog(messages, caps.Markdown(), caps.Width-2, 0, "", "", true))
 	}
 	vp.GotoBottom()
 
-	sp := spinner.New()
-
 	if sendRightAway {
 
 	}
@@ -839,20 +1161,38 @@ func initialModel(session Session, messages []Message, llmHistoryApi func(Messag
 	return chatTuiState{
 		spin:           false,
 		streaming:      false,
-		spinner:        sp,
+		status:         newStatusLine(statusConfig()),
 		textarea:       ta,
 		viewport:       vp,
 		llmMessages:    messages,
 		llmApi:         llmApi,
+		reloadApi:      reloadApi,
 		historyApi:     llmHistoryApi,
 		session:        session,
+		modelname:      modelname,
 		ch:             nil,
 		err:            nil,
-		renderMarkdown: true,
-		viewportWidth:  80,
+		renderMarkdown: caps.Markdown(),
+		viewportWidth:  caps.Width - 2,
 		mdPaddingWidth: 0,
 		sendRightAway:  sendRightAway,
+		transcript:     &transcriptCache{},
+	}
+}
+
+// reloadConfigMsg is sent on SIGHUP
+type reloadConfigMsg struct{}
+
+func (m chatTuiState) reloadConfig() chatTuiState {
+	llmApi, err := m.reloadApi()
+	if err != nil {
+		m.textarea.Placeholder = "Reload failed, " + err.Error()
+		return m
 	}
+
+	m.llmApi = llmApi
+	m.textarea.Placeholder = "Config reloaded. " + TEXTINPUT_PLACEHOLDER
+	return m
 }
 
 func (m chatTuiState) Init() tea.Cmd {
@@ -870,7 +1210,7 @@ func removeLastMsg(m chatTuiState) error {
 			break
 		}
 
-		pseudoMsg := NewMessage("__sys__", fmt.Sprintf(`{"sysop": "remove_msg", "id": "%s"}`, lastMsg))
+		pseudoMsg := NewMessage("__sys__", fmt.Sprintf(`{"sysop": "remove_msg", "id": "%s"}`, lastMsg.UUID))
 		m.historyApi(*pseudoMsg)
 
 		m.llmMessages = m.llmMessages[:len(m.llmMessages)-1]
@@ -891,10 +1231,9 @@ func removeLastMsg(m chatTuiState) error {
 	return nil
 }
 
-var markdownCache = struct {
-	sync.Mutex
-	cache map[string]string
-}{cache: make(map[string]string)}
+var hardLineBreakRe = regexp.MustCompile(`(?m:^(  |\z)|\n)`)
+
+var interruptedStyle = lipgloss.NewStyle().Faint(true)
 
 func formatMessageLog(msgs []Message, renderMarkdown bool, lineWidth int,
 	mdPadding int, suffix string, roleFormat string, renderNewlinesInUsermsgs bool) string {
@@ -910,8 +1249,7 @@ func formatMessageLog(msgs []Message, renderMarkdown bool, lineWidth int,
 		content := strings.TrimRight(msg.Content, " \t\r\n")
 
 		if msg.Role == "user" && renderNewlinesInUsermsgs {
-			re := regexp.MustCompile(`(?m:^(  |\z)|\n)`)
-			content = re.ReplaceAllStringFunc(content, func(match string) string {
+			content = hardLineBreakRe.ReplaceAllStringFunc(content, func(match string) string {
 				if strings.HasPrefix(match, "  ") || match == "\n" {
 					return match
 				}
@@ -920,24 +1258,21 @@ func formatMessageLog(msgs []Message, renderMarkdown bool, lineWidth int,
 		}
 
 		if renderMarkdown {
-			key := fmt.Sprintf("%s__%s__%s", content, lineWidth, mdPadding)
-			markdownCache.Lock()
-			if cachedContent, ok := markdownCache.cache[key]; ok {
-				markdownCache.Unlock()
-				content = cachedContent
-			} else {
-				renderedContent := markdown.Render(content, lineWidth, mdPadding)
-				markdownCache.cache[key] = string(renderedContent)
-				markdownCache.Unlock()
-				content = string(renderedContent)
-			}
+			content = renderMarkdownCached(content, lineWidth, mdPadding)
+		} else if lineWidth > 0 {
+			// the viewport doesn't wrap, lipgloss measures by display width so
+			// CJK and emoji wrap where the terminal would
+			content = lipgloss.NewStyle().Width(lineWidth).Render(content)
 		}
 
 		content = strings.TrimRight(content, " \t\r\n")
 
 		sfx := ""
+		if msg.Interrupted {
+			sfx = " " + interruptedStyle.Render("[interrupted]")
+		}
 		if i == len(msgs)-1 && len(suffix) > 0 {
-			sfx = suffix
+			sfx += suffix
 		}
 
 		fmt.Fprintf(&ret, roleFmt+"%s%s\n\n", strings.ToUpper(msg.Role), content, sfx)
@@ -948,6 +1283,13 @@ func formatMessageLog(msgs []Message, renderMarkdown bool, lineWidth int,
 
 type tickMsg time.Time
 
+func queuedPlaceholder(n int) string {
+	if n == 1 {
+		return "1 message queued, sent when the answer is complete..."
+	}
+	return fmt.Sprintf("%d messages queued, sent one by one when the answers are complete...", n)
+}
+
 func tickCmd() tea.Cmd {
 	return tea.Tick(time.Second*1, func(t time.Time) tea.Msg {
 		return tickMsg(t)
@@ -958,32 +1300,57 @@ func sendMsg(m chatTuiState, usermsg string) (tea.Model, tea.Cmd) {
 	var newmsg = *NewMessage("user", usermsg)
 
 	m.llmMessages = append(m.llmMessages, newmsg)
-	m.historyApi(newmsg)
+	if err := m.historyApi(newmsg); err != nil {
+		m.err = err
+	}
+
+	request := m.llmMessages
+	if m.prefill != "" {
+		request = prefillMessages(m.llmMessages, m.prefill)
+	}
 
-	ch, err := m.llmApi(m.llmMessages)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := m.llmApi(ctx, request)
 
 	if err != nil {
-		log.Println(err)
-		m.err = err
+		cancel()
+		slog.Warn(err.Error())
+		m.err = withErrorHint(err)
 		return m, nil
 	}
+	m.cancel = cancel
 
-	m.llmMessages = append(m.llmMessages, *NewMessage("assistant", ""))
+	// the streamed continuation is appended to the prefill
+	m.llmMessages = append(m.llmMessages, *NewMessage("assistant", m.prefill))
+	m.prefill = ""
 
 	m.spin = true
-	m.spinner.Spinner = spinner.Pulse
-	m.spinner.Spinner.FPS = time.Second / 10
-	m.spinner.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("171"))
+	statusCmd := m.status.waiting()
 
 	m.ch = ch
 	m.textarea.Reset()
 	m.textarea.Placeholder = TEXTINPUT_PLACEHOLDER
 	m.textarea.Focus()
 
-	m.viewport.SetContent(formatMessageLog(m.llmMessages, m.renderMarkdown, m.viewportWidth, m.mdPaddingWidth, m.spinner.View(), "", true))
+	m.viewport.SetContent(m.renderTranscript(m.status.View()))
 	m.viewport.GotoBottom()
 
-	return m, tea.Batch(m.spinner.Tick, readLLMResponse(m, m.ch))
+	cmds := []tea.Cmd{readLLMResponse(m, m.ch)}
+	if statusCmd != nil {
+		cmds = append(cmds, statusCmd)
+	}
+
+	userMsgs := 0
+	for _, msg := range m.llmMessages {
+		if msg.Role == "user" {
+			userMsgs++
+		}
+	}
+	if userMsgs == 1 {
+		cmds = append(cmds, tea.SetWindowTitle(windowTitle(m.modelname, usermsg)))
+	}
+
+	return m, tea.Batch(cmds...)
 }
 
 func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -996,6 +1363,10 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	m.textarea, tiCmd = m.textarea.Update(msg)
 	m.viewport, vpCmd = m.viewport.Update(msg)
 
+	if m.viewport.AtBottom() {
+		m.newContent = false
+	}
+
 	if m.sendRightAway {
 		m.sendRightAway = false
 		var usermsg = m.textarea.Value()
@@ -1008,7 +1379,23 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.Type {
 
-		case tea.KeyCtrlC, tea.KeyEsc:
+		case tea.KeyEsc, tea.KeyCtrlX:
+			// stop the answer, the partial text is kept
+			if m.cancel != nil {
+				m.cancel()
+				m.cancel = nil
+				if len(m.llmMessages) > 0 && m.llmMessages[len(m.llmMessages)-1].Role == "assistant" {
+					m.llmMessages[len(m.llmMessages)-1].Interrupted = true
+				}
+				m.textarea.Placeholder = "Answer interrupted. " + TEXTINPUT_PLACEHOLDER
+				return m, nil
+			}
+			if msg.Type == tea.KeyEsc {
+				return m, tea.Quit
+			}
+			return m, nil
+
+		case tea.KeyCtrlC:
 			return m, tea.Quit
 
 		case tea.KeyCtrlN: // ctrl+N
@@ -1055,7 +1442,7 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyCtrlD: // ctrl+N
 			removeLastMsg(m)
 
-			m.viewport.SetContent(formatMessageLog(m.llmMessages, m.renderMarkdown, m.viewportWidth, m.mdPaddingWidth, "", "", true))
+			m.viewport.SetContent(m.renderTranscript(""))
 			m.viewport.GotoBottom()
 
 			return m, nil
@@ -1070,6 +1457,29 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					return m, nil
 				}
 
+				if strings.TrimSpace(usermsg) == "/reload" {
+					m.textarea.Reset()
+					return m.reloadConfig(), nil
+				}
+
+				if prefill, ok := parsePrefillCommand(usermsg); ok {
+					m.prefill = prefill
+					m.textarea.Reset()
+					if prefill == "" {
+						m.textarea.Placeholder = "Prefill cleared. " + TEXTINPUT_PLACEHOLDER
+					} else {
+						m.textarea.Placeholder = fmt.Sprintf("The next answer starts with %q. %s", prefill, TEXTINPUT_PLACEHOLDER)
+					}
+					return m, nil
+				}
+
+				if m.ch != nil {
+					m.queue = append(m.queue, usermsg)
+					m.textarea.Reset()
+					m.textarea.Placeholder = queuedPlaceholder(len(m.queue))
+					return m, nil
+				}
+
 				// if len(m.llmMessages) > 0 && m.llmMessages[len(m.llmMessages)-1].Role == "user" {
 				// 	// TODO customize
 				// 	var lastmsg = m.llmMessages[len(m.llmMessages)-1]
@@ -1089,6 +1499,9 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// 	}
 		// }
 
+	case reloadConfigMsg:
+		return m.reloadConfig(), nil
+
 	case tea.WindowSizeMsg:
 		m.textarea.SetWidth(msg.Width - 2)
 		m.viewport.Width = msg.Width - 2
@@ -1102,11 +1515,31 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if m.spin {
 			m.spin = false
 			m.streaming = true
-			m.spinner.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("51"))
+			m.status.streaming()
 		}
 
 		if streaming_done {
 			m.streaming = false
+			m.ch = nil
+			if m.cancel != nil {
+				m.cancel()
+				m.cancel = nil
+			}
+			m.viewport.SetContent(m.renderTranscript(""))
+
+			if len(m.queue) > 0 {
+				usermsg := m.queue[0]
+				m.queue = m.queue[1:]
+				// keep what is being typed
+				typed := m.textarea.Value()
+				ret, cmd := sendMsg(m, usermsg)
+				next := ret.(chatTuiState)
+				next.textarea.SetValue(typed)
+				if len(next.queue) > 0 {
+					next.textarea.Placeholder = queuedPlaceholder(len(next.queue))
+				}
+				return next, cmd
+			}
 			return m, nil
 		}
 
@@ -1117,8 +1550,14 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.spin = false
 		}
 
-		m.viewport.SetContent(formatMessageLog(m.llmMessages, m.renderMarkdown, m.viewportWidth, m.mdPaddingWidth, "", "", true))
-		m.viewport.GotoBottom()
+		// keep following the answer only if the user hasn't scrolled up
+		atBottom := m.viewport.AtBottom()
+		m.viewport.SetContent(m.renderTranscript(""))
+		if atBottom {
+			m.viewport.GotoBottom()
+		} else {
+			m.newContent = true
+		}
 
 		return m, tea.Batch(tiCmd, vpCmd, spCmd, readLLMResponse(m, m.ch))
 
@@ -1127,7 +1566,7 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 
 	if m.spin || m.streaming {
-		m.spinner, spCmd = m.spinner.Update(msg)
+		m.status, spCmd = m.status.Update(msg)
 		return m, tea.Batch(tiCmd, vpCmd, spCmd)
 	}
 
@@ -1137,12 +1576,19 @@ func (m chatTuiState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m chatTuiState) View() string {
 
 	if m.spin || m.streaming {
-		m.viewport.SetContent(formatMessageLog(m.llmMessages, m.renderMarkdown, m.viewportWidth, m.mdPaddingWidth, m.spinner.View(), "", true))
+		m.viewport.SetContent(m.renderTranscript(m.status.View()))
+	}
+
+	view := m.viewport.View()
+	if m.newContent && !m.viewport.AtBottom() {
+		lines := strings.Split(view, "\n")
+		lines[len(lines)-1] = lipgloss.PlaceHorizontal(m.viewport.Width, lipgloss.Right, newContentStyle.Render(" new content ↓ "))
+		view = strings.Join(lines, "\n")
 	}
 
 	return fmt.Sprintf(
 		"%s\n%s",
-		m.viewport.View(),
+		view,
 		m.textarea.View(),
 	) + "\n"
 }
@@ -1150,17 +1596,18 @@ func (m chatTuiState) View() string {
 func readLLMResponse(m chatTuiState, ch <-chan string) tea.Cmd {
 	return func() tea.Msg {
 		for content := range ch {
-			return updateViewportMsg{content: content, streaming: true}
+			return updateViewportMsg{content: content, streaming: true, tab: m.id}
 		}
 		var lastMsg, err = getLastMsg(m)
 		if err == nil {
 			m.historyApi(lastMsg)
 		}
-		return updateViewportMsg{content: "", streaming: false}
+		return updateViewportMsg{content: "", streaming: false, tab: m.id}
 	}
 }
 
 type updateViewportMsg struct {
 	streaming bool
 	content   string
+	tab       int
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// local_servers start a llama-server, ollama or similar on the first request
+// to one of their models, to -m local:<name> or to their api_base when
+// nothing answers there yet. The server runs under a detached llm
+// local-server process, which stops it once no request was made for
+// idle_shutdown, so it's shared by the following invocations. Output goes to
+// ~/.config/llmcli/local/<name>.log.
+
+type LocalServerConfig struct {
+	Models         []string `yaml:"models"` // the -m names it serves, the first one is asked for local:<name>
+	APIBase        string   `yaml:"api_base"`
+	LaunchCmd      string   `yaml:"launch_cmd"` // run by the shell
+	Binary         string   `yaml:"binary"`     // instead of launch_cmd: run directly with args, ~ and $VARS expanded
+	Args           []string `yaml:"args"`
+	Health         string   `yaml:"health"`          // URL answering 200 once the model is loaded, default <api_base>/models
+	StartupTimeout string   `yaml:"startup_timeout"` // default 2m
+	IdleShutdown   string   `yaml:"idle_shutdown"`   // default 15m, 0 keeps it running
+}
+
+const (
+	defaultStartupTimeout = 2 * time.Minute
+	defaultIdleShutdown   = 15 * time.Minute
+)
+
+type localServerState struct {
+	PID     int       `json:"pid"` // of llm local-server
+	Started time.Time `json:"started"`
+}
+
+// lookupLocalServer finds the server of a model, local:<name> or the server
+// at apiBase
+func lookupLocalServer(cfg *Config, model string, apiBase string) (string, LocalServerConfig, bool) {
+	if name, ok := strings.CutPrefix(model, "local:"); ok {
+		srv, ok := cfg.LocalServers[name]
+		return name, srv, ok
+	}
+	for name, srv := range cfg.LocalServers {
+		for _, m := range srv.Models {
+			if m == model {
+				return name, srv, true
+			}
+		}
+	}
+	for name, srv := range cfg.LocalServers {
+		if apiBase != "" && strings.TrimRight(srv.APIBase, "/") == strings.TrimRight(apiBase, "/") {
+			return name, srv, true
+		}
+	}
+	return "", LocalServerConfig{}, false
+}
+
+// model is what the server is asked for in place of local:<name>, servers
+// of a single model such as llama-server take any name
+func (srv LocalServerConfig) model(name string) string {
+	if len(srv.Models) > 0 {
+		return srv.Models[0]
+	}
+	return name
+}
+
+func (srv LocalServerConfig) command() *exec.Cmd {
+	if srv.Binary == "" {
+		return shellCommand(srv.LaunchCmd)
+	}
+	args := make([]string, len(srv.Args))
+	for i, arg := range srv.Args {
+		args[i] = expandLaunchArg(arg)
+	}
+	return exec.Command(expandLaunchArg(srv.Binary), args...)
+}
+
+func (srv LocalServerConfig) commandLine() string {
+	if srv.Binary == "" {
+		return srv.LaunchCmd
+	}
+	return strings.Join(append([]string{srv.Binary}, srv.Args...), " ")
+}
+
+// expandLaunchArg does what the shell would for a launch_cmd
+func expandLaunchArg(arg string) string {
+	arg = os.ExpandEnv(arg)
+	if rest, ok := strings.CutPrefix(arg, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return arg
+}
+
+func (srv LocalServerConfig) healthURL() string {
+	if srv.Health != "" {
+		return srv.Health
+	}
+	return strings.TrimRight(srv.APIBase, "/") + "/models"
+}
+
+func (srv LocalServerConfig) startupTimeout() time.Duration {
+	if d, err := time.ParseDuration(srv.StartupTimeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultStartupTimeout
+}
+
+func (srv LocalServerConfig) idleShutdown() time.Duration {
+	if srv.IdleShutdown == "" {
+		return defaultIdleShutdown
+	}
+	d, _ := time.ParseDuration(srv.IdleShutdown)
+	return d
+}
+
+// idleCheckInterval is how often the server checks whether it's idle, and
+// how often a request in progress marks it used
+func (srv LocalServerConfig) idleCheckInterval() time.Duration {
+	return min(max(srv.idleShutdown()/4, time.Second), 30*time.Second)
+}
+
+func localServerHealthy(srv LocalServerConfig) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(srv.healthURL())
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func localServerPath(name, ext string) (string, error) {
+	dir, err := historyDirPath()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "local")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+ext), nil
+}
+
+// touchLocalServer marks the server as used now, for the idle shutdown
+func touchLocalServer(name string) {
+	path, err := localServerPath(name, ".used")
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if os.Chtimes(path, now, now) != nil {
+		os.WriteFile(path, nil, 0644)
+	}
+}
+
+func readLocalServerState(name string) (localServerState, bool) {
+	var st localServerState
+	path, err := localServerPath(name, ".json")
+	if err != nil {
+		return st, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &st) != nil {
+		return st, false
+	}
+	return st, processAlive(st.PID)
+}
+
+// localServerMiddleware sends the requests for a model of local_servers to
+// its server, started on demand. The server is marked used until the answer
+// is complete, so a long answer isn't cut by the idle shutdown.
+func localServerMiddleware(cfg *Config, model string) llmclient.Middleware {
+	if len(cfg.LocalServers) == 0 {
+		return nil
+	}
+	return func(next llmclient.Handler) llmclient.Handler {
+		return func(req *llmclient.Request) (*llmclient.Response, error) {
+			name, srv, ok := lookupLocalServer(cfg, model, req.APIBase)
+			if !ok {
+				return next(req)
+			}
+			req.APIBase = srv.APIBase
+			if strings.HasPrefix(model, "local:") {
+				req.Body["model"] = srv.model(name)
+			}
+			if err := ensureLocalServer(name, srv); err != nil {
+				return nil, err
+			}
+
+			done := make(chan struct{})
+			go func() {
+				ticker := time.NewTicker(srv.idleCheckInterval())
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						touchLocalServer(name)
+					case <-done:
+						touchLocalServer(name)
+						return
+					}
+				}
+			}()
+
+			resp, err := next(req)
+			if err != nil {
+				close(done)
+				return nil, err
+			}
+
+			ch := make(chan string)
+			out := &llmclient.Response{Chunks: ch}
+			go func() {
+				for c := range resp.Chunks {
+					ch <- c
+				}
+				out.Usage, out.Complete = resp.Usage, resp.Complete
+				close(done)
+				close(ch)
+			}()
+			return out, nil
+		}
+	}
+}
+
+// ensureLocalServer starts the server unless it answers already or another
+// llm process started it, then waits for it to be ready
+func ensureLocalServer(name string, srv LocalServerConfig) error {
+	touchLocalServer(name)
+	if localServerHealthy(srv) {
+		return nil
+	}
+
+	lockPath, err := localServerPath(name, ".lock")
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock, true); err != nil {
+		return err
+	}
+
+	logPath, err := localServerPath(name, ".log")
+	if err != nil {
+		unlockFile(lock)
+		return err
+	}
+	if _, running := readLocalServerState(name); !running && !localServerHealthy(srv) {
+		if err := launchLocalServer(name, logPath); err != nil {
+			unlockFile(lock)
+			return fmt.Errorf("starting local server %s: %w", name, err)
+		}
+		slog.Info("starting local server "+name, "command", srv.commandLine())
+	}
+	unlockFile(lock)
+
+	start := time.Now()
+	for !localServerHealthy(srv) {
+		if _, running := readLocalServerState(name); !running {
+			return fmt.Errorf("local server %s exited, see %s", name, logPath)
+		}
+		if time.Since(start) > srv.startupTimeout() {
+			return fmt.Errorf("local server %s isn't ready after %s, see %s", name, srv.startupTimeout(), logPath)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if time.Since(start) > time.Second {
+		slog.Info("local server "+name+" ready", "after", time.Since(start).Round(time.Second))
+	}
+	return nil
+}
+
+func launchLocalServer(name, logPath string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(self, "local-server", name)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	statePath, err := localServerPath(name, ".json")
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(localServerState{PID: cmd.Process.Pid, Started: time.Now()})
+	if err := os.WriteFile(statePath, data, 0644); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// runLocalServer runs the launch command until it exits or is idle for too
+// long, in the detached process started by ensureLocalServer
+func runLocalServer(name string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	srv, ok := cfg.LocalServers[name]
+	if !ok {
+		return fmt.Errorf("no local server %s in the config", name)
+	}
+	usedPath, err := localServerPath(name, ".used")
+	if err != nil {
+		return err
+	}
+	statePath, err := localServerPath(name, ".json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(statePath)
+
+	server := srv.command()
+	server.Stdout = os.Stdout
+	server.Stderr = os.Stderr
+	server.SysProcAttr = serverProcAttr()
+	fmt.Printf("--- %s %s\n", time.Now().Format(time.DateTime), srv.commandLine())
+	if err := server.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Wait()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	idle := srv.idleShutdown()
+	ticker := time.NewTicker(srv.idleCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			fmt.Printf("--- exited: %v\n", err)
+			return err
+		case <-stop:
+			stopProcess(server.Process)
+			return <-exited
+		case <-ticker.C:
+			if idle <= 0 {
+				continue
+			}
+			if info, err := os.Stat(usedPath); err == nil && time.Since(info.ModTime()) > idle {
+				fmt.Printf("--- idle for %s, stopping\n", idle)
+				stopProcess(server.Process)
+				<-exited
+				return nil
+			}
+		}
+	}
+}
+
+func newLocalServerCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:    "local-server <name>",
+		Short:  "Run a server of local_servers until it's idle, started by llm as needed",
+		Args:   cobra.ExactArgs(1),
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLocalServer(args[0])
+		},
+	}
+}
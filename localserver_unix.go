@@ -0,0 +1,43 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// detachedProcAttr lets llm local-server outlive the invocation starting it
+// and the terminal it was started in
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// serverProcAttr puts the launch command and whatever the shell starts in a
+// process group of their own, stopped together
+func serverProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// stopProcess asks the process group to terminate, killing it if it's still
+// there after 10s
+func stopProcess(p *os.Process) {
+	syscall.Kill(-p.Pid, syscall.SIGTERM)
+	for i := 0; i < 100; i++ {
+		if syscall.Kill(-p.Pid, 0) != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// Diagnostics of the cli and of llmclient go through slog to stderr, stdout
+// carries only answers so piped output stays intact. --log-level (or
+// logging.level) picks the least severe level shown: info by default, for
+// progress like a local server starting, and debug with -v.
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	logLevel.Set(slog.LevelInfo)
+	slog.SetDefault(slog.New(&stderrHandler{w: os.Stderr, level: logLevel, mu: &sync.Mutex{}}))
+}
+
+func applyLogLevel(cmd *cobra.Command) error {
+	name, _ := cmd.Flags().GetString("log-level")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	if !cmd.Flags().Changed("log-level") {
+		if cfg, err := loadConfig(); err == nil && cfg.Logging.Level != "" && !isConfigCmd(cmd) {
+			name = cfg.Logging.Level
+		}
+		if verbose {
+			name = "debug"
+		}
+	}
+
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// stderrHandler writes records as lines like the other messages of the cli:
+// "llm: warning: message key=value"
+type stderrHandler struct {
+	w     io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *stderrHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *stderrHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString("llm: ")
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("warning: ")
+	case r.Level < slog.LevelInfo:
+		b.WriteString("debug: ")
+	}
+	b.WriteString(r.Message)
+
+	writeAttr := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%s", a.Key, quoteLogValue(a.Value.String()))
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// quoteLogValue quotes values with spaces or line breaks, so a record stays
+// on one line
+func quoteLogValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+func (h *stderrHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := *h
+	ret.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &ret
+}
+
+// groups aren't used by the cli, their attributes are written ungrouped
+func (h *stderrHandler) WithGroup(name string) slog.Handler {
+	return h
+}
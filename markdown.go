@@ -0,0 +1,163 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/glamour"
+	"github.com/muesli/termenv"
+	markdown "github.com/vlanse/go-term-markdown"
+)
+
+type TUIConfig struct {
+	Renderer string       `yaml:"renderer"` // go-term-markdown (default) or glamour
+	Plain    bool         `yaml:"plain"`    // see --plain
+	Actions  bool         `yaml:"actions"`  // see --actions
+	Status   StatusConfig `yaml:"status"`
+}
+
+type markdownRenderer interface {
+	Render(content string, width int, padding int) string
+}
+
+type termMarkdownRenderer struct{}
+
+func (termMarkdownRenderer) Render(content string, width int, padding int) string {
+	return string(markdown.Render(content, width, padding))
+}
+
+// glamourRenderer handles tables and nested lists better, its renderers are
+// bound to a word wrap width and kept per width
+type glamourRenderer struct {
+	style string
+
+	mu        sync.Mutex
+	renderers map[int]*glamour.TermRenderer
+}
+
+func (r *glamourRenderer) Render(content string, width int, padding int) string {
+	r.mu.Lock()
+	tr, ok := r.renderers[width]
+	if !ok {
+		var err error
+		tr, err = glamour.NewTermRenderer(glamour.WithStandardStyle(r.style), glamour.WithWordWrap(width-padding))
+		if err != nil {
+			r.mu.Unlock()
+			return content
+		}
+		r.renderers[width] = tr
+	}
+	r.mu.Unlock()
+
+	out, err := tr.Render(content)
+	if err != nil {
+		return content
+	}
+
+	if padding > 0 {
+		pad := strings.Repeat(" ", padding)
+		out = pad + strings.ReplaceAll(out, "\n", "\n"+pad)
+	}
+
+	return out
+}
+
+// mdRenderer is selected once per process by setMarkdownRenderer
+var mdRenderer markdownRenderer = termMarkdownRenderer{}
+
+func setMarkdownRenderer(cfg *Config) error {
+	switch cfg.TUI.Renderer {
+	case "", "go-term-markdown":
+		mdRenderer = termMarkdownRenderer{}
+	case "glamour":
+		// the background is queried before the TUI takes over the terminal
+		style := "dark"
+		if !termenv.HasDarkBackground() {
+			style = "light"
+		}
+		mdRenderer = &glamourRenderer{style: style, renderers: map[int]*glamour.TermRenderer{}}
+	default:
+		return fmt.Errorf("tui.renderer: unknown markdown renderer %q, use go-term-markdown or glamour", cfg.TUI.Renderer)
+	}
+
+	return nil
+}
+
+// markdownCacheSize bounds the rendered messages kept, enough for the
+// visible part of long sessions at a couple of widths
+const markdownCacheSize = 256
+
+type markdownCacheKey struct {
+	hash    uint64
+	width   int
+	padding int
+}
+
+type markdownCacheEntry struct {
+	key      markdownCacheKey
+	rendered string
+}
+
+// markdownLRU caches rendered markdown by content hash, the least recently
+// used entries are evicted beyond size
+type markdownLRU struct {
+	sync.Mutex
+	size    int
+	order   *list.List // front is the most recently used
+	entries map[markdownCacheKey]*list.Element
+}
+
+func newMarkdownLRU(size int) *markdownLRU {
+	return &markdownLRU{size: size, order: list.New(), entries: map[markdownCacheKey]*list.Element{}}
+}
+
+func (c *markdownLRU) Get(key markdownCacheKey) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*markdownCacheEntry).rendered, true
+}
+
+func (c *markdownLRU) Put(key markdownCacheKey, rendered string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*markdownCacheEntry).rendered = rendered
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&markdownCacheEntry{key: key, rendered: rendered})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*markdownCacheEntry).key)
+	}
+}
+
+var markdownCache = newMarkdownLRU(markdownCacheSize)
+
+func renderMarkdownCached(content string, width int, padding int) string {
+	h := fnv.New64a()
+	h.Write([]byte(content))
+	key := markdownCacheKey{hash: h.Sum64(), width: width, padding: padding}
+
+	if rendered, ok := markdownCache.Get(key); ok {
+		return rendered
+	}
+
+	rendered := mdRenderer.Render(content, width, padding)
+	markdownCache.Put(key, rendered)
+
+	return rendered
+}
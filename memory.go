@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type MemoryConfig struct {
+	Enabled bool `yaml:"enabled"` // inject remembered facts into the system prompt
+}
+
+// memoryFact is a durable fact or preference of the user ("I use fish"),
+// carried over into future sessions
+type memoryFact struct {
+	ID      string `json:"id"`
+	Fact    string `json:"fact"`
+	Created int64  `json:"created"`
+}
+
+// newFactID returns a short hex id, base64 uuids may start with a dash and
+// would be taken for a flag by memory rm
+func newFactID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func memoryFilePath() (string, error) {
+	configDir, err := historyDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "memory.json"), nil
+}
+
+func loadMemory() ([]memoryFact, error) {
+	memoryFile, err := memoryFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(memoryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var facts []memoryFact
+	if err := json.Unmarshal(data, &facts); err != nil {
+		return nil, fmt.Errorf("%s: %w", memoryFile, err)
+	}
+
+	return facts, nil
+}
+
+func saveMemory(facts []memoryFact) error {
+	memoryFile, err := memoryFilePath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(memoryFile), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(memoryFile, data, 0o644)
+}
+
+// withMemory appends the remembered facts to the system prompt
+func withMemory(systemPrompt string, facts []memoryFact) string {
+	if len(facts) == 0 {
+		return systemPrompt
+	}
+
+	var section strings.Builder
+	section.WriteString("Facts the user asked you to remember:")
+	for _, f := range facts {
+		fmt.Fprintf(&section, "\n- %s", f.Fact)
+	}
+
+	return appendSystemPrompt(systemPrompt, section.String())
+}
+
+func newMemoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "memory",
+		Short:   "Manage facts injected into the system prompt of future sessions (config: memory.enabled)",
+		GroupID: "data",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add <fact>",
+		Short: "Remember a fact or preference",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			facts, err := loadMemory()
+			if err != nil {
+				return err
+			}
+
+			fact := memoryFact{ID: newFactID(), Fact: strings.Join(args, " "), Created: time.Now().Unix()}
+			if err := saveMemory(append(facts, fact)); err != nil {
+				return err
+			}
+
+			if cfg, err := loadConfig(); err == nil && !cfg.Memory.Enabled {
+				fmt.Fprintln(os.Stderr, "note: memory is disabled, set memory.enabled in the config to use it")
+			}
+
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List remembered facts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			facts, err := loadMemory()
+			if err != nil {
+				return err
+			}
+
+			for _, f := range facts {
+				fmt.Printf("%s  %s  %s\n", f.ID, time.Unix(f.Created, 0).Format("2006-01-02"), f.Fact)
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rm <id-prefix>",
+		Short: "Forget a fact",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			facts, err := loadMemory()
+			if err != nil {
+				return err
+			}
+
+			var kept []memoryFact
+			var removed int
+			for _, f := range facts {
+				if strings.HasPrefix(f.ID, args[0]) {
+					removed++
+				} else {
+					kept = append(kept, f)
+				}
+			}
+
+			switch removed {
+			case 0:
+				return fmt.Errorf("no fact matches %q", args[0])
+			case 1:
+				return saveMemory(kept)
+			default:
+				return fmt.Errorf("%q matches %d facts, use a longer prefix", args[0], removed)
+			}
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// RequestConfig adjusts the requests to a model
+type RequestConfig struct {
+	Retries      int    `yaml:"retries"`       // on rate limits, server and connection errors
+	RetryBackoff string `yaml:"retry_backoff"` // first wait, doubled for each retry, default 1s
+	CacheContext bool   `yaml:"cache_context"` // see --cache-context
+}
+
+// lookupRequestConfig returns the settings of the model, or the default
+func lookupRequestConfig(cfg *Config, model string) RequestConfig {
+	if rc, ok := cfg.Requests[model]; ok {
+		return rc
+	}
+	return cfg.Requests["default"]
+}
+
+// requestMiddlewares are the per-model additions to the llmclient chain:
+// local servers, the daily budget and retries
+func requestMiddlewares(cfg *Config, model string) []llmclient.Middleware {
+	rc := lookupRequestConfig(cfg, model)
+
+	backoff := time.Second
+	if d, err := time.ParseDuration(rc.RetryBackoff); err == nil && d > 0 {
+		backoff = d
+	}
+
+	ret := []llmclient.Middleware{
+		llmclient.Guard(func(*llmclient.Request) error { return checkBudget(cfg) }),
+		llmclient.Retry(rc.Retries, backoff),
+	}
+	if mw := localServerMiddleware(cfg, model); mw != nil {
+		ret = append([]llmclient.Middleware{mw}, ret...)
+	}
+	return ret
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// The context window and the longest answer of a model are taken from the
+// model list of the API where the provider reports them (OpenRouter, Groq,
+// vLLM, Together, llama.cpp). The lists are cached per API base for a day,
+// a failed lookup for an hour. context_windows in the config still wins.
+
+const (
+	modelLimitsTTL       = 24 * time.Hour
+	modelLimitsFailedTTL = time.Hour
+	modelLimitsTimeout   = 3 * time.Second
+
+	// smaller requests fit any model, their limits aren't looked up
+	modelLimitsThreshold = 8192
+)
+
+type modelLimits struct {
+	Context   int `json:"context,omitempty"`
+	MaxOutput int `json:"max_output,omitempty"`
+}
+
+type modelLimitsEntry struct {
+	Fetched time.Time              `json:"fetched"`
+	Failed  bool                   `json:"failed,omitempty"`
+	Models  map[string]modelLimits `json:"models"`
+}
+
+func modelLimitsPath() (string, error) {
+	dir, err := cacheDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "models.json"), nil
+}
+
+func readModelLimitsCache() map[string]modelLimitsEntry {
+	ret := map[string]modelLimitsEntry{}
+	path, err := modelLimitsPath()
+	if err != nil {
+		return ret
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &ret)
+	}
+	return ret
+}
+
+func writeModelLimitsCache(entries map[string]modelLimitsEntry) error {
+	path, err := modelLimitsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// discoveredModelLimits returns the limits the API reports for its models,
+// from the cache or fetched
+func discoveredModelLimits(apiKey, apiBase string) map[string]modelLimits {
+	entries := readModelLimitsCache()
+	if entry, ok := entries[apiBase]; ok {
+		ttl := modelLimitsTTL
+		if entry.Failed {
+			ttl = modelLimitsFailedTTL
+		}
+		if time.Since(entry.Fetched) < ttl {
+			return entry.Models
+		}
+	}
+
+	entry := modelLimitsEntry{Fetched: time.Now(), Models: map[string]modelLimits{}}
+	models, err := llmclient.ListModels(apiKey, apiBase, modelLimitsTimeout)
+	if err != nil {
+		slog.Debug("listing the models for their limits", "err", err)
+		entry.Failed = true
+	}
+	for _, model := range models {
+		if context, maxOutput := model.Limits(); context > 0 || maxOutput > 0 {
+			entry.Models[model.ID] = modelLimits{Context: context, MaxOutput: maxOutput}
+		}
+	}
+
+	entries[apiBase] = entry
+	if err := writeModelLimitsCache(entries); err != nil {
+		slog.Debug("caching the model limits", "err", err)
+	}
+	return entry.Models
+}
+
+// resolveModelLimits prefers the window set for exactly this model in the
+// config, then what the API reports, then the prefixes of the config and
+// the built-in windows
+func resolveModelLimits(cfg *Config, apiKey, apiBase, model string) modelLimits {
+	if n, ok := cfg.ContextWindows[model]; ok {
+		return modelLimits{Context: n}
+	}
+
+	listed := model
+	if name, srv, ok := lookupLocalServer(cfg, model, apiBase); ok {
+		apiBase = srv.APIBase
+		if strings.HasPrefix(model, "local:") {
+			listed = srv.model(name)
+		}
+	}
+	limits := discoveredModelLimits(apiKey, apiBase)[listed]
+	if limits.Context == 0 {
+		limits.Context, _ = lookupContextWindow(cfg, model)
+	}
+	return limits
+}
+
+// contextShare tells how much of the context window a prompt takes, empty
+// when the window is unknown
+func contextShare(limits modelLimits, model string, prompt int) string {
+	if limits.Context <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d%% of the context window of %s (%d)", prompt*100/limits.Context, model, limits.Context)
+}
+
+// fitAnswerLength warns about requests larger than the context window and
+// lowers the default max_tokens to what the model can still answer,
+// an explicit -N is only warned about
+func fitAnswerLength(limits modelLimits, model string, prompt int, maxTokens int, explicit bool, summarized bool) int {
+	if limits.Context > 0 && prompt >= limits.Context {
+		hint := ", --summarize-overflow can fit it"
+		if summarized {
+			hint = ""
+		}
+		slog.Warn(fmt.Sprintf("the request is ~%d tokens, %s%s", prompt, contextShare(limits, model, prompt), hint))
+		return maxTokens
+	}
+
+	ret := maxTokens
+	if limits.MaxOutput > 0 && ret > limits.MaxOutput {
+		ret = limits.MaxOutput
+	}
+	if limits.Context > 0 && prompt+ret > limits.Context {
+		ret = limits.Context - prompt
+	}
+	if ret == maxTokens {
+		return maxTokens
+	}
+	if explicit {
+		slog.Warn(fmt.Sprintf("-N %d is more than %s can answer here, at most %d tokens", maxTokens, model, ret))
+		return maxTokens
+	}
+	return ret
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+)
+
+// --summarize-overflow: input that doesn't fit in the context window of the
+// model is split into chunks, each is summarized with regard to the question
+// (usually by a cheaper model) and the question is asked about the summaries
+
+// defaultContextWindows in tokens, overridable via context_windows in the config
+var defaultContextWindows = map[string]int{
+	"gpt-3.5-turbo":      16385,
+	"gpt-4":              8192,
+	"gpt-4-turbo":        128000,
+	"gpt-4o":             128000,
+	"gpt-4o-mini":        128000,
+	"llama3-8b-8192":     8192,
+	"llama3-70b-8192":    8192,
+	"mixtral-8x7b-32768": 32768,
+	"gemma-7b-it":        8192,
+}
+
+type SummarizeConfig struct {
+	Model       string `yaml:"model"`        // for the chunk summaries, default the main model
+	ChunkTokens int    `yaml:"chunk_tokens"` // default two thirds of the summary model's window, at most 24000
+}
+
+const (
+	defaultChunkTokens  = 6000 // when the window of the summary model is unknown
+	maxChunkTokens      = 24000
+	summaryTokens       = 1024
+	summaryParallelism  = 4
+	maxSummarizeRounds  = 3
+	summarizeSystemText = "You condense one part of a long input so that a question about the whole input can be answered from the condensed parts alone. Keep every fact, number, name, error message and code line that may matter for the question, drop repetition and irrelevant detail. Answer with the condensed text only."
+)
+
+// lookupContextWindow matches the model like lookupPricing: exactly first,
+// then by the longest known prefix
+func lookupContextWindow(cfg *Config, model string) (int, bool) {
+	tables := []map[string]int{cfg.ContextWindows, defaultContextWindows}
+	key, table, ok := lookupModelKey(model, tables...)
+	if !ok {
+		return 0, false
+	}
+	return tables[table][key], true
+}
+
+func messagesTokens(messages []Message) int {
+	n := 0
+	for _, msg := range messages {
+		n += llmclient.EstimateTokens(msg.Content) + 4
+	}
+	return n
+}
+
+// splitChunks cuts text at line ends into pieces of at most maxChars, lines
+// longer than that are cut as well
+func splitChunks(text string, maxChars int) []string {
+	var chunks []string
+	var cur strings.Builder
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		for len(line) > maxChars {
+			if cur.Len() > 0 {
+				chunks = append(chunks, cur.String())
+				cur.Reset()
+			}
+			chunks = append(chunks, line[:maxChars])
+			line = line[maxChars:]
+		}
+		if cur.Len()+len(line) > maxChars {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line)
+	}
+	if strings.TrimSpace(cur.String()) != "" {
+		chunks = append(chunks, cur.String())
+	}
+
+	return chunks
+}
+
+type overflowSummarizer struct {
+	cfg         *Config
+	model       string
+	chunkTokens int
+	summarize   func(system, user string) (string, error)
+}
+
+func newOverflowSummarizer(cfg *Config, model string, seed int, apiKey, apiBase string, verbose bool, cache *llmclient.Cache, usage *usageReporter) *overflowSummarizer {
+	chunkTokens := cfg.Summarize.ChunkTokens
+	if chunkTokens <= 0 {
+		chunkTokens = defaultChunkTokens
+		if window := resolveModelLimits(cfg, apiKey, apiBase, model).Context; window > 0 {
+			chunkTokens = min(window*2/3, maxChunkTokens)
+		}
+	}
+
+	var mu sync.Mutex
+
+	return &overflowSummarizer{
+		cfg:         cfg,
+		model:       model,
+		chunkTokens: chunkTokens,
+		summarize: func(system, user string) (string, error) {
+			messages := []llmclient.Message{{Role: "system", Content: system}, {Role: "user", Content: user}}
+			record := func(u llmclient.Usage) {
+				mu.Lock()
+				defer mu.Unlock()
+				usage.Record(u)
+			}
+			ch, err := llmclient.Chat(messages, model, seed, 0, nil, apiKey, apiBase, false, map[string]interface{}{"max_tokens": summaryTokens}, verbose, record, cache, cfg.Hooks, requestMiddlewares(cfg, model)...)
+			if err != nil {
+				return "", err
+			}
+			var ret strings.Builder
+			for content := range ch {
+				ret.WriteString(content)
+			}
+			return ret.String(), nil
+		},
+	}
+}
+
+// summarizeParts summarizes the chunks of text concurrently
+func (s *overflowSummarizer) summarizeParts(text, question string) ([]string, error) {
+	chunks := splitChunks(text, s.chunkTokens*4)
+
+	summaries := make([]string, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, summaryParallelism)
+	var wg sync.WaitGroup
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prompt := fmt.Sprintf("Question about the whole input: %s\n\nPart %d of %d of the input:\n\n%s", question, i+1, len(chunks), chunk)
+			if strings.TrimSpace(question) == "" {
+				prompt = fmt.Sprintf("Part %d of %d of the input:\n\n%s", i+1, len(chunks), chunk)
+			}
+			summaries[i], errs[i] = s.summarize(summarizeSystemText, prompt)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("summarizing part %d of %d: %w", i+1, len(chunks), err)
+		}
+	}
+	return summaries, nil
+}
+
+// fitContextWindow replaces the user message (and files placed in the
+// system prompt) with summaries when the request wouldn't fit in window
+// tokens with reserve tokens left for the answer. messages end with the
+// user message, question is the part of it typed by the user.
+func (s *overflowSummarizer) fitContextWindow(messages []Message, question, systemFiles string, window, reserve int) ([]Message, error) {
+	total := messagesTokens(messages)
+	if total+reserve <= window || len(messages) == 0 {
+		return messages, nil
+	}
+
+	user := messages[len(messages)-1]
+	rest := append([]Message{}, messages[:len(messages)-1]...)
+
+	// the question is kept as is, everything else is material
+	material := user.Content
+	if question != "" {
+		material = strings.Replace(material, question, "", 1)
+	}
+	if systemFiles != "" {
+		for i, msg := range rest {
+			if msg.Role == "system" && strings.Contains(msg.Content, systemFiles) {
+				rest[i].Content = strings.TrimSpace(strings.Replace(msg.Content, systemFiles, "", 1))
+				material = systemFiles + "\n\n" + material
+			}
+		}
+	}
+
+	budget := window - reserve - messagesTokens(rest) - llmclient.EstimateTokens(question) - 100
+	if budget <= 0 {
+		return nil, fmt.Errorf("the context window of %d tokens leaves no room for the input, lower --max_tokens", window)
+	}
+
+	slog.Info(fmt.Sprintf("the request needs ~%d tokens, more than the context window of %d, summarizing the input with %s", total+reserve, window, s.model))
+
+	for round := 1; ; round++ {
+		summaries, err := s.summarizeParts(material, question)
+		if err != nil {
+			return nil, err
+		}
+
+		var b strings.Builder
+		for i, summary := range summaries {
+			fmt.Fprintf(&b, "### Part %d of %d\n\n%s\n\n", i+1, len(summaries), strings.TrimSpace(summary))
+		}
+		material = b.String()
+
+		if llmclient.EstimateTokens(material) <= budget {
+			break
+		}
+		if round == maxSummarizeRounds {
+			return nil, fmt.Errorf("the input is still ~%d tokens after %d rounds of summaries, more than the %d available", llmclient.EstimateTokens(material), round, budget)
+		}
+	}
+
+	content := "The input was too long and was condensed part by part:\n\n" + material
+	if question != "" {
+		content += "\n" + question
+	}
+	user.Content = strings.TrimSpace(content)
+
+	return append(rest, user), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filePatch is a whole-file change produced by one of the code workflows,
+// it is presented to the user as a unified diff and applied only on request.
+type filePatch struct {
+	Path string
+	Old  string
+	New  string
+}
+
+func (p filePatch) Diff() string {
+	return unifiedDiff(p.Path, p.Old, p.New)
+}
+
+func formatPatches(patches []filePatch) string {
+	var ret strings.Builder
+	for _, p := range patches {
+		ret.WriteString(p.Diff())
+	}
+	return ret.String()
+}
+
+func applyFilePatches(patches []filePatch) error {
+	for _, p := range patches {
+		current, err := os.ReadFile(p.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if string(current) != p.Old {
+			return fmt.Errorf("%s changed on disk since the patch was generated", p.Path)
+		}
+	}
+
+	for _, p := range patches {
+		if dir := filepath.Dir(p.Path); dir != "" {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(p.Path, []byte(p.New), 0o644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines computes a shortest edit script with the Myers algorithm
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+search:
+	for d := 0; d <= max; d++ {
+		vc := make([]int, len(v))
+		copy(vc, v)
+		trace = append(trace, vc)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+
+	return ops
+}
+
+func unifiedDiff(path, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+
+	const context = 3
+
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+
+	oldPos := make([]int, len(ops)+1)
+	newPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if op.kind != '+' {
+			oldPos[i+1]++
+		}
+		if op.kind != '-' {
+			newPos[i+1]++
+		}
+	}
+
+	oldName, newName := "a/"+path, "b/"+path
+	if oldText == "" {
+		oldName = "/dev/null"
+	}
+	if newText == "" {
+		newName = "/dev/null"
+	}
+
+	var ret strings.Builder
+	fmt.Fprintf(&ret, "--- %s\n+++ %s\n", oldName, newName)
+
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i >= len(ops) {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		j := i
+		for j < len(ops) {
+			if ops[j].kind != ' ' {
+				j++
+				continue
+			}
+			run := 0
+			for j+run < len(ops) && ops[j+run].kind == ' ' {
+				run++
+			}
+			if j+run >= len(ops) || run > 2*context {
+				break
+			}
+			j += run
+		}
+
+		end := j + context
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		oldStart, oldCount := oldPos[start], oldPos[end]-oldPos[start]
+		newStart, newCount := newPos[start], newPos[end]-newPos[start]
+		if oldCount > 0 {
+			oldStart++
+		}
+		if newCount > 0 {
+			newStart++
+		}
+		fmt.Fprintf(&ret, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+
+		for _, op := range ops[start:end] {
+			ret.WriteByte(op.kind)
+			ret.WriteString(strings.TrimSuffix(op.line, "\n"))
+			ret.WriteByte('\n')
+			if !strings.HasSuffix(op.line, "\n") {
+				ret.WriteString("\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return ret.String()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// llm pipe draft:gpt-4o-mini refine:claude-3-5-sonnet passes the request
+// through several stages, each one answering the prompt of its stage with the
+// output of the previous one. Stages are the built-in ones below, task
+// presets (their system prompt and temperature) or the stages of a pipeline
+// declared in the config. Prompts can use {{input}}, the output of the
+// previous stage, and {{request}}, the original request.
+
+type PipelineStage struct {
+	Name        string   `yaml:"name"`
+	Model       string   `yaml:"model"`
+	Prompt      string   `yaml:"prompt"` // {{input}} and {{request}} are replaced, the input is appended without {{input}}
+	System      string   `yaml:"system"`
+	Temperature *float64 `yaml:"temperature"`
+}
+
+var defaultPipelineStages = map[string]PipelineStage{
+	"draft": {
+		Prompt: "{{input}}",
+	},
+	"refine": {
+		System: "You are a meticulous editor. You improve drafts without changing what they are about.",
+		Prompt: "Request:\n{{request}}\n\nDraft answer:\n{{input}}\n\nImprove the draft: fix mistakes, fill in what's missing for the request and tighten the wording. Reply with the improved answer only.",
+	},
+	"review": {
+		System: "You are a critical reviewer.",
+		Prompt: "Request:\n{{request}}\n\nAnswer:\n{{input}}\n\nList the errors, omissions and weak points of the answer, most important first.",
+	},
+	"fix": {
+		Prompt: "Request:\n{{request}}\n\nReview of an earlier answer:\n{{input}}\n\nWrite the answer to the request, addressing every point of the review. Reply with the answer only.",
+	},
+	"summarize": {
+		Temperature: temperaturePtr(0),
+		Prompt:      "Summarize the following concisely, keeping the key facts:\n\n{{input}}",
+	},
+}
+
+func pipelineStageNames(cfg *Config) []string {
+	var ret []string
+	for name := range defaultPipelineStages {
+		ret = append(ret, name)
+	}
+	for _, name := range taskPresetNames(cfg) {
+		if _, ok := defaultPipelineStages[name]; !ok {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// parsePipelineStage resolves name[:model], a task preset becomes a stage
+// sending the input with the preset's system prompt. Tasks of the config
+// take precedence over the built-in stages.
+func parsePipelineStage(cfg *Config, spec string) (PipelineStage, error) {
+	name, model, _ := strings.Cut(spec, ":")
+
+	_, configured := cfg.Tasks[name]
+	if stage, ok := defaultPipelineStages[name]; ok && !configured {
+		stage.Name, stage.Model = name, model
+		return stage, nil
+	}
+	if preset, err := lookupTaskPreset(cfg, name); err == nil {
+		return PipelineStage{Name: name, Model: model, Prompt: "{{input}}", System: preset.SystemPrompt, Temperature: preset.Temperature}, nil
+	}
+
+	return PipelineStage{}, fmt.Errorf("unknown stage %q, available: %s; pipelines of the config: %s", name, strings.Join(pipelineStageNames(cfg), ", "), strings.Join(pipelineNames(cfg), ", "))
+}
+
+func pipelineNames(cfg *Config) []string {
+	var ret []string
+	for name := range cfg.Pipelines {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	if len(ret) == 0 {
+		return []string{"none"}
+	}
+	return ret
+}
+
+func stagePrompt(stage PipelineStage, input, request string) string {
+	prompt := stage.Prompt
+	if prompt == "" {
+		prompt = "{{input}}"
+	}
+	if !strings.Contains(prompt, "{{input}}") {
+		prompt += "\n\n{{input}}"
+	}
+	return strings.NewReplacer("{{input}}", input, "{{request}}", request).Replace(prompt)
+}
+
+func newPipeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pipe <pipeline | stage[:model]...>",
+		Short: "Pass the request from stdin or --input through several stages, e.g. a draft by one model refined by another",
+		Example: `  echo "explain raft consensus" | llm pipe draft:gpt-4o-mini refine:gpt-4o
+  llm pipe blogpost --input "why we moved to postgres" --save-dir stages/`,
+		GroupID: "chat",
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    runPipe,
+	}
+
+	cmd.Flags().StringP("input", "i", "", "The request, read from stdin if not given")
+	cmd.Flags().String("save-dir", "", "Save the output of every stage to <dir>/<n>-<stage>.md")
+	cmd.Flags().IntP("max_tokens", "N", 4096, "Max amount of tokens in each response")
+
+	return cmd
+}
+
+func runPipe(cmd *cobra.Command, args []string) error {
+	request, _ := cmd.Flags().GetString("input")
+	saveDir, _ := cmd.Flags().GetString("save-dir")
+	maxTokens, _ := cmd.Flags().GetInt("max_tokens")
+
+	modelname := getModelName(cmd)
+	seed, _ := cmd.Flags().GetInt("seed")
+	temperature, _ := cmd.Flags().GetFloat64("temperature")
+	apiKey, apiBase := configuredAPI(cmd)
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	printCost, _ := cmd.Flags().GetBool("cost")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var stages []PipelineStage
+	if pipeline, ok := cfg.Pipelines[args[0]]; ok && len(args) == 1 {
+		stages = pipeline
+	} else {
+		for _, spec := range args {
+			stage, err := parsePipelineStage(cfg, spec)
+			if err != nil {
+				return err
+			}
+			stages = append(stages, stage)
+		}
+	}
+	if len(stages) == 0 {
+		return fmt.Errorf("pipeline %s has no stages", args[0])
+	}
+
+	if request == "" {
+		if terminal().Stdin {
+			return fmt.Errorf("give the request with --input or on stdin")
+		}
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		request = strings.TrimSpace(string(data))
+	}
+	if request == "" {
+		return fmt.Errorf("the request is empty")
+	}
+
+	if saveDir != "" {
+		if err := os.MkdirAll(saveDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	cache, err := openResponseCache(cmd, cfg)
+	if err != nil {
+		return err
+	}
+	session := newSession()
+
+	input := request
+	for i, stage := range stages {
+		last := i == len(stages)-1
+
+		model := stage.Model
+		if model == "" {
+			model = modelname
+		}
+		temp := temperature
+		if stage.Temperature != nil && !cmd.Flags().Changed("temperature") {
+			temp = *stage.Temperature
+		}
+		name := stage.Name
+		if name == "" {
+			name = fmt.Sprintf("stage%d", i+1)
+		}
+
+		var messages []llmclient.Message
+		if stage.System != "" {
+			messages = append(messages, llmclient.Message{Role: "system", Content: stage.System})
+		}
+		messages = append(messages, llmclient.Message{Role: "user", Content: stagePrompt(stage, input, request)})
+
+		fmt.Fprintf(os.Stderr, "pipe: %d/%d %s (%s)\n", i+1, len(stages), name, model)
+
+		extra := map[string]interface{}{"max_tokens": maxTokens}
+		if last && printCost {
+			extra["stream_options"] = map[string]interface{}{"include_usage": true}
+		}
+		usage := newUsageReporter(cfg, session, model)
+		// only the final answer is streamed
+		ch, err := llmclient.Chat(messages, model, seed, temp, nil, apiKey, apiBase, last, extra, verbose, usage.Record, cache, cfg.Hooks, requestMiddlewares(cfg, model)...)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", name, err)
+		}
+		var output strings.Builder
+		for content := range ch {
+			output.WriteString(content)
+			if last {
+				fmt.Print(content)
+			}
+		}
+		if last {
+			fmt.Println()
+		}
+		if printCost {
+			usage.Print()
+		}
+
+		if saveDir != "" {
+			path := filepath.Join(saveDir, fmt.Sprintf("%d-%s.md", i+1, name))
+			if err := os.WriteFile(path, []byte(output.String()), 0644); err != nil {
+				return err
+			}
+		}
+
+		input = strings.TrimSpace(output.String())
+		if input == "" && !last {
+			return fmt.Errorf("stage %s gave an empty answer", name)
+		}
+	}
+
+	return nil
+}
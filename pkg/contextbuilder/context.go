@@ -0,0 +1,107 @@
+// Package contextbuilder assembles the context of a request: files picked
+// by paths and globs, rendered as markdown or xml, and the order of the
+// parts of the user message.
+package contextbuilder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// FenceLanguages maps file extensions to markdown code block languages
+var FenceLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".ts": "typescript", ".tsx": "tsx",
+	".rs": "rust", ".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".java": "java",
+	".rb": "ruby", ".sh": "bash", ".cs": "csharp", ".kt": "kotlin", ".swift": "swift",
+}
+
+// FormatFiles renders the files as markdown code blocks (format md) or xml
+// elements (xml)
+func FormatFiles(paths []string, format string) (string, error) {
+	return formatFiles(paths, format, false)
+}
+
+// FormatFilesNumbered is FormatFiles with the files labeled [1], [2], ...
+// in the order of paths, for answers citing them
+func FormatFilesNumbered(paths []string, format string) (string, error) {
+	return formatFiles(paths, format, true)
+}
+
+func formatFiles(paths []string, format string, numbered bool) (string, error) {
+	var ret strings.Builder
+
+	switch format {
+	case "md":
+		ret.WriteString("Files provided as context:\n\n")
+	case "xml":
+		ret.WriteString("<files>\n")
+	default:
+		return "", fmt.Errorf("unknown context format %q, use md or xml", format)
+	}
+
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		content := strings.TrimRight(string(data), "\n")
+
+		switch {
+		case format == "md" && numbered:
+			fmt.Fprintf(&ret, "### [%d] %s\n```%s\n%s\n```\n\n", i+1, filepath.ToSlash(path), FenceLanguages[filepath.Ext(path)], content)
+		case format == "md":
+			fmt.Fprintf(&ret, "### %s\n```%s\n%s\n```\n\n", filepath.ToSlash(path), FenceLanguages[filepath.Ext(path)], content)
+		case numbered:
+			fmt.Fprintf(&ret, "<file index=\"%d\" path=%q>\n%s\n</file>\n", i+1, filepath.ToSlash(path), content)
+		default:
+			fmt.Fprintf(&ret, "<file path=%q>\n%s\n</file>\n", filepath.ToSlash(path), content)
+		}
+	}
+
+	if format == "xml" {
+		ret.WriteString("</files>")
+	}
+
+	return strings.TrimRight(ret.String(), "\n"), nil
+}
+
+// Sources are the parts a layout can order
+var Sources = []string{"files", "stdin", "clipboard", "prompt"}
+
+// ParseLayout parses a spec like "files,stdin,prompt", an empty spec
+// keeps the classic layout (files in the system prompt, the question
+// followed by stdin)
+func ParseLayout(spec string) ([]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var layout []string
+	for _, source := range strings.Split(spec, ",") {
+		source = strings.TrimSpace(source)
+		if !slices.Contains(Sources, source) {
+			return nil, fmt.Errorf("context layout %q: unknown source %q, use %s", spec, source, strings.Join(Sources, ", "))
+		}
+		if slices.Contains(layout, source) {
+			return nil, fmt.Errorf("context layout %q: %s is listed twice", spec, source)
+		}
+		layout = append(layout, source)
+	}
+
+	return layout, nil
+}
+
+// Compose joins the non-empty parts in layout order, parts not
+// in the layout are left out
+func Compose(layout []string, parts map[string]string) string {
+	var ret []string
+	for _, source := range layout {
+		if part := strings.TrimSpace(parts[source]); part != "" {
+			ret = append(ret, part)
+		}
+	}
+	return strings.Join(ret, "\n\n")
+}
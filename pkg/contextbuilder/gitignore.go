@@ -0,0 +1,175 @@
+package contextbuilder
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// globToRegexp translates a glob with ** (any number of directories), *, ?
+// and [classes] into a regular expression matching slash separated paths
+func globToRegexp(glob string) string {
+	var re strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				switch {
+				case strings.HasPrefix(glob[i:], "**/"):
+					re.WriteString("(.*/)?")
+					i += 2
+				default:
+					re.WriteString(".*")
+					i++
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			if end := strings.IndexByte(glob[i+1:], ']'); end >= 0 {
+				class := glob[i+1 : i+1+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				re.WriteString("[" + class + "]")
+				i += end + 1
+			} else {
+				re.WriteString(`\[`)
+			}
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return re.String()
+}
+
+type ignoreRule struct {
+	base    string // absolute directory of the .gitignore
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// gitignore holds the rules of the .gitignore files seen so far, later
+// rules win like in git. Rules only apply below their file's directory.
+type gitignore struct {
+	rules []ignoreRule
+}
+
+// newGitignore loads the .gitignore files from the repository root down to
+// dir, the ones below dir are added by the walk with load
+func newGitignore(dir string) *gitignore {
+	g := &gitignore{}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return g
+	}
+
+	var dirs []string
+	for d := abs; ; {
+		dirs = append(dirs, d)
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			// not in a repository, only the walked directories count
+			dirs = dirs[:1]
+			break
+		}
+		d = parent
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		g.load(dirs[i])
+	}
+
+	return g
+}
+
+func (g *gitignore) load(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(abs, ".gitignore"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: abs}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// without a slash the pattern matches a name at any depth,
+		// otherwise it's relative to the .gitignore
+		prefix := "^"
+		if !strings.Contains(line, "/") {
+			prefix = "^(.*/)?"
+		}
+		line = strings.TrimPrefix(line, "/")
+
+		re, err := regexp.Compile(prefix + globToRegexp(line) + "$")
+		if err != nil {
+			continue
+		}
+		rule.re = re
+		g.rules = append(g.rules, rule)
+	}
+}
+
+// Ignored tells whether path is excluded, the walk skips ignored
+// directories so their contents needn't be checked
+func (g *gitignore) Ignored(path string, isDir bool) bool {
+	if len(g.rules) == 0 {
+		return false
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	ignored := false
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.base, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rule.re.MatchString(filepath.ToSlash(rel)) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
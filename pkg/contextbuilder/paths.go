@@ -0,0 +1,167 @@
+package contextbuilder
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var skippedDirs = map[string]bool{
+	".git":         true,
+	".hg":          true,
+	".svn":         true,
+	"node_modules": true,
+	"vendor":       true,
+}
+
+// PathResolver expands paths (files, directories and globs, ** included)
+// into a sorted, de-duplicated list of regular text files
+type PathResolver struct {
+	Extensions []string // only keep files with these extensions, all when empty
+}
+
+func (r PathResolver) Resolve(patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	var ret []string
+
+	add := func(path string) {
+		path = filepath.Clean(path)
+		if seen[path] || !r.accepts(path) {
+			return
+		}
+		seen[path] = true
+		ret = append(ret, path)
+	}
+
+	for _, pattern := range patterns {
+		// filepath.Glob has no **, those patterns are matched while walking
+		if strings.Contains(pattern, "**") {
+			n := len(ret)
+			if err := r.walkRecursiveGlob(pattern, add); err != nil {
+				return nil, err
+			}
+			if len(ret) == n {
+				return nil, fmt.Errorf("%s: no matching files", pattern)
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", pattern)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+
+			if err := walkTextFiles(match, func(path string) { add(path) }); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+// walkTextFiles calls fn for the text files below dir, skipping hidden,
+// vendored and gitignored directories and gitignored files
+func walkTextFiles(dir string, fn func(path string)) error {
+	ignore := newGitignore(dir)
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && (skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".") || ignore.Ignored(path, true)) {
+				return filepath.SkipDir
+			}
+			ignore.load(path)
+			return nil
+		}
+		if d.Type().IsRegular() && !ignore.Ignored(path, false) && !isBinaryFile(path) {
+			fn(path)
+		}
+		return nil
+	})
+}
+
+// walkRecursiveGlob matches a pattern like src/**/*.go against the files
+// below its leading directory (src)
+func (r PathResolver) walkRecursiveGlob(pattern string, add func(string)) error {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+
+	var root []string
+	segs := strings.Split(pattern, "/")
+	for _, seg := range segs[:len(segs)-1] {
+		if strings.ContainsAny(seg, "*?[\\") {
+			break
+		}
+		root = append(root, seg)
+	}
+
+	dir := strings.Join(root, "/")
+	if dir == "" && strings.HasPrefix(pattern, "/") {
+		dir = "/"
+	} else if dir == "" {
+		dir = "."
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return fmt.Errorf("%s: %w", pattern, err)
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%s: %w", pattern, err)
+	}
+
+	return walkTextFiles(filepath.FromSlash(dir), func(path string) {
+		if re.MatchString(filepath.ToSlash(filepath.Clean(path))) {
+			add(path)
+		}
+	})
+}
+
+func (r PathResolver) accepts(path string) bool {
+	if len(r.Extensions) == 0 {
+		return true
+	}
+	for _, ext := range r.Extensions {
+		if filepath.Ext(path) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func isBinaryFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	buf := make([]byte, 8000)
+	n, _ := f.Read(buf)
+
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
@@ -0,0 +1,436 @@
+package contextbuilder
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StdinFormats are the accepted --stdin-format values, text passes the
+// input through unchanged
+var StdinFormats = []string{"text", "auto", "diff", "log", "csv", "json"}
+
+// FormatStdin prepares piped input for the model according to format:
+// diffs are split into per-file sections, repeated log lines are collapsed
+// and old ones dropped to fit maxChars, CSV is summarized as a schema with
+// sample rows and JSON is pretty-printed or, when too large, reduced to its
+// schema. auto picks the format from the content. maxChars <= 0 means no
+// limit.
+func FormatStdin(input string, format string, maxChars int) (string, error) {
+	if !slices.Contains(StdinFormats, format) {
+		return "", fmt.Errorf("unknown stdin format %q, use %s", format, strings.Join(StdinFormats, ", "))
+	}
+	if format == "auto" {
+		format = DetectStdinFormat(input)
+	}
+
+	switch format {
+	case "diff":
+		return formatDiff(input), nil
+	case "log":
+		return formatLog(input, maxChars), nil
+	case "csv":
+		return formatCSV(input)
+	case "json":
+		return formatJSON(input, maxChars)
+	default:
+		return input, nil
+	}
+}
+
+var (
+	diffHeader = regexp.MustCompile(`(?m)^(diff --git |--- \S+.*\n\+\+\+ \S+)`)
+	hunkHeader = regexp.MustCompile(`(?m)^@@ -\d+(,\d+)? \+\d+(,\d+)? @@`)
+
+	// 2024-05-01T12:00:00, 2024/05/01 12:00:00, [01/May/2024:12:00:00 +0000],
+	// May  1 12:00:00 (syslog) and 12:00:00.123
+	logTimestamp = regexp.MustCompile(`^\[?(\d{4}[-/]\d{2}[-/]\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?|\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2}( [+-]\d{4})?|\w{3} [ \d]\d \d{2}:\d{2}:\d{2}|\d{2}:\d{2}:\d{2}(\.\d+)?)\]?\s*`)
+)
+
+// DetectStdinFormat guesses the format of piped input, text when nothing
+// matches
+func DetectStdinFormat(input string) string {
+	trimmed := strings.TrimSpace(input)
+	if trimmed == "" {
+		return "text"
+	}
+
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+	if diffHeader.MatchString(input) && hunkHeader.MatchString(input) {
+		return "diff"
+	}
+
+	lines := firstLines(trimmed, 20)
+
+	stamped := 0
+	for _, line := range lines {
+		if logTimestamp.MatchString(line) {
+			stamped++
+		}
+	}
+	if stamped > 0 && stamped*2 >= len(lines) {
+		return "log"
+	}
+
+	if len(lines) >= 2 {
+		if _, fields := csvDelimiter(lines); fields > 1 {
+			return "csv"
+		}
+	}
+
+	return "text"
+}
+
+func firstLines(s string, n int) []string {
+	var ret []string
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ret = append(ret, strings.TrimRight(line, "\r"))
+		if len(ret) == n {
+			break
+		}
+	}
+	return ret
+}
+
+// csvDelimiter returns the delimiter giving every line the same number of
+// fields, and that number
+func csvDelimiter(lines []string) (rune, int) {
+	for _, delim := range []rune{',', '\t', ';', '|'} {
+		r := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+		r.Comma = delim
+		r.LazyQuotes = true
+		records, err := r.ReadAll()
+		if err == nil && len(records) == len(lines) && len(records[0]) > 1 {
+			return delim, len(records[0])
+		}
+	}
+	return ',', 0
+}
+
+type diffFile struct {
+	path             string
+	body             strings.Builder
+	added, deleted   int
+	header, binaries bool
+}
+
+// formatDiff splits a unified diff (git or plain) into a section per file
+// with its line counts
+func formatDiff(input string) string {
+	var files []*diffFile
+	var cur *diffFile
+
+	lines := strings.Split(strings.TrimRight(input, "\n"), "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			cur = &diffFile{path: gitDiffPath(line), header: true}
+			files = append(files, cur)
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			path := diffPath(lines[i+1][4:])
+			if path == "/dev/null" {
+				path = diffPath(line[4:])
+			}
+			// a git diff already started the section
+			if cur == nil || !cur.header || cur.body.Len() > 0 && strings.Contains(cur.body.String(), "\n@@") {
+				cur = &diffFile{}
+				files = append(files, cur)
+			}
+			cur.path = path
+		case cur == nil:
+			// text before the first file, e.g. a commit message
+			cur = &diffFile{path: ""}
+			files = append(files, cur)
+		case strings.HasPrefix(line, "Binary files "):
+			cur.binaries = true
+		case strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++ "):
+			cur.added++
+		case strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "--- "):
+			cur.deleted++
+		}
+		cur.body.WriteString(line + "\n")
+	}
+
+	var ret strings.Builder
+	changed := 0
+	for _, f := range files {
+		if f.path != "" {
+			changed++
+		}
+	}
+	fmt.Fprintf(&ret, "Diff of %d file(s):\n", changed)
+
+	for _, f := range files {
+		body := strings.TrimRight(f.body.String(), "\n")
+		if f.path == "" {
+			fmt.Fprintf(&ret, "\n%s\n", body)
+			continue
+		}
+		stats := fmt.Sprintf("+%d -%d", f.added, f.deleted)
+		if f.binaries {
+			stats = "binary"
+		}
+		fmt.Fprintf(&ret, "\n### %s (%s)\n\n```diff\n%s\n```\n", f.path, stats, body)
+	}
+
+	return ret.String()
+}
+
+func gitDiffPath(line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, "diff --git "))
+	if len(fields) == 0 {
+		return "?"
+	}
+	return strings.TrimPrefix(fields[len(fields)-1], "b/")
+}
+
+func diffPath(s string) string {
+	// the timestamp of plain diffs follows a tab
+	path, _, _ := strings.Cut(s, "\t")
+	path = strings.TrimSpace(path)
+	if path != "/dev/null" {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "b/"), "a/")
+	}
+	return path
+}
+
+// formatLog collapses runs of lines that only differ in their timestamp
+// and, if still over maxChars, keeps the most recent lines
+func formatLog(input string, maxChars int) string {
+	type entry struct {
+		line  string
+		key   string
+		count int
+	}
+
+	var entries []*entry
+	for _, line := range strings.Split(strings.TrimRight(input, "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		key := logTimestamp.ReplaceAllString(line, "")
+		if n := len(entries); n > 0 && entries[n-1].key == key {
+			entries[n-1].count++
+			entries[n-1].line = line
+			continue
+		}
+		entries = append(entries, &entry{line: line, key: key, count: 1})
+	}
+
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.line
+		if e.count > 1 {
+			lines[i] += fmt.Sprintf(" [repeated %d times]", e.count)
+		}
+	}
+
+	if maxChars <= 0 {
+		return strings.Join(lines, "\n")
+	}
+
+	start, size := len(lines), 0
+	for start > 0 && size+len(lines[start-1])+1 <= maxChars {
+		start--
+		size += len(lines[start]) + 1
+	}
+	if start == 0 {
+		return strings.Join(lines, "\n")
+	}
+	if start == len(lines) {
+		// a single huge line, keep its end
+		last := lines[len(lines)-1]
+		return fmt.Sprintf("[%d earlier lines omitted, last line truncated]\n%s", len(lines)-1, last[len(last)-maxChars:])
+	}
+	return fmt.Sprintf("[%d earlier lines omitted]\n%s", start, strings.Join(lines[start:], "\n"))
+}
+
+const csvSampleRows = 5
+
+// formatCSV describes the columns (inferred type, empty cells, distinct
+// values) and shows the first rows
+func formatCSV(input string) (string, error) {
+	delim, _ := csvDelimiter(firstLines(input, 20))
+
+	r := csv.NewReader(strings.NewReader(input))
+	r.Comma = delim
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return "", fmt.Errorf("parsing csv: %w", err)
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+
+	header, rows := records[0], records[1:]
+
+	var ret strings.Builder
+	fmt.Fprintf(&ret, "CSV with %d rows and %d columns:\n\n", len(rows), len(header))
+	ret.WriteString("| column | type | empty | distinct | examples |\n|---|---|---|---|---|\n")
+
+	for i, name := range header {
+		var values []string
+		empty := 0
+		for _, row := range rows {
+			if i >= len(row) || strings.TrimSpace(row[i]) == "" {
+				empty++
+				continue
+			}
+			values = append(values, strings.TrimSpace(row[i]))
+		}
+
+		distinct := map[string]bool{}
+		var examples []string
+		for _, v := range values {
+			if !distinct[v] && len(examples) < 3 {
+				examples = append(examples, truncate(v, 30))
+			}
+			distinct[v] = true
+		}
+
+		fmt.Fprintf(&ret, "| %s | %s | %d | %d | %s |\n", name, csvColumnType(values), empty, len(distinct), strings.Join(examples, ", "))
+	}
+
+	n := min(csvSampleRows, len(rows))
+	fmt.Fprintf(&ret, "\nFirst %d rows:\n\n```csv\n", n)
+	var sample bytes.Buffer
+	w := csv.NewWriter(&sample)
+	w.Comma = delim
+	w.WriteAll(records[:n+1])
+	ret.Write(sample.Bytes())
+	ret.WriteString("```\n")
+
+	return ret.String(), nil
+}
+
+func csvColumnType(values []string) string {
+	if len(values) == 0 {
+		return "empty"
+	}
+
+	is := func(parse func(string) bool) bool {
+		for _, v := range values {
+			if !parse(v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case is(func(v string) bool { _, err := strconv.ParseInt(v, 10, 64); return err == nil }):
+		return "integer"
+	case is(func(v string) bool { _, err := strconv.ParseFloat(v, 64); return err == nil }):
+		return "number"
+	case is(func(v string) bool { _, err := strconv.ParseBool(v); return err == nil }):
+		return "boolean"
+	case is(func(v string) bool {
+		for _, layout := range []string{time.RFC3339, "2006-01-02", "2006-01-02 15:04:05", "01/02/2006"} {
+			if _, err := time.Parse(layout, v); err == nil {
+				return true
+			}
+		}
+		return false
+	}):
+		return "date"
+	default:
+		return "string"
+	}
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+// formatJSON pretty-prints the document, or describes its structure when
+// the printed form doesn't fit in maxChars
+func formatJSON(input string, maxChars int) (string, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(input), &doc); err != nil {
+		return "", fmt.Errorf("parsing json: %w", err)
+	}
+
+	pretty, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if maxChars <= 0 || len(pretty) <= maxChars {
+		return "```json\n" + string(pretty) + "\n```\n", nil
+	}
+
+	schema, err := json.MarshalIndent(jsonSchema(doc), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("JSON document of %d bytes, its structure (types, array lengths and example values):\n\n```json\n%s\n```\n", len(input), schema), nil
+}
+
+// jsonSchema replaces values with their types, arrays are described by
+// their length and the merged structure of their elements
+func jsonSchema(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, val := range v {
+			ret[k] = jsonSchema(val)
+		}
+		return ret
+	case []interface{}:
+		if len(v) == 0 {
+			return "array (empty)"
+		}
+		var merged interface{}
+		for _, el := range v {
+			merged = mergeSchema(merged, jsonSchema(el))
+		}
+		return map[string]interface{}{fmt.Sprintf("array of %d", len(v)): merged}
+	case string:
+		return "string, e.g. " + strconv.Quote(truncate(v, 40))
+	case float64:
+		return "number, e.g. " + strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// mergeSchema unites the keys of object schemas, for other values the
+// first one wins
+func mergeSchema(a, b interface{}) interface{} {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+
+	keys := make([]string, 0, len(bm))
+	for k := range bm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		am[k] = mergeSchema(am[k], bm[k])
+	}
+	return am
+}
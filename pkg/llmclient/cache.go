@@ -0,0 +1,85 @@
+package llmclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache stores complete answers keyed by a hash of the request payload, so
+// repeated identical requests don't hit the API
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewCache keeps entries in dir, they expire after ttl unless it's 0
+func NewCache(dir string, ttl time.Duration) *Cache {
+	return &Cache{dir: dir, ttl: ttl}
+}
+
+type CacheEntry struct {
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Content string `json:"content"`
+	Usage   Usage  `json:"usage"`
+}
+
+// Key hashes the request payload, streaming options don't affect the answer
+// and are left out so streamed and buffered requests share entries
+func (c *Cache) Key(apiBase string, payload map[string]interface{}) string {
+	filtered := map[string]interface{}{}
+	for k, v := range payload {
+		if k != "stream" && k != "stream_options" {
+			filtered[k] = v
+		}
+	}
+
+	data, _ := json.Marshal(filtered)
+
+	h := sha256.New()
+	h.Write([]byte(apiBase + "\n"))
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) Get(key string) (*CacheEntry, bool) {
+	data, err := os.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+
+	if c.ttl > 0 && time.Since(time.Unix(entry.Created, 0)) > c.ttl {
+		os.Remove(filepath.Join(c.dir, key+".json"))
+		return nil, false
+	}
+
+	return &entry, true
+}
+
+func (c *Cache) Put(key string, model string, content string, usage Usage) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(CacheEntry{Created: time.Now().Unix(), Model: model, Content: content, Usage: usage})
+	if err != nil {
+		return err
+	}
+
+	// write-then-rename so parallel invocations never read a partial entry
+	tmp := filepath.Join(c.dir, key+".json.tmp"+newID())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.dir, key+".json"))
+}
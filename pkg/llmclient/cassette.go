@@ -0,0 +1,233 @@
+package llmclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A cassette records the API interactions of Chat into a file and replays
+// them later, so tests of code built on Chat run without network access
+// and with deterministic answers.
+//
+//	LLM_CASSETTE=testdata/foo.json   replay recorded requests, record new ones
+//	LLM_CASSETTE_MODE=replay         fail on requests that weren't recorded
+//	LLM_CASSETTE_MODE=record         record everything again
+//
+// Requests are matched by method, url path and json body; headers, including
+// the API key, are never written.
+
+type cassetteInteraction struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	Status      int             `json:"status"`
+	ContentType string          `json:"content_type"`
+	Response    string          `json:"response"`
+}
+
+type cassetteFile struct {
+	Interactions []cassetteInteraction `json:"interactions"`
+}
+
+type cassette struct {
+	sync.Mutex
+	path   string
+	mode   string
+	tape   cassetteFile
+	played map[string]int // times each request was replayed, identical requests replay in order
+}
+
+var loadCassette = sync.OnceValues(func() (*cassette, error) {
+	path := os.Getenv("LLM_CASSETTE")
+	if path == "" {
+		return nil, nil
+	}
+
+	c := &cassette{path: path, mode: os.Getenv("LLM_CASSETTE_MODE"), played: map[string]int{}}
+	switch c.mode {
+	case "", "replay", "record":
+	default:
+		return nil, fmt.Errorf("LLM_CASSETTE_MODE: unknown mode %q, use replay or record", c.mode)
+	}
+
+	if c.mode != "record" {
+		data, err := os.ReadFile(path)
+		if err != nil && !(os.IsNotExist(err) && c.mode == "") {
+			return nil, fmt.Errorf("cassette: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &c.tape); err != nil {
+				return nil, fmt.Errorf("cassette %s: %w", path, err)
+			}
+			// the file is indented, requests are compared compacted
+			for i, it := range c.tape.Interactions {
+				c.tape.Interactions[i].Request = canonicalJSON(it.Request)
+			}
+		}
+	}
+
+	return c, nil
+})
+
+// canonicalJSON re-encodes a json body with sorted keys, so the order of the
+// request fields doesn't matter
+func canonicalJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		data, _ := json.Marshal(string(body))
+		return data
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func (c *cassette) find(method, path string, request json.RawMessage) (*cassetteInteraction, bool) {
+	key := method + " " + path + "\n" + string(request)
+
+	var matches []*cassetteInteraction
+	for i := range c.tape.Interactions {
+		it := &c.tape.Interactions[i]
+		if it.Method == method && it.Path == path && bytes.Equal(it.Request, request) {
+			matches = append(matches, it)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, false
+	}
+
+	// the last recording answers any further repetitions
+	n := min(c.played[key], len(matches)-1)
+	c.played[key]++
+
+	return matches[n], true
+}
+
+func (c *cassette) add(it cassetteInteraction) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.tape.Interactions = append(c.tape.Interactions, it)
+
+	data, err := json.MarshalIndent(c.tape, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp" + newID()
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+type cassetteTransport struct {
+	cassette *cassette
+	next     http.RoundTripper
+}
+
+// withCassette wraps the transport of Chat when LLM_CASSETTE is set
+func withCassette(next http.RoundTripper) (http.RoundTripper, error) {
+	c, err := loadCassette()
+	if err != nil || c == nil {
+		return next, err
+	}
+
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &cassetteTransport{cassette: c, next: next}, nil
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	request := canonicalJSON(body)
+
+	c := t.cassette
+	if c.mode != "record" {
+		c.Lock()
+		it, ok := c.find(req.Method, req.URL.Path, request)
+		c.Unlock()
+
+		if ok {
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", it.Status, http.StatusText(it.Status)),
+				StatusCode:    it.Status,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {it.ContentType}},
+				Body:          io.NopCloser(bytes.NewReader([]byte(it.Response))),
+				ContentLength: int64(len(it.Response)),
+				Request:       req,
+			}, nil
+		}
+		if c.mode == "replay" {
+			return nil, fmt.Errorf("cassette %s: no recorded response for %s %s", c.path, req.Method, req.URL.Path)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	it := cassetteInteraction{
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Request:     request,
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+
+	// streamed answers are passed through as they arrive and saved once
+	// the body is closed
+	resp.Body = &recordingBody{ReadCloser: resp.Body, done: func(data []byte) {
+		it.Response = string(data)
+		if err := c.add(it); err != nil {
+			slog.Warn("recording the cassette", "err", err)
+		}
+	}}
+
+	return resp, nil
+}
+
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func([]byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return b.ReadCloser.Close()
+}
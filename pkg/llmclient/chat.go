@@ -0,0 +1,435 @@
+// Package llmclient is the chat client of the llm cli: OpenAI-compatible
+// chat completions with streaming, hooks, a response cache, usage reporting
+// and cassettes for hermetic tests.
+package llmclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type chatRequest struct {
+	Model       string                 `json:"model"`
+	Seed        int                    `json:"seed"`
+	Temperature float64                `json:"temperature"`
+	Stream      bool                   `json:"stream"`
+	Messages    []Message              `json:"messages"`
+	Extra       map[string]interface{} `json:"-"`
+}
+
+// Message is a chat message as sent to the API
+type Message struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"-"` // data URLs
+
+	// CacheControl ends a prefix to be cached by the provider, a cache_control
+	// breakpoint of Anthropic (also through OpenRouter)
+	CacheControl bool `json:"-"`
+}
+
+// MarshalJSON sends messages with images or a cache breakpoint as text and
+// image_url parts
+func (m Message) MarshalJSON() ([]byte, error) {
+	if len(m.Images) == 0 && !m.CacheControl {
+		type plain Message
+		return json.Marshal(plain(m))
+	}
+
+	text := map[string]interface{}{"type": "text", "text": m.Content}
+	if m.CacheControl {
+		text["cache_control"] = map[string]interface{}{"type": "ephemeral"}
+	}
+	parts := []interface{}{text}
+	for _, url := range m.Images {
+		parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}})
+	}
+
+	return json.Marshal(map[string]interface{}{"role": m.Role, "content": parts})
+}
+
+// DefaultAPIBase is used when neither the caller nor OPENAI_API_BASE give one
+const DefaultAPIBase = "https://api.openai.com/v1"
+
+// ResolveAPI fills in the API key and base not given from OPENAI_API_KEY and
+// OPENAI_API_BASE, the values given take precedence
+func ResolveAPI(apiKey string, apiBase string) (string, string, error) {
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+	if apiBase == "" {
+		apiBase = os.Getenv("OPENAI_API_BASE")
+	}
+	if apiBase == "" {
+		apiBase = DefaultAPIBase
+	}
+
+	if apiKey == "" && strings.Contains(apiBase, "api.openai.com") {
+		return "", "", fmt.Errorf("must provide OpenAI API key")
+	}
+
+	return apiKey, strings.TrimSuffix(apiBase, "/"), nil
+}
+
+func urlJoin(base, rel string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	relURL, err := url.Parse(rel)
+	if err != nil {
+		return "", err
+	}
+
+	if relURL.Scheme != "" && relURL.Host != "" {
+		return rel, nil
+	}
+
+	joinedPath := path.Join(baseURL.Path, relURL.Path)
+
+	result := &url.URL{
+		Scheme: baseURL.Scheme,
+		User:   baseURL.User,
+		Host:   baseURL.Host,
+		Path:   joinedPath,
+	}
+
+	return result.String(), nil
+}
+
+// Chat sends a chat completion request and returns the answer, streamed in
+// chunks when stream is set. The channel is closed when the answer is
+// complete. postprocess, onUsage and cache may be nil. The middlewares run
+// inside the hooks, usage reporting and cache, around the API call.
+// Diagnostics go to the default slog logger, verbose adds the payloads at
+// the debug level.
+func Chat(
+	messages []Message,
+	model string,
+	seed int,
+	temperature float64,
+	postprocess func(string) string,
+	apiKey string,
+	apiBase string,
+	stream bool,
+	extra map[string]interface{},
+	verbose bool,
+	onUsage func(Usage),
+	cache *Cache,
+	hooks Hooks,
+	middlewares ...Middleware,
+) (<-chan string, error) {
+	apiKey, apiBase, err := ResolveAPI(apiKey, apiBase)
+	if err != nil {
+		return nil, err
+	}
+
+	req := chatRequest{
+		Model:       model,
+		Seed:        seed,
+		Temperature: temperature,
+		Stream:      stream,
+		Messages:    messages,
+	}
+
+	mergedData := map[string]interface{}{}
+
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(reqJson, &mergedData)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range extra {
+		mergedData[k] = v
+	}
+
+	chain := []Middleware{
+		Postprocess(postprocess),
+		PreRequestHook(hooks),
+		PostResponseHook(hooks),
+		ReportUsage(onUsage),
+		Cached(cache),
+	}
+	chain = append(chain, middlewares...)
+	chain = append(chain, LogRequests(verbose))
+
+	resp, err := Chain(Send(apiKey), chain...)(&Request{APIBase: apiBase, Body: mergedData, Messages: messages})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Chunks, nil
+}
+
+// Send is the handler calling the chat completions endpoint
+func Send(apiKey string) Handler {
+	return func(req *Request) (*Response, error) {
+		headers := http.Header{
+			"Authorization": {"Bearer " + apiKey},
+			"Content-Type":  {"application/json"},
+		}
+
+		jsonData, err := json.Marshal(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		client := &http.Client{Transport: withTranscript(nil)}
+		if client.Transport, err = withCassette(client.Transport); err != nil {
+			return nil, err
+		}
+
+		chatUrl, err := urlJoin(req.APIBase, "/chat/completions")
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Stream() {
+			headers.Set("Accept", "text/event-stream")
+		}
+
+		httpReq, err := http.NewRequestWithContext(req.ctx(), "POST", chatUrl, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header = headers
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 400 {
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+
+		if req.Stream() {
+			return readStream(req, resp.Body), nil
+		}
+
+		defer resp.Body.Close()
+
+		var respBody struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+			Usage Usage `json:"usage"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&respBody)
+		if err != nil {
+			return nil, err
+		}
+		if len(respBody.Choices) == 0 {
+			return nil, fmt.Errorf("the API returned no choices")
+		}
+
+		content := respBody.Choices[0].Message.Content
+		return single(content, CompleteUsage(respBody.Usage, req.Messages, content)), nil
+	}
+}
+
+// readStream turns the server-sent events of a streamed answer into chunks
+func readStream(req *Request, body io.ReadCloser) *Response {
+	ch := make(chan string)
+	ret := &Response{Chunks: ch}
+
+	// with stream_options.include_usage the usage arrives in a separate
+	// chunk after the one carrying finish_reason
+	_, waitForUsage := req.Body["stream_options"]
+
+	go func() {
+		defer body.Close()
+
+		scanner := bufio.NewScanner(body)
+		scanner.Split(bufio.ScanLines)
+
+		var usage Usage
+		var output strings.Builder
+		finished := false
+
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			line = strings.TrimSpace(line)
+
+			if line == "data: [DONE]" {
+				finished = true
+				break
+			}
+
+			if strings.HasPrefix(line, "data: ") {
+
+				var resp struct {
+					Choices []struct {
+						Delta struct {
+							Content string `json:"content"`
+						} `json:"delta"`
+						FinishReason *string `json:"finish_reason"`
+						Index        int     `json:"index"`
+					} `json:"choices"`
+					Created int    `json:"created"`
+					ID      string `json:"id"`
+					Model   string `json:"model"`
+					Object  string `json:"object"`
+					Usage   *Usage `json:"usage,omitempty"` // add omitempty to avoid error when usage is not present
+				}
+
+				err := json.Unmarshal([]byte(line[6:]), &resp)
+
+				if err != nil {
+					slog.Warn("skipping a malformed event of the answer stream", "err", err, "event", line)
+					continue
+				}
+
+				if resp.Usage != nil && resp.Usage.TotalTokens > 0 {
+					usage = *resp.Usage
+				}
+
+				if len(resp.Choices) == 0 {
+					continue
+				}
+
+				if resp.Choices[0].Delta.Content != "" {
+					content := resp.Choices[0].Delta.Content
+					output.WriteString(content)
+					ch <- content
+				} else {
+					if resp.Choices[0].FinishReason != nil && len(*resp.Choices[0].FinishReason) > 0 {
+						finished = true
+						if !waitForUsage || usage.TotalTokens > 0 {
+							break
+						}
+					} else {
+						slog.Debug("unexpected end of the answer stream", "event", line)
+					}
+				}
+			}
+		}
+
+		ret.Usage = CompleteUsage(usage, req.Messages, output.String())
+		ret.Complete = finished
+		close(ch)
+	}()
+
+	return ret
+}
+
+// Model is an entry of the /models endpoint
+type Model struct {
+	ID   string                 `json:"id"`
+	Meta map[string]interface{} `json:"meta"`
+
+	// limits reported by some providers, see Limits
+	ContextLength       int               `json:"context_length,omitempty"`        // OpenRouter, Together
+	ContextWindow       int               `json:"context_window,omitempty"`        // Groq
+	MaxModelLen         int               `json:"max_model_len,omitempty"`         // vLLM
+	MaxCompletionTokens int               `json:"max_completion_tokens,omitempty"` // Groq
+	TopProvider         *ModelTopProvider `json:"top_provider,omitempty"`          // OpenRouter
+}
+
+type ModelTopProvider struct {
+	ContextLength       int `json:"context_length,omitempty"`
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+}
+
+// Limits returns the context window and the longest answer in tokens as
+// reported by the provider, 0 when it doesn't say. llama.cpp only reports
+// the context it was trained with, the server may run with a smaller one.
+func (m Model) Limits() (contextWindow int, maxOutput int) {
+	for _, n := range []int{m.ContextWindow, m.ContextLength, m.MaxModelLen} {
+		if n > 0 {
+			contextWindow = n
+			break
+		}
+	}
+	maxOutput = m.MaxCompletionTokens
+
+	if m.TopProvider != nil {
+		if contextWindow == 0 {
+			contextWindow = m.TopProvider.ContextLength
+		}
+		if maxOutput == 0 {
+			maxOutput = m.TopProvider.MaxCompletionTokens
+		}
+	}
+
+	if n, ok := m.Meta["n_ctx_train"].(float64); ok && contextWindow == 0 {
+		contextWindow = int(n)
+	}
+
+	return contextWindow, maxOutput
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// ListModels returns the models served by the API
+func ListModels(apiKey string, apiBase string, timeout time.Duration) ([]Model, error) {
+
+	url, err := urlJoin(apiBase, "models")
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{
+		"Authorization": {"Bearer " + apiKey},
+		"Content-Type":  {"application/json"},
+	}
+
+	client := &http.Client{
+		Timeout:   timeout, // set the timeout for the client
+		Transport: withTranscript(nil),
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var modelList ModelList
+	err = json.NewDecoder(resp.Body).Decode(&modelList)
+	if err != nil {
+		return nil, err
+	}
+
+	return modelList.Data, nil
+}
+
+func newID() string {
+	u := make([]byte, 16)
+	_, err := rand.Read(u)
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixMilli())
+	}
+	return base64.URLEncoding.EncodeToString(u)
+}
@@ -0,0 +1,155 @@
+package llmclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ErrorKind sorts failed requests by what the user can do about them
+type ErrorKind int
+
+const (
+	ErrOther ErrorKind = iota
+	ErrAuth
+	ErrRateLimit
+	ErrQuota
+	ErrContextLength
+	ErrContentFilter
+	ErrNetwork
+	ErrTimeout
+	ErrCancelled
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrAuth:
+		return "authentication"
+	case ErrRateLimit:
+		return "rate limit"
+	case ErrQuota:
+		return "quota"
+	case ErrContextLength:
+		return "context length"
+	case ErrContentFilter:
+		return "content filter"
+	case ErrNetwork:
+		return "network"
+	case ErrTimeout:
+		return "timeout"
+	case ErrCancelled:
+		return "cancelled"
+	}
+	return "other"
+}
+
+// StatusError is an error response of the API
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API error %d: %s", e.StatusCode, e.Message())
+}
+
+// errorBody covers the error responses of OpenAI and the compatible servers
+// (llama.cpp, vLLM, Groq, OpenRouter, Anthropic)
+type errorBody struct {
+	Error json.RawMessage `json:"error"`
+	// vLLM, FastAPI
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail"`
+}
+
+type errorObject struct {
+	Message string          `json:"message"`
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+}
+
+func (e *StatusError) parse() (message, code string) {
+	var body errorBody
+	if json.Unmarshal([]byte(e.Body), &body) != nil {
+		return strings.TrimSpace(e.Body), ""
+	}
+	var obj errorObject
+	var text string
+	switch {
+	case json.Unmarshal(body.Error, &obj) == nil && obj.Message != "":
+		code = strings.Trim(string(obj.Code), `"`)
+		if code == "" || code == "null" {
+			code = obj.Type
+		}
+		return obj.Message, code
+	case json.Unmarshal(body.Error, &text) == nil && text != "":
+		return text, ""
+	case body.Message != "":
+		return body.Message, ""
+	case json.Unmarshal(body.Detail, &text) == nil && text != "":
+		return text, ""
+	}
+	return strings.TrimSpace(e.Body), ""
+}
+
+// Message is the error message of the provider without the JSON around it
+func (e *StatusError) Message() string {
+	message, _ := e.parse()
+	return message
+}
+
+func (e *StatusError) Kind() ErrorKind {
+	message, code := e.parse()
+	text := strings.ToLower(message + " " + code)
+	switch {
+	case code == "context_length_exceeded" || containsAny(text, "maximum context length", "context length", "context window", "prompt is too long", "too many tokens", "exceeds the available context"):
+		return ErrContextLength
+	case code == "content_filter" || containsAny(text, "content_filter", "content management policy", "content policy", "safety system"):
+		return ErrContentFilter
+	case code == "insufficient_quota" || containsAny(text, "insufficient_quota", "exceeded your current quota", "credit balance", "insufficient credits"):
+		return ErrQuota
+	case e.StatusCode == 401 || e.StatusCode == 403:
+		return ErrAuth
+	case e.StatusCode == 429:
+		return ErrRateLimit
+	case e.StatusCode == 408 || e.StatusCode == 504:
+		return ErrTimeout
+	}
+	return ErrOther
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassifyError tells the kind of a failed request
+func ClassifyError(err error) ErrorKind {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Kind()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrCancelled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return ErrNetwork
+	}
+	return ErrOther
+}
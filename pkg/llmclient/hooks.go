@@ -0,0 +1,89 @@
+package llmclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Hooks holds shell commands run around every request. Both receive
+// JSON on stdin; pre_request may print a replacement request payload and
+// post_response a replacement answer, empty output leaves things unchanged.
+// A hook exiting with a non-zero status aborts the request.
+type Hooks struct {
+	PreRequest   string `yaml:"pre_request"`
+	PostResponse string `yaml:"post_response"`
+}
+
+func runHook(command string, input []byte) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("hook %q: %w", command, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func applyPreRequestHook(hooks Hooks, payload map[string]interface{}) (map[string]interface{}, error) {
+	if hooks.PreRequest == "" {
+		return payload, nil
+	}
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := runHook(hooks.PreRequest, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(output)) == 0 {
+		return payload, nil
+	}
+
+	modified := map[string]interface{}{}
+	if err := json.Unmarshal(output, &modified); err != nil {
+		return nil, fmt.Errorf("hooks.pre_request must print a JSON request payload: %w", err)
+	}
+
+	return modified, nil
+}
+
+func applyPostResponseHook(hooks Hooks, payload map[string]interface{}, content string) (string, error) {
+	if hooks.PostResponse == "" {
+		return content, nil
+	}
+
+	input, err := json.Marshal(map[string]interface{}{
+		"request":  payload,
+		"response": map[string]interface{}{"content": content},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	output, err := runHook(hooks.PostResponse, input)
+	if err != nil {
+		return "", err
+	}
+	if len(output) == 0 {
+		return content, nil
+	}
+
+	return string(output), nil
+}
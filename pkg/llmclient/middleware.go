@@ -0,0 +1,307 @@
+package llmclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Request is a chat completion request on its way through the middlewares,
+// they may change or replace Body
+type Request struct {
+	APIBase  string
+	Body     map[string]interface{} // the JSON payload
+	Messages []Message              // as passed to Chat, for usage estimates
+	Context  context.Context        // cancels the request, nil for none
+}
+
+func (r *Request) Model() string {
+	model, _ := r.Body["model"].(string)
+	return model
+}
+
+func (r *Request) Stream() bool {
+	stream, _ := r.Body["stream"].(bool)
+	return stream
+}
+
+func (r *Request) ctx() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+	return r.Context
+}
+
+// Response streams the answer in Chunks. Usage and Complete are set before
+// Chunks is closed.
+type Response struct {
+	Chunks   <-chan string
+	Usage    Usage
+	Complete bool // the answer wasn't cut off
+}
+
+// Handler sends a request, Send is the one talking to the API
+type Handler func(req *Request) (*Response, error)
+
+// Middleware wraps a handler to add a feature around every request
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in the middlewares, the first one is the outermost
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] != nil {
+			h = middlewares[i](h)
+		}
+	}
+	return h
+}
+
+// single returns a complete response of one chunk
+func single(content string, usage Usage) *Response {
+	ch := make(chan string, 1)
+	ch <- content
+	close(ch)
+	return &Response{Chunks: ch, Usage: usage, Complete: true}
+}
+
+// tap passes the chunks of resp through chunk (nil keeps them, "" drops
+// them) and calls done with the complete output when the stream ends. done
+// may adjust the usage and return a last chunk to send.
+func tap(resp *Response, chunk func(string) string, done func(out *Response, output string) string) *Response {
+	ch := make(chan string)
+	out := &Response{Chunks: ch}
+
+	go func() {
+		var output strings.Builder
+		for c := range resp.Chunks {
+			output.WriteString(c)
+			if chunk != nil {
+				c = chunk(c)
+			}
+			if c != "" {
+				ch <- c
+			}
+		}
+
+		out.Usage, out.Complete = resp.Usage, resp.Complete
+		if done != nil {
+			if last := done(out, output.String()); last != "" {
+				ch <- last
+			}
+		}
+		close(ch)
+	}()
+
+	return out
+}
+
+// Postprocess applies fn to every chunk of the answer
+func Postprocess(fn func(string) string) Middleware {
+	if fn == nil {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			resp, err := next(req)
+			if err != nil {
+				return nil, err
+			}
+			return tap(resp, fn, nil), nil
+		}
+	}
+}
+
+// PreRequestHook lets hooks.pre_request rewrite (e.g. redact) the payload
+func PreRequestHook(hooks Hooks) Middleware {
+	if hooks.PreRequest == "" {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			body, err := applyPreRequestHook(hooks, req.Body)
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+			return next(req)
+		}
+	}
+}
+
+// PostResponseHook lets hooks.post_response rewrite the answer, which is
+// then sent in one piece
+func PostResponseHook(hooks Hooks) Middleware {
+	if hooks.PostResponse == "" {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			resp, err := next(req)
+			if err != nil {
+				return nil, err
+			}
+
+			if !req.Stream() {
+				// the caller waits for the answer anyway, a failing hook
+				// fails the request
+				var output strings.Builder
+				for c := range resp.Chunks {
+					output.WriteString(c)
+				}
+				content, err := applyPostResponseHook(hooks, req.Body, output.String())
+				if err != nil {
+					return nil, err
+				}
+				ret := single(content, resp.Usage)
+				ret.Complete = resp.Complete
+				return ret, nil
+			}
+
+			drop := func(string) string { return "" }
+			return tap(resp, drop, func(out *Response, output string) string {
+				content, err := applyPostResponseHook(hooks, req.Body, output)
+				if err != nil {
+					slog.Warn("keeping the answer as it is", "err", err)
+					return output
+				}
+				return content
+			}), nil
+		}
+	}
+}
+
+// ReportUsage calls onUsage once the answer is complete, with the time it
+// took, or once the request failed, with the kind of error and no tokens
+func ReportUsage(onUsage func(Usage)) Middleware {
+	if onUsage == nil {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			start := time.Now()
+			resp, err := next(req)
+			if err != nil {
+				onUsage(Usage{LatencyMS: time.Since(start).Milliseconds(), Error: ClassifyError(err).String()})
+				return nil, err
+			}
+			return tap(resp, nil, func(out *Response, output string) string {
+				usage := out.Usage
+				usage.LatencyMS = time.Since(start).Milliseconds()
+				usage.Incomplete = !out.Complete
+				onUsage(usage)
+				return ""
+			}), nil
+		}
+	}
+}
+
+// Cached answers repeated requests from the cache, hits report no usage as
+// they cost nothing
+func Cached(cache *Cache) Middleware {
+	if cache == nil {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			key := cache.Key(req.APIBase, req.Body)
+
+			if entry, ok := cache.Get(key); ok {
+				slog.Debug("answered from the cache", "key", key)
+				return single(entry.Content, Usage{}), nil
+			}
+
+			resp, err := next(req)
+			if err != nil {
+				return nil, err
+			}
+			return tap(resp, nil, func(out *Response, output string) string {
+				if out.Complete {
+					if err := cache.Put(key, req.Model(), output, out.Usage); err != nil {
+						slog.Warn("caching the answer", "err", err)
+					}
+				}
+				return ""
+			}), nil
+		}
+	}
+}
+
+// Guard fails requests check objects to, e.g. over budget
+func Guard(check func(req *Request) error) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			if err := check(req); err != nil {
+				return nil, err
+			}
+			return next(req)
+		}
+	}
+}
+
+// retryable are rate limits, server errors and failed connections, not
+// cancelled requests
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.StatusCode == 429 || status.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// Retry repeats requests failing with a rate limit, server or connection
+// error up to retries times, waiting backoff, 2*backoff, ... in between. A
+// started answer isn't retried.
+func Retry(retries int, backoff time.Duration) Middleware {
+	if retries <= 0 {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			for attempt := 0; ; attempt++ {
+				resp, err := next(req)
+				if err == nil || attempt == retries || !retryable(err) {
+					return resp, err
+				}
+				wait := backoff << attempt
+				slog.Warn("retrying", "err", err, "in", wait)
+				time.Sleep(wait)
+			}
+		}
+	}
+}
+
+// WithContext lets ctx cancel the request, a cancelled stream ends with the
+// answer so far, marked incomplete
+func WithContext(ctx context.Context) Middleware {
+	if ctx == nil {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			req.Context = ctx
+			return next(req)
+		}
+	}
+}
+
+// LogRequests logs the payload sent to the API at the debug level
+func LogRequests(verbose bool) Middleware {
+	if !verbose {
+		return nil
+	}
+	return func(next Handler) Handler {
+		return func(req *Request) (*Response, error) {
+			data, _ := json.Marshal(req.Body)
+			slog.Debug("request", "body", string(data))
+			return next(req)
+		}
+	}
+}
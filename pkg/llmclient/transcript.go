@@ -0,0 +1,172 @@
+package llmclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptDir, when set, gets a file per request to the API with the
+// request and the raw response as it arrived, server-sent events included,
+// for debugging provider incompatibilities. API keys are redacted from the
+// headers, the url and the bodies.
+var TranscriptDir string
+
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"X-Api-Key":           true,
+	"Api-Key":             true,
+	"X-Goog-Api-Key":      true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// key formats of the common providers, and the key query parameter of Gemini
+var secretPattern = regexp.MustCompile(`(sk-[A-Za-z0-9_\-]{8,}|gsk_[A-Za-z0-9]{8,}|xai-[A-Za-z0-9]{8,}|AIza[0-9A-Za-z_\-]{20,}|([?&]key=)[^&\s"]+)`)
+
+func redactSecrets(s string) string {
+	return secretPattern.ReplaceAllStringFunc(s, func(secret string) string {
+		if param := secretPattern.FindStringSubmatch(secret)[2]; param != "" {
+			return param + "[redacted]"
+		}
+		return "[redacted]"
+	})
+}
+
+func redactHeader(name, value string) string {
+	if !redactedHeaders[http.CanonicalHeaderKey(name)] {
+		return redactSecrets(value)
+	}
+	if scheme, _, ok := strings.Cut(value, " "); ok && (scheme == "Bearer" || scheme == "Basic") {
+		return scheme + " [redacted]"
+	}
+	return "[redacted]"
+}
+
+func writeHeaders(w io.Writer, prefix string, header http.Header) {
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s %s: %s\n", prefix, name, redactHeader(name, value))
+		}
+	}
+}
+
+// withTranscript logs the requests going through next into TranscriptDir
+func withTranscript(next http.RoundTripper) http.RoundTripper {
+	if TranscriptDir == "" {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transcriptTransport{dir: TranscriptDir, next: next}
+}
+
+type transcriptTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+// transcriptFile names the file after the time and the endpoint, e.g.
+// 20240501-142310.512-3fa2-chat-completions.log
+func (t *transcriptTransport) transcriptFile(req *http.Request) (*os.File, error) {
+	if err := os.MkdirAll(t.dir, 0o700); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	endpoint := strings.ReplaceAll(strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1"), "/"), "/", "-")
+	name := fmt.Sprintf("%s-%s-%s.log", time.Now().Format("20060102-150405.000"), hex.EncodeToString(suffix), endpoint)
+	return os.OpenFile(filepath.Join(t.dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+}
+
+func (t *transcriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, err := t.transcriptFile(req)
+	if err != nil {
+		// the request matters more than its log
+		slog.Warn("writing the request log", "err", err)
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	start := time.Now()
+	fmt.Fprintf(f, "# %s\n", start.Format(time.RFC3339Nano))
+	fmt.Fprintf(f, ">>> %s %s\n", req.Method, redactSecrets(req.URL.String()))
+	writeHeaders(f, ">>>", req.Header)
+	if len(body) > 0 {
+		var indented bytes.Buffer
+		if json.Indent(&indented, body, "", "  ") == nil {
+			body = indented.Bytes()
+		}
+		fmt.Fprintf(f, "\n%s\n", redactSecrets(string(body)))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(f, "\n!!! %s (%s)\n", redactSecrets(err.Error()), time.Since(start).Round(time.Millisecond))
+		f.Close()
+		return nil, err
+	}
+
+	fmt.Fprintf(f, "\n<<< %s %s (%s)\n", resp.Proto, resp.Status, time.Since(start).Round(time.Millisecond))
+	writeHeaders(f, "<<<", resp.Header)
+	f.WriteString("\n")
+	resp.Body = &transcriptBody{body: resp.Body, f: f, start: start}
+	return resp, nil
+}
+
+// transcriptBody copies the response into the transcript as it is read, a
+// stream is logged chunk by chunk even when the answer is cancelled
+type transcriptBody struct {
+	body  io.ReadCloser
+	f     *os.File
+	start time.Time
+	once  sync.Once
+}
+
+func (b *transcriptBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.f.WriteString(redactSecrets(string(p[:n])))
+	}
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(b.f, "\n!!! %s\n", err)
+	}
+	return n, err
+}
+
+func (b *transcriptBody) Close() error {
+	b.once.Do(func() {
+		fmt.Fprintf(b.f, "\n<<< end (%s)\n", time.Since(b.start).Round(time.Millisecond))
+		b.f.Close()
+	})
+	return b.body.Close()
+}
@@ -0,0 +1,63 @@
+package llmclient
+
+import "encoding/json"
+
+type Usage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	TotalTokens      int  `json:"total_tokens"`
+	Estimated        bool `json:"estimated,omitempty"`
+	CachedTokens     int  `json:"cached_tokens,omitempty"` // of the prompt tokens, read from the provider's prompt cache
+
+	// set by ReportUsage
+	LatencyMS  int64  `json:"latency_ms,omitempty"` // until the answer was complete
+	Incomplete bool   `json:"incomplete,omitempty"` // the answer was cut off, e.g. cancelled
+	Error      string `json:"error,omitempty"`      // the request failed, ClassifyError's kind
+}
+
+// UnmarshalJSON also reads the cached tokens as reported by OpenAI
+// (prompt_tokens_details) and Anthropic (cache_read_input_tokens)
+func (u *Usage) UnmarshalJSON(data []byte) error {
+	type plain Usage
+	var raw struct {
+		plain
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+		CacheReadInputTokens int `json:"cache_read_input_tokens"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*u = Usage(raw.plain)
+	if u.CachedTokens == 0 {
+		u.CachedTokens = max(raw.PromptTokensDetails.CachedTokens, raw.CacheReadInputTokens)
+	}
+	return nil
+}
+
+// EstimateTokens is a rough chars/4 heuristic for servers that don't report usage
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// CompleteUsage estimates the usage from the messages and output when the
+// server didn't report it
+func CompleteUsage(usage Usage, messages []Message, output string) Usage {
+	if usage.TotalTokens > 0 {
+		return usage
+	}
+
+	prompt := 0
+	for _, msg := range messages {
+		prompt += EstimateTokens(msg.Content)
+	}
+	completion := EstimateTokens(output)
+
+	return Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+		Estimated:        true,
+	}
+}
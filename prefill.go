@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// --prefill starts the answer with the given text: it is sent as a partial
+// assistant message the model continues (supported by Anthropic and most open
+// models), e.g. "```json" to force a format
+
+// withPrefill sends prefill as the beginning of the answer and streams it
+// back in front of the continuation, so callers see the whole answer
+func withPrefill(llmApi func(ctx context.Context, messages []Message) (<-chan string, error), prefill string) func(ctx context.Context, messages []Message) (<-chan string, error) {
+	if prefill == "" {
+		return llmApi
+	}
+	return func(ctx context.Context, messages []Message) (<-chan string, error) {
+		ch, err := llmApi(ctx, prefillMessages(messages, prefill))
+		if err != nil {
+			return nil, err
+		}
+
+		out := make(chan string)
+		go func() {
+			defer close(out)
+			out <- prefill
+			for content := range ch {
+				out <- content
+			}
+		}()
+		return out, nil
+	}
+}
+
+// prefillMessages returns messages followed by the partial assistant message
+func prefillMessages(messages []Message, prefill string) []Message {
+	ret := append([]Message{}, messages...)
+	return append(ret, *NewMessage("assistant", prefill))
+}
+
+// parsePrefillCommand handles "/prefill <text>" in the chat, no text clears it
+func parsePrefillCommand(input string) (string, bool) {
+	input = strings.TrimSpace(input)
+	if input != "/prefill" && !strings.HasPrefix(input, "/prefill ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(input, "/prefill")), true
+}
@@ -0,0 +1,23 @@
+package main
+
+import "github.com/kir-gadjello/llm/pkg/llmclient"
+
+// --cache-context (cache_context in the requests of a model) marks the stable
+// beginning of a request for the provider to cache, which bills it at a
+// fraction of the price when it's sent again within minutes. Anthropic needs
+// these cache_control breakpoints, OpenAI caches long prompts by itself.
+// Either way the cached tokens are reported with --cost.
+
+// markCacheBreakpoints ends cached prefixes after the system prompt, which
+// holds the files unless --context-layout moves them, and before the last
+// message, so the earlier turns of a conversation are read from the cache
+func markCacheBreakpoints(messages []llmclient.Message) {
+	for i := range messages {
+		if messages[i].Role == "system" {
+			messages[i].CacheControl = true
+		}
+	}
+	if n := len(messages); n >= 2 && messages[n-2].Role != "system" {
+		messages[n-2].CacheControl = true
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --save-to writes the answer to a file followed by where it came from: the
+// model and every part of the context with its hash, so a saved analysis can
+// be checked against the current files or reproduced later. The footer is a
+// markdown comment, invisible when the file is rendered.
+
+const provenanceMarker = "<!-- llm provenance"
+
+type provenanceSource struct {
+	Kind      string `json:"kind"` // system_prompt, instructions, file, memory, datetime, stdin, clipboard, image
+	Path      string `json:"path,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Bytes     int    `json:"bytes,omitempty"`
+	Format    string `json:"format,omitempty"`     // of stdin, see --stdin-format
+	SentBytes int    `json:"sent_bytes,omitempty"` // when preprocessing changed the size
+	Truncated bool   `json:"truncated,omitempty"`
+	Items     int    `json:"items,omitempty"`
+}
+
+type provenance struct {
+	Created    time.Time          `json:"created"`
+	Session    string             `json:"session"`
+	Model      string             `json:"model"`
+	Seed       int                `json:"seed"`
+	Sources    []provenanceSource `json:"sources"`
+	Summarized bool               `json:"summarized,omitempty"` // by --summarize-overflow
+	Truncated  bool               `json:"truncated,omitempty"`  // the answer was cut by --deadline
+}
+
+// newProvenance returns nil unless the answer is saved, the methods do
+// nothing on nil
+func newProvenance(saveTo string, session *Session, model string, seed int) *provenance {
+	if saveTo == "" {
+		return nil
+	}
+	return &provenance{Created: time.Now(), Session: session.UUID, Model: model, Seed: seed, Sources: []provenanceSource{}}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// addText records content that's sent as is
+func (p *provenance) addText(kind, path, content string) {
+	if p == nil {
+		return
+	}
+	p.Sources = append(p.Sources, provenanceSource{Kind: kind, Path: path, SHA256: sha256Hex([]byte(content)), Bytes: len(content)})
+}
+
+func (p *provenance) addFiles(paths []string) {
+	if p == nil {
+		return
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		p.Sources = append(p.Sources, provenanceSource{Kind: "file", Path: filepath.ToSlash(path), SHA256: sha256Hex(data), Bytes: len(data)})
+	}
+}
+
+// addStdin records the input as read and the size of what was sent of it
+func (p *provenance) addStdin(input, format string, sent int) {
+	if p == nil {
+		return
+	}
+	src := provenanceSource{Kind: "stdin", SHA256: sha256Hex([]byte(input)), Bytes: len(input), Format: format}
+	if sent != len(input) {
+		src.SentBytes = sent
+		src.Truncated = sent < len(strings.TrimSpace(input))
+	}
+	p.Sources = append(p.Sources, src)
+}
+
+func (p *provenance) addItems(kind string, n int) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.Sources = append(p.Sources, provenanceSource{Kind: kind, Items: n})
+}
+
+func (p *provenance) markTruncated() {
+	if p != nil {
+		p.Truncated = true
+	}
+}
+
+func (p *provenance) footer() string {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s\n%s\n-->\n", provenanceMarker, data)
+}
+
+// saveAnswer writes the answer with the provenance footer to path
+func saveAnswer(path, answer string, p *provenance) error {
+	if p == nil {
+		return nil
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	content := answer
+	if content != "" && content[len(content)-1] != '\n' {
+		content += "\n"
+	}
+	return os.WriteFile(path, []byte(content+"\n"+p.footer()), 0644)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// --race fast-model asks a cheap fast model along with the -m model. The fast
+// answer is printed right away, the strong one follows below it once
+// complete. Pressing Enter while waiting keeps the fast answer and cancels
+// the strong request. Both are recorded as sessions of their own.
+
+type raceResult struct {
+	answer strings.Builder
+	err    error
+	done   chan struct{}
+}
+
+func startRace(ctx context.Context, target fanOutTarget, messages []Message, chunks chan<- string) *raceResult {
+	res := &raceResult{done: make(chan struct{})}
+	go func() {
+		defer close(res.done)
+		if chunks != nil {
+			defer close(chunks)
+		}
+
+		ch, err := target.Api(ctx, messages)
+		if err != nil {
+			res.err = err
+			return
+		}
+		for content := range ch {
+			res.answer.WriteString(content)
+			if chunks != nil {
+				chunks <- content
+			}
+		}
+	}()
+	return res
+}
+
+// waitForEnter signals a line typed on the terminal, never when stdin is
+// piped
+func waitForEnter() <-chan struct{} {
+	ret := make(chan struct{})
+	if !terminal().Stdin {
+		return ret
+	}
+	go func() {
+		if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err == nil {
+			close(ret)
+		}
+	}()
+	return ret
+}
+
+func runRace(fast, strong fanOutTarget, messages []Message, printCost bool) error {
+	fastCtx, cancelFast := context.WithCancel(context.Background())
+	defer cancelFast()
+	strongCtx, cancelStrong := context.WithCancel(context.Background())
+	defer cancelStrong()
+
+	chunks := make(chan string, 1<<14)
+	fastRes := startRace(fastCtx, fast, messages, chunks)
+	strongRes := startRace(strongCtx, strong, messages, nil)
+
+	headerStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("171"))
+
+	fmt.Printf("%s\n\n", headerStyle.Render("## "+fast.Model))
+
+	strongDone := strongRes.done
+	cut := false
+stream:
+	for {
+		select {
+		case content, ok := <-chunks:
+			if !ok {
+				break stream
+			}
+			fmt.Print(content)
+		case <-strongDone:
+			// the fast one lost, no need to read it to the end
+			cancelFast()
+			cut = true
+			strongDone = nil
+		}
+	}
+	<-fastRes.done
+	if fastRes.err != nil {
+		fmt.Printf("error: %s", withErrorHint(fastRes.err))
+	} else if cut {
+		fmt.Printf(" [cut: %s answered first]", strong.Model)
+	}
+	fmt.Print("\n\n")
+
+	accepted := false
+	select {
+	case <-strongRes.done:
+	default:
+		if fastRes.err == nil {
+			fmt.Fprintf(os.Stderr, "race: waiting for %s, Enter keeps this answer\n", strong.Model)
+		}
+		select {
+		case <-strongRes.done:
+		case <-waitForEnter():
+			cancelStrong()
+			<-strongRes.done
+			accepted = true
+			fmt.Fprintf(os.Stderr, "race: kept the answer of %s\n", fast.Model)
+		}
+	}
+
+	if !accepted {
+		fmt.Printf("%s\n\n", headerStyle.Render("## "+strong.Model))
+		if strongRes.err != nil {
+			fmt.Printf("error: %s", withErrorHint(strongRes.err))
+		} else {
+			fmt.Print(strongRes.answer.String())
+		}
+		fmt.Print("\n\n")
+	}
+
+	recordRaceAnswer(fast, messages, fastRes, cut)
+	recordRaceAnswer(strong, messages, strongRes, accepted)
+
+	if printCost {
+		fast.Usage.Print()
+		strong.Usage.Print()
+		printRaceCost(fast.Usage, strong.Usage)
+	}
+
+	if fastRes.err != nil && strongRes.err != nil {
+		return strongRes.err
+	}
+	return nil
+}
+
+func recordRaceAnswer(target fanOutTarget, messages []Message, res *raceResult, interrupted bool) {
+	for _, msg := range messages {
+		dumpMessageToHistory(target.Session, msg)
+	}
+	if res.err == nil {
+		answer := *NewMessage("assistant", res.answer.String())
+		answer.Interrupted = interrupted
+		dumpMessageToHistory(target.Session, answer)
+	}
+}
+
+// printRaceCost sums what both requests cost, the cancelled one included
+func printRaceCost(reporters ...*usageReporter) {
+	total := 0.0
+	for _, r := range reporters {
+		if r.last == nil {
+			return
+		}
+		cost, known := estimateCost(r.cfg, r.model, *r.last)
+		if !known {
+			return
+		}
+		total += cost
+	}
+	fmt.Fprintf(os.Stderr, "cost: $%.6f for the race\n", total)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+	"golang.org/x/tools/go/packages"
+)
+
+// renameCandidate is an occurrence the model has to judge: inside a string
+// literal, a comment or a non-Go file
+type renameCandidate struct {
+	file   string
+	line   int
+	text   string
+	offset int
+}
+
+type renameFile struct {
+	path  string
+	src   []byte
+	edits []int // offsets of occurrences to replace
+}
+
+func wordOffsets(text string, word string) []int {
+	re := regexp.MustCompile(`\b` + regexp.QuoteMeta(word) + `\b`)
+
+	var ret []int
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		ret = append(ret, loc[0])
+	}
+	return ret
+}
+
+func lineAt(src []byte, offset int) (int, string) {
+	start := lineStart(src, offset)
+	end := len(src)
+	if i := bytes.IndexByte(src[offset:], '\n'); i >= 0 {
+		end = offset + i
+	}
+	return 1 + bytes.Count(src[:offset], []byte("\n")), string(src[start:end])
+}
+
+// renameTarget is the object being renamed, identified by the position of
+// its declaration so that it matches across packages (an importing package
+// sees it through export data, as another types.Object)
+type renameTarget struct {
+	key  string
+	decl string
+}
+
+func objectKey(fset *token.FileSet, obj types.Object) string {
+	return fmt.Sprintf("%s %s", fset.Position(obj.Pos()), obj.Name())
+}
+
+// objectRank orders the declarations of a name: package-level first, then
+// fields and methods, then locals
+func objectRank(obj types.Object) int {
+	switch {
+	case obj.Pkg() != nil && obj.Parent() == obj.Pkg().Scope():
+		return 0
+	case isFieldOrMethod(obj):
+		return 1
+	}
+	return 2
+}
+
+func isFieldOrMethod(obj types.Object) bool {
+	switch x := obj.(type) {
+	case *types.Var:
+		return x.IsField()
+	case *types.Func:
+		return x.Type().(*types.Signature).Recv() != nil
+	}
+	return false
+}
+
+// findRenameTarget picks the declaration of oldName to rename: the one
+// declared or used on the line given with --at (file.go:line), else the only
+// declaration of the best rank
+func findRenameTarget(pkgs []*packages.Package, oldName, at string) (renameTarget, error) {
+	var atFile string
+	var atLine int
+	if at != "" {
+		file, line, ok := strings.Cut(at, ":")
+		n, err := strconv.Atoi(line)
+		if !ok || err != nil {
+			return renameTarget{}, fmt.Errorf("--at: expected file.go:line, got %q", at)
+		}
+		if atFile, err = filepath.Abs(file); err != nil {
+			return renameTarget{}, err
+		}
+		atLine = n
+	}
+
+	found := map[string]renameTarget{}
+	rank := map[string]int{}
+	add := func(pkg *packages.Package, ident *ast.Ident, obj types.Object) {
+		if obj == nil || ident.Name != oldName || obj.Pkg() == nil {
+			return
+		}
+		if at != "" {
+			pos := pkg.Fset.Position(ident.Pos())
+			if pos.Filename != atFile || pos.Line != atLine {
+				return
+			}
+		}
+		key := objectKey(pkg.Fset, obj)
+		found[key] = renameTarget{key: key, decl: pkg.Fset.Position(obj.Pos()).String()}
+		rank[key] = objectRank(obj)
+	}
+	for _, pkg := range pkgs {
+		for ident, obj := range pkg.TypesInfo.Defs {
+			add(pkg, ident, obj)
+		}
+		if at != "" {
+			for ident, obj := range pkg.TypesInfo.Uses {
+				add(pkg, ident, obj)
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		if at != "" {
+			return renameTarget{}, fmt.Errorf("no %s at %s", oldName, at)
+		}
+		return renameTarget{}, fmt.Errorf("no declaration of %s in the Go files", oldName)
+	}
+
+	best := 3
+	for key := range found {
+		best = min(best, rank[key])
+	}
+	var targets []renameTarget
+	for key, target := range found {
+		if rank[key] == best {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) > 1 {
+		var decls []string
+		for _, target := range targets {
+			decls = append(decls, target.decl)
+		}
+		sort.Strings(decls)
+		return renameTarget{}, fmt.Errorf("%s is declared more than once, pick one with --at file.go:line:\n  %s", oldName, strings.Join(decls, "\n  "))
+	}
+	return targets[0], nil
+}
+
+// scanGoFiles type-checks the packages of files and renames the identifiers
+// resolving to the target, so unrelated locals, fields, methods and names of
+// other packages are left alone. String literals and comments mentioning the
+// name become candidates for the model.
+func scanGoFiles(files []string, oldName, at string) ([]*renameFile, []renameCandidate, error) {
+	wanted := map[string]string{} // absolute path -> path as given
+	dirs := map[string]bool{}
+	for _, path := range files {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		wanted[abs] = path
+		dirs[filepath.Dir(abs)] = true
+	}
+	var patterns []string
+	for dir := range dirs {
+		patterns = append(patterns, dir)
+	}
+	sort.Strings(patterns)
+
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:  packages.NeedName | packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo,
+		Tests: true,
+	}, patterns...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) > 0 {
+			return nil, nil, fmt.Errorf("%s: %s, references can't be resolved", pkg.PkgPath, pkg.Errors[0])
+		}
+	}
+
+	target, err := findRenameTarget(pkgs, oldName, at)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byPath := map[string]*renameFile{}
+	var ret []*renameFile
+	var candidates []renameCandidate
+
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Syntax {
+			abs := pkg.Fset.File(f.Pos()).Name()
+			path, ok := wanted[abs]
+			if !ok {
+				continue
+			}
+
+			// the file is in the package and its test variant, its
+			// literals and comments are judged once
+			rf, seen := byPath[path]
+			if !seen {
+				src, err := os.ReadFile(path)
+				if err != nil {
+					return nil, nil, err
+				}
+				rf = &renameFile{path: path, src: src}
+				byPath[path] = rf
+				ret = append(ret, rf)
+			}
+
+			addCandidates := func(pos token.Pos, text string) {
+				base := pkg.Fset.Position(pos).Offset
+				for _, off := range wordOffsets(text, oldName) {
+					line, lineText := lineAt(rf.src, base+off)
+					candidates = append(candidates, renameCandidate{file: path, line: line, text: lineText, offset: base + off})
+				}
+			}
+
+			ast.Inspect(f, func(n ast.Node) bool {
+				switch x := n.(type) {
+				case *ast.Ident:
+					if x.Name != oldName {
+						break
+					}
+					obj := pkg.TypesInfo.Defs[x]
+					if obj == nil {
+						obj = pkg.TypesInfo.Uses[x]
+					}
+					if obj != nil && objectKey(pkg.Fset, obj) == target.key {
+						rf.edits = append(rf.edits, pkg.Fset.Position(x.Pos()).Offset)
+					}
+				case *ast.BasicLit:
+					if x.Kind == token.STRING && !seen {
+						addCandidates(x.Pos(), x.Value)
+					}
+				}
+				return true
+			})
+
+			if !seen {
+				for _, group := range f.Comments {
+					for _, c := range group.List {
+						addCandidates(c.Pos(), c.Text)
+					}
+				}
+			}
+		}
+	}
+
+	for _, path := range files {
+		if _, ok := byPath[path]; !ok {
+			slog.Warn(path + ": not renamed, the file isn't part of the build (build constraints)")
+		}
+	}
+
+	return ret, candidates, nil
+}
+
+func scanTextFile(path string, src []byte, oldName string) (*renameFile, []renameCandidate) {
+	rf := &renameFile{path: path, src: src}
+	var candidates []renameCandidate
+
+	for _, off := range wordOffsets(string(src), oldName) {
+		line, lineText := lineAt(src, off)
+		candidates = append(candidates, renameCandidate{file: path, line: line, text: lineText, offset: off})
+	}
+
+	return rf, candidates
+}
+
+func (rf *renameFile) apply(oldName, newName string) string {
+	sort.Sort(sort.Reverse(sort.IntSlice(rf.edits)))
+
+	out := string(rf.src)
+	last := -1
+	for _, offset := range rf.edits {
+		if offset == last {
+			continue
+		}
+		last = offset
+		out = out[:offset] + newName + out[offset+len(oldName):]
+	}
+	return out
+}
+
+func newRenameCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "rename <OldName> <NewName>",
+		Short:   "Rename a Go identifier across files and present the result as a patch",
+		GroupID: "code",
+		Args:    cobra.ExactArgs(2),
+		RunE:    runRename,
+	}
+
+	cmd.Flags().StringSliceP("files", "f", []string{"."}, "Files, directories or globs to search")
+	cmd.Flags().Bool("apply", false, "Write the changes instead of only printing the patch")
+	cmd.Flags().String("at", "", "Rename the identifier declared or used at file.go:line, when the name is declared more than once")
+
+	return cmd
+}
+
+func runRename(cmd *cobra.Command, args []string) error {
+	oldName, newName := args[0], args[1]
+	patterns, _ := cmd.Flags().GetStringSlice("files")
+	apply, _ := cmd.Flags().GetBool("apply")
+	at, _ := cmd.Flags().GetString("at")
+
+	if !token.IsIdentifier(oldName) || !token.IsIdentifier(newName) {
+		return fmt.Errorf("both names must be valid identifiers")
+	}
+
+	files, err := contextbuilder.PathResolver{}.Resolve(patterns)
+	if err != nil {
+		return err
+	}
+
+	var renameFiles []*renameFile
+	var candidates []renameCandidate
+	var goFiles []string
+
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(src), oldName) {
+			continue
+		}
+
+		if filepath.Ext(path) == ".go" {
+			goFiles = append(goFiles, path)
+			continue
+		}
+		rf, cs := scanTextFile(path, src, oldName)
+		renameFiles = append(renameFiles, rf)
+		candidates = append(candidates, cs...)
+	}
+
+	if len(goFiles) > 0 {
+		rfs, cs, err := scanGoFiles(goFiles, oldName, at)
+		if err != nil {
+			return err
+		}
+		renameFiles = append(rfs, renameFiles...)
+		candidates = append(cs, candidates...)
+	}
+
+	if len(candidates) > 0 {
+		accepted, err := judgeRenameCandidates(newLLMCompleter(cmd), oldName, newName, candidates)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range accepted {
+			for _, rf := range renameFiles {
+				if rf.path == c.file {
+					rf.edits = append(rf.edits, c.offset)
+				}
+			}
+		}
+	}
+
+	var patches []filePatch
+	for _, rf := range renameFiles {
+		if len(rf.edits) == 0 {
+			continue
+		}
+		patches = append(patches, filePatch{Path: rf.path, Old: string(rf.src), New: rf.apply(oldName, newName)})
+	}
+
+	if len(patches) == 0 {
+		fmt.Fprintf(os.Stderr, "no occurrences of %s to rename\n", oldName)
+		return nil
+	}
+
+	fmt.Print(formatPatches(patches))
+
+	if apply {
+		return applyFilePatches(patches)
+	}
+
+	return nil
+}
+
+func judgeRenameCandidates(complete llmCompleteFunc, oldName, newName string, candidates []renameCandidate) ([]renameCandidate, error) {
+	var list strings.Builder
+	for i, c := range candidates {
+		fmt.Fprintf(&list, "%d. %s:%d: %s\n", i+1, c.file, c.line, strings.TrimSpace(c.text))
+	}
+
+	messages := []llmclient.Message{
+		{
+			Role: "system",
+			Content: `You are assisting with a code refactoring. An identifier is being renamed and all code references are already handled.
+You judge textual occurrences (string literals, comments, templates, docs, configs) and decide which of them refer to the renamed identifier and must change too.
+Respond with a JSON array of the numbers of the occurrences to rename in a fenced code block, e.g. [1, 3].`,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Renaming %s to %s. Occurrences:\n%s", oldName, newName, list.String()),
+		},
+	}
+
+	answer, err := complete(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := extractCodeBlock(answer)
+	if err != nil {
+		payload = answer
+	}
+
+	var numbers []int
+	if err := json.Unmarshal([]byte(payload), &numbers); err != nil {
+		return nil, fmt.Errorf("unexpected model response: %w", err)
+	}
+
+	var ret []renameCandidate
+	for _, n := range numbers {
+		if n >= 1 && n <= len(candidates) {
+			ret = append(ret, candidates[n-1])
+		}
+	}
+
+	return ret, nil
+}
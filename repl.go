@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// --repl is the chat without the full screen interface: a prompt with line
+// editing and up-arrow history, answers streamed as raw markdown into the
+// scrollback. Meant for SSH sessions, dumb terminals and screen readers.
+// Without a terminal (or with TERM=dumb) lines are read as they come.
+
+const replHelp = `/help              this help
+/clear             start over, the system prompt is kept
+/undo              forget the last question and its answer
+/model <name>      continue with another model
+/reload            read the config again (pricing, budget, hooks)
+/prefill <text>    start the next answer with text, no text clears it
+/exit              quit, as do Ctrl+D and Ctrl+C at the prompt
+Ctrl+C while an answer streams stops it. End a line with \ to continue on the next one.`
+
+type replState struct {
+	messages   []Message
+	system     int // leading messages kept by /clear
+	modelname  string
+	llmApi     func(ctx context.Context, messages []Message) (<-chan string, error)
+	newApi     func(model string) (func(ctx context.Context, messages []Message) (<-chan string, error), error) // with the config read again
+	historyApi func(Message) error
+	prefill    string
+	sources    []string // of --cite
+	status     statusLine
+}
+
+// lineReader reads the input lines, with line editing on a terminal
+type lineReader interface {
+	ReadLine() (string, error)
+	Close() error
+}
+
+type plainLineReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r plainLineReader) ReadLine() (string, error) {
+	fmt.Print("> ")
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.scanner.Text(), nil
+}
+
+func (r plainLineReader) Close() error {
+	return nil
+}
+
+// rawLineReader switches the terminal to raw mode only while reading, so
+// Ctrl+C interrupts an answer as usual
+type rawLineReader struct {
+	t *term.Terminal
+}
+
+func (r rawLineReader) ReadLine() (string, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(fd, state)
+
+	if width, height, err := term.GetSize(fd); err == nil {
+		r.t.SetSize(width, height)
+	}
+	return r.t.ReadLine()
+}
+
+func (r rawLineReader) Close() error {
+	r.t.SetBracketedPasteMode(false)
+	return nil
+}
+
+func newLineReader() lineReader {
+	// the terminal's own line editing reads better with a screen reader
+	if terminal().Stdin && terminal().Stdout && os.Getenv("TERM") != "dumb" && !plainOutput {
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "> ")
+		t.SetBracketedPasteMode(true)
+		return rawLineReader{t}
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	return plainLineReader{scanner}
+}
+
+// readInput reads a message, which spans several lines when pasted or when
+// lines end with a backslash
+func readInput(r lineReader) (string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadLine()
+		if errors.Is(err, term.ErrPasteIndicator) {
+			lines = append(lines, line)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.HasSuffix(line, "\\") {
+			lines = append(lines, strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		return strings.Join(append(lines, line), "\n"), nil
+	}
+}
+
+func runREPL(s *replState, first string) error {
+	fmt.Printf("%s, /help for the commands\n\n", s.modelname)
+
+	r := newLineReader()
+	defer r.Close()
+	input := first
+	for {
+		if input == "" {
+			var err error
+			input, err = readInput(r)
+			if err == io.EOF {
+				fmt.Println()
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		msg := strings.TrimSpace(input)
+		input = ""
+		if msg == "" {
+			continue
+		}
+		if strings.HasPrefix(msg, "/") {
+			if quit := s.command(msg); quit {
+				return nil
+			}
+			continue
+		}
+
+		if err := s.send(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n\n", withErrorHint(err))
+		}
+	}
+}
+
+// command runs a slash command, true to quit
+func (s *replState) command(input string) bool {
+	if prefill, ok := parsePrefillCommand(input); ok {
+		s.prefill = prefill
+		if prefill == "" {
+			fmt.Print("prefill cleared\n\n")
+		} else {
+			fmt.Printf("the next answer starts with %q\n\n", prefill)
+		}
+		return false
+	}
+
+	name, arg, _ := strings.Cut(input, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/exit", "/quit":
+		return true
+	case "/help":
+		fmt.Print(replHelp + "\n\n")
+	case "/clear":
+		s.truncate(s.system)
+		fmt.Print("conversation cleared\n\n")
+	case "/undo":
+		n := len(s.messages)
+		for n > s.system && s.messages[n-1].Role != "user" {
+			n--
+		}
+		if n == s.system {
+			fmt.Print("nothing to undo\n\n")
+			return false
+		}
+		s.truncate(n - 1)
+		fmt.Print("removed the last question and answer\n\n")
+	case "/model":
+		if arg == "" {
+			fmt.Printf("model: %s\n\n", s.modelname)
+			return false
+		}
+		llmApi, err := s.newApi(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n\n", err)
+			return false
+		}
+		s.modelname, s.llmApi = arg, llmApi
+		fmt.Printf("continuing with %s\n\n", arg)
+	case "/reload":
+		llmApi, err := s.newApi(s.modelname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n\n", err)
+			return false
+		}
+		s.llmApi = llmApi
+		fmt.Print("config reloaded\n\n")
+	default:
+		fmt.Printf("unknown command %s, /help lists them\n\n", name)
+	}
+	return false
+}
+
+// truncate drops the messages from n on, in the history too
+func (s *replState) truncate(n int) {
+	for _, msg := range s.messages[n:] {
+		s.historyApi(*NewMessage("__sys__", fmt.Sprintf(`{"sysop": "remove_msg", "id": "%s"}`, msg.UUID)))
+	}
+	s.messages = s.messages[:n]
+}
+
+// send streams the answer to msg, Ctrl+C stops it and keeps what arrived
+func (s *replState) send(msg string) error {
+	userMsg := *NewMessage("user", msg)
+	s.messages = append(s.messages, userMsg)
+	s.historyApi(userMsg)
+
+	request := s.messages
+	if s.prefill != "" {
+		request = prefillMessages(s.messages, s.prefill)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stopStatus := s.status.show(os.Stdout)
+	ch, err := s.llmApi(ctx, request)
+	if err != nil {
+		stopStatus()
+		// the question stays for another try after /undo or as context
+		return err
+	}
+
+	answer := *NewMessage("assistant", s.prefill)
+	s.prefill = ""
+	started := false
+	start := func() {
+		if !started {
+			started = true
+			stopStatus()
+			fmt.Print(answer.Content)
+		}
+	}
+	for content := range ch {
+		start()
+		fmt.Print(content)
+		answer.Content += content
+	}
+	start()
+	if ctx.Err() != nil {
+		answer.Interrupted = true
+		fmt.Print(" [interrupted]")
+	}
+	fmt.Print("\n\n")
+	if footer := citationFooter(answer.Content, s.sources); footer != "" {
+		fmt.Print(footer + "\n\n")
+	}
+
+	s.messages = append(s.messages, answer)
+	return s.historyApi(answer)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+	"github.com/zalando/go-keyring"
+	"gopkg.in/yaml.v3"
+)
+
+// The model and the API of a run are resolved through one precedence chain,
+// the first layer setting a value wins: flags, the environment, the personal
+// config, the team config (llm sync), built-in defaults. The API key is
+// looked up in the keyring entry of the provider chosen in the setup after
+// the config's api_key.
+
+const defaultModel = "gpt-3.5-turbo"
+
+type setting struct {
+	Value  string
+	Source string // flag --model, env OPENAI_API_KEY, config, team config, keyring, default; empty when unset
+}
+
+type runConfig struct {
+	Model   setting
+	APIBase setting
+	APIKey  setting
+}
+
+type settingLayer func() (value string, source string)
+
+func resolveSetting(layers ...settingLayer) setting {
+	for _, layer := range layers {
+		if value, source := layer(); value != "" {
+			return setting{Value: value, Source: source}
+		}
+	}
+	return setting{}
+}
+
+func flagLayer(cmd *cobra.Command, name string) settingLayer {
+	return func() (string, string) {
+		if !cmd.Flags().Changed(name) {
+			return "", ""
+		}
+		value, _ := cmd.Flags().GetString(name)
+		return value, "flag --" + name
+	}
+}
+
+func envLayer(names ...string) settingLayer {
+	return func() (string, string) {
+		for _, name := range names {
+			if value := os.Getenv(name); value != "" {
+				return value, "env " + name
+			}
+		}
+		return "", ""
+	}
+}
+
+// configLayer takes the value from the merged config, the source tells
+// whether the personal or the team config set it
+func configLayer(cfg *Config, key string, value func(cfg *Config) string) settingLayer {
+	return func() (string, string) {
+		if cfg == nil {
+			return "", ""
+		}
+		v := value(cfg)
+		if v == "" {
+			return "", ""
+		}
+		return v, configSource(key)
+	}
+}
+
+func defaultLayer(value string) settingLayer {
+	return func() (string, string) {
+		return value, "default"
+	}
+}
+
+// configSource tells whether the value at the keys of the merged config is
+// set in the personal config or comes from the team config
+func configSource(keys ...string) string {
+	data, err := readConfigFile()
+	if err != nil {
+		return "config"
+	}
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) == nil && len(doc.Content) > 0 {
+		node := doc.Content[0]
+		for _, key := range keys {
+			node = mappingValue(node, key)
+		}
+		if node != nil {
+			return "config"
+		}
+	}
+	return "team config"
+}
+
+// resolveRunConfig applies the precedence chain, a config that can't be
+// read is skipped
+func resolveRunConfig(cmd *cobra.Command) runConfig {
+	cfg, err := loadConfig()
+	if err != nil {
+		cfg = nil
+	}
+
+	defaultBase := llmclient.DefaultAPIBase
+	if f := cmd.Flags().Lookup("api-base"); f != nil {
+		defaultBase = f.DefValue
+	}
+
+	rc := runConfig{
+		Model: resolveSetting(
+			flagLayer(cmd, "model"),
+			envLayer("OPENAI_API_MODEL", "GROQ_API_MODEL", "LLM_MODEL"),
+			configLayer(cfg, "model", func(cfg *Config) string { return cfg.Model }),
+			defaultLayer(defaultModel),
+		),
+		APIBase: resolveSetting(
+			flagLayer(cmd, "api-base"),
+			envLayer("OPENAI_API_BASE"),
+			configLayer(cfg, "api_base", func(cfg *Config) string { return cfg.APIBase }),
+			defaultLayer(defaultBase),
+		),
+		APIKey: resolveSetting(
+			flagLayer(cmd, "api-key"),
+			envLayer("OPENAI_API_KEY"),
+			configLayer(cfg, "api_key", func(cfg *Config) string { return cfg.APIKey }),
+			func() (string, string) {
+				if cfg == nil || cfg.Provider == "" {
+					return "", ""
+				}
+				// a missing entry is reported by the API as a missing key
+				key, _ := keyring.Get(keyringService, cfg.Provider)
+				return key, "keyring " + cfg.Provider
+			},
+		),
+	}
+	rc.APIBase.Value = strings.TrimSuffix(rc.APIBase.Value, "/")
+	if model := resolveAlias(cfg, rc.Model.Value); model != rc.Model.Value {
+		rc.Model.Source += ", " + configSource("aliases", rc.Model.Value) + " aliases." + rc.Model.Value
+		rc.Model.Value = model
+	}
+	return rc
+}
+
+// maskKey shows enough of an API key to tell which one it is
+func maskKey(key string) string {
+	if len(key) <= 12 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+// effectiveSettings lists what a run with these flags would use: the model
+// and the API through the precedence chain, then the settings of the model.
+// Nothing is fetched, the limits reported by the API are taken from the
+// cache only.
+func effectiveSettings(cmd *cobra.Command, cfg *Config) [][3]string {
+	rc := resolveRunConfig(cmd)
+	model := rc.Model.Value
+	var rows [][3]string
+	add := func(key, value, source string) {
+		rows = append(rows, [3]string{key, value, source})
+	}
+
+	add("model", model, rc.Model.Source)
+	apiBase := rc.APIBase.Value
+	add("api_base", apiBase, rc.APIBase.Source)
+	if name, srv, ok := lookupLocalServer(cfg, model, apiBase); ok {
+		apiBase = strings.TrimSuffix(srv.APIBase, "/")
+		add("api_base", apiBase+", started on demand: "+srv.commandLine(), configSource("local_servers", name)+" local_servers."+name)
+		if strings.HasPrefix(model, "local:") {
+			add("model", srv.model(name)+", asked for in place of "+model, configSource("local_servers", name)+" local_servers."+name)
+		}
+	}
+	if rc.APIKey.Value != "" {
+		add("api_key", maskKey(rc.APIKey.Value), rc.APIKey.Source)
+	} else {
+		add("api_key", "none", "")
+	}
+
+	requestsKey, requestsSource := "", ""
+	for _, key := range []string{model, "default"} {
+		if _, ok := cfg.Requests[key]; ok {
+			requestsKey = key
+			requestsSource = configSource("requests", key) + " requests." + key
+			break
+		}
+	}
+	// zero values are the defaults
+	requests := cfg.Requests[requestsKey]
+	sourceUnlessZero := func(zero bool) string {
+		if zero {
+			return "default"
+		}
+		return requestsSource
+	}
+	add("retries", fmt.Sprint(requests.Retries), sourceUnlessZero(requests.Retries == 0))
+	backoff := requests.RetryBackoff
+	if backoff == "" {
+		backoff = "1s"
+	}
+	add("retry_backoff", backoff, sourceUnlessZero(requests.RetryBackoff == ""))
+	add("cache_context", fmt.Sprint(requests.CacheContext), sourceUnlessZero(!requests.CacheContext))
+
+	listed := model
+	if name, srv, ok := lookupLocalServer(cfg, model, rc.APIBase.Value); ok && strings.HasPrefix(model, "local:") {
+		listed = srv.model(name)
+	}
+	var discovered modelLimits
+	if entry, ok := readModelLimitsCache()[apiBase]; ok {
+		discovered = entry.Models[listed]
+	}
+	switch {
+	case cfg.ContextWindows[model] > 0:
+		add("context_window", fmt.Sprint(cfg.ContextWindows[model]), configSource("context_windows", model)+" context_windows."+model)
+	case discovered.Context > 0:
+		add("context_window", fmt.Sprint(discovered.Context), "API model list, cached")
+	default:
+		tables := []map[string]int{cfg.ContextWindows, defaultContextWindows}
+		if key, table, ok := lookupModelKey(model, tables...); ok && table == 0 {
+			add("context_window", fmt.Sprint(tables[0][key]), configSource("context_windows", key)+" context_windows."+key)
+		} else if ok {
+			add("context_window", fmt.Sprint(tables[1][key]), "built-in "+key)
+		} else {
+			add("context_window", "unknown", "")
+		}
+	}
+	if discovered.MaxOutput > 0 {
+		add("max_output", fmt.Sprint(discovered.MaxOutput), "API model list, cached")
+	}
+
+	tables := []map[string]ModelPricing{cfg.Pricing, defaultPricing}
+	if key, table, ok := lookupModelKey(model, tables...); ok {
+		p := tables[table][key]
+		price := fmt.Sprintf("$%g in, $%g out per 1M tokens", p.Input, p.Output)
+		if p.CachedInput > 0 {
+			price += fmt.Sprintf(", $%g cached", p.CachedInput)
+		}
+		source := "built-in " + key
+		if table == 0 {
+			source = configSource("pricing", key) + " pricing." + key
+		}
+		add("pricing", price, source)
+	} else {
+		add("pricing", "unknown", "")
+	}
+
+	return rows
+}
+
+func newConfigEffectiveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "effective",
+		Short: "Print the model, API and model settings a run with the same flags would use, and where each comes from",
+		Example: `  llm config effective
+  llm config effective -m gpt-4o-mini`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			rows := effectiveSettings(cmd, cfg)
+
+			width := 0
+			for _, row := range rows {
+				width = max(width, len(row[1]))
+			}
+			for _, row := range rows {
+				line := fmt.Sprintf("%-15s %-*s  %s", row[0], width, row[1], row[2])
+				fmt.Println(strings.TrimRight(line, " "))
+			}
+			return nil
+		},
+	}
+}
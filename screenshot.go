@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// the @screen token in the message does the same as --screenshot
+const screenToken = "@screen"
+
+// captureScreenshot lets the user select a screen region with the platform
+// screenshot tool and returns it as PNG, or nil when the selection was
+// cancelled
+func captureScreenshot() ([]byte, error) {
+	f, err := os.CreateTemp("", "llm-screenshot-*.png")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("screencapture", "-i", "-x", path)
+	case "windows":
+		return nil, fmt.Errorf("screenshots aren't supported on Windows, take one with Win+Shift+S and attach it with -x")
+	default:
+		cmd, err = linuxScreenshotCommand(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the region selection is interactive
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+func linuxScreenshotCommand(path string) (*exec.Cmd, error) {
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if hasCommand("grim") && hasCommand("slurp") {
+			return exec.Command("sh", "-c", `region=$(slurp) && grim -g "$region" "$1"`, "sh", path), nil
+		}
+		if hasCommand("gnome-screenshot") {
+			return exec.Command("gnome-screenshot", "-a", "-f", path), nil
+		}
+		if hasCommand("spectacle") {
+			return exec.Command("spectacle", "-r", "-b", "-n", "-o", path), nil
+		}
+		return nil, fmt.Errorf("no screenshot tool found, install grim and slurp")
+	}
+
+	switch {
+	case hasCommand("maim"):
+		return exec.Command("maim", "-s", path), nil
+	case hasCommand("scrot"):
+		return exec.Command("scrot", "-s", "-o", path), nil
+	case hasCommand("gnome-screenshot"):
+		return exec.Command("gnome-screenshot", "-a", "-f", path), nil
+	case hasCommand("spectacle"):
+		return exec.Command("spectacle", "-r", "-b", "-n", "-o", path), nil
+	case hasCommand("import"):
+		// ImageMagick
+		return exec.Command("import", path), nil
+	}
+	return nil, fmt.Errorf("no screenshot tool found, install maim, scrot or ImageMagick")
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// screenshotImage captures a region and returns it as a data URL
+func screenshotImage() (string, error) {
+	png, err := captureScreenshot()
+	if err != nil {
+		return "", err
+	}
+	if len(png) == 0 {
+		return "", fmt.Errorf("the screenshot was cancelled")
+	}
+
+	if caps := terminal(); caps.Stderr && !caps.CI {
+		showImage(os.Stderr, png, caps.Images, 40)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
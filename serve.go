@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// llm serve exposes an OpenAI-compatible endpoint that forwards to the
+// configured upstream, so editors and other tools get the same memory,
+// project instructions, hooks, cache, budget and history as the cli
+
+func newServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "serve",
+		Short:   "Run a local OpenAI-compatible proxy (/v1/chat/completions, /v1/models) applying llm's configuration",
+		GroupID: "chat",
+		Args:    cobra.NoArgs,
+		RunE:    runServe,
+	}
+
+	cmd.Flags().StringP("listen", "l", "127.0.0.1:8181", "Address to listen on")
+
+	return cmd
+}
+
+type chatCompletionRequest struct {
+	Model    string `json:"model"`
+	Stream   bool   `json:"stream"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// messageContent flattens string and multi-part message contents into the
+// text and the urls of the image parts
+func messageContent(content json.RawMessage) (string, []string) {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text, nil
+	}
+
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	json.Unmarshal(content, &parts)
+
+	var texts, images []string
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL.URL != "" {
+				images = append(images, part.ImageURL.URL)
+			}
+		}
+	}
+	return strings.Join(texts, "\n"), images
+}
+
+// unsupportedKeys are request fields the proxy can't honor: the answer is
+// relayed as text, tool calls of the upstream answer would be lost
+var unsupportedKeys = []string{"tools", "functions"}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"message": err.Error(), "type": "llm_serve_error"},
+	})
+}
+
+// finishReason is "length" for an answer cut off upstream, call it once the
+// answer is drained
+func finishReason(usage *usageReporter) string {
+	if usage.last != nil && usage.last.Incomplete {
+		return "length"
+	}
+	return "stop"
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	defaultModel := getModelName(cmd)
+	seed, _ := cmd.Flags().GetInt("seed")
+	temperature, _ := cmd.Flags().GetFloat64("temperature")
+	apiKey, apiBase := configuredAPI(cmd)
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	noInstructions, _ := cmd.Flags().GetBool("no-instructions")
+	listen, _ := cmd.Flags().GetString("listen")
+
+	apiKey, apiBase, err := llmclient.ResolveAPI(apiKey, apiBase)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		models, err := llmclient.ListModels(apiKey, apiBase, 10*time.Second)
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		// the aliases of the config are offered as models too
+		if cfg, err := readConfig(); err == nil {
+			var aliases []string
+			for alias := range cfg.Aliases {
+				aliases = append(aliases, alias)
+			}
+			sort.Strings(aliases)
+			for _, alias := range aliases {
+				models = append(models, llmclient.Model{ID: alias})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(llmclient.ModelList{Object: "list", Data: models})
+	})
+
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+			return
+		}
+
+		var body map[string]interface{}
+		var req chatCompletionRequest
+
+		data, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(data, &body)
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &req)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		for _, key := range unsupportedKeys {
+			if _, ok := body[key]; ok {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%q isn't supported, llm serve relays text answers only", key))
+				return
+			}
+		}
+
+		cfg, err := readConfig()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		model := req.Model
+		if model == "" {
+			model = defaultModel
+		}
+		model = resolveAlias(cfg, model)
+
+		var messages []llmclient.Message
+		for _, msg := range req.Messages {
+			text, images := messageContent(msg.Content)
+			messages = append(messages, llmclient.Message{Role: msg.Role, Content: text, Images: images})
+		}
+
+		var section string
+		if cfg.InjectDatetime {
+			section = datetimeContext(time.Now())
+		}
+		if cfg.Memory.Enabled {
+			facts, err := loadMemory()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, err)
+				return
+			}
+			section = withMemory(section, facts)
+		}
+		if !noInstructions {
+			instructions, err := loadProjectInstructions(cfg)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, err)
+				return
+			}
+			section = appendSystemPrompt(section, instructions)
+		}
+		messages = withSystemSection(messages, section)
+
+		// everything else (max_tokens, stop, stream_options, tools...) is
+		// forwarded as is, the client's seed and temperature override ours
+		extra := map[string]interface{}{}
+		for k, v := range body {
+			if k != "model" && k != "messages" && k != "stream" {
+				extra[k] = v
+			}
+		}
+
+		cache, err := openResponseCache(cmd, cfg)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		session := newSession()
+		usage := newUsageReporter(cfg, session, model)
+
+		params, _ := json.Marshal(extra)
+		markChatStart(session, "", "", model, seed, temperature, apiBase, 0, 0, 0, false, nil, 0, string(params), "")
+		for _, msg := range messages {
+			histMsg := NewMessage(msg.Role, msg.Content)
+			histMsg.Images = msg.Images
+			dumpMessageToHistory(session, *histMsg)
+		}
+
+		// a client hanging up cancels the upstream request
+		middlewares := append([]llmclient.Middleware{llmclient.WithContext(r.Context())}, requestMiddlewares(cfg, model)...)
+		ch, err := llmclient.Chat(messages, model, seed, temperature, nil, apiKey, apiBase, req.Stream, extra, verbose, usage.Record, cache, cfg.Hooks, middlewares...)
+		if errors.Is(err, errBudgetExceeded) {
+			writeAPIError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		id := "chatcmpl-" + session.UUID
+		created := time.Now().Unix()
+		var answer strings.Builder
+
+		if !req.Stream {
+			for content := range ch {
+				answer.WriteString(content)
+			}
+
+			resp := map[string]interface{}{
+				"id":      id,
+				"object":  "chat.completion",
+				"created": created,
+				"model":   model,
+				"choices": []interface{}{map[string]interface{}{
+					"index":         0,
+					"message":       map[string]interface{}{"role": "assistant", "content": answer.String()},
+					"finish_reason": finishReason(usage),
+				}},
+			}
+			if usage.last != nil {
+				resp["usage"] = usage.last
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		} else {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			flusher, _ := w.(http.Flusher)
+
+			sendChunk := func(delta map[string]interface{}, finishReason interface{}, usage interface{}) {
+				chunk := map[string]interface{}{
+					"id":      id,
+					"object":  "chat.completion.chunk",
+					"created": created,
+					"model":   model,
+					"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finishReason}},
+				}
+				if usage != nil {
+					chunk["usage"] = usage
+				}
+				data, _ := json.Marshal(chunk)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+
+			sendChunk(map[string]interface{}{"role": "assistant"}, nil, nil)
+			for content := range ch {
+				answer.WriteString(content)
+				sendChunk(map[string]interface{}{"content": content}, nil, nil)
+			}
+
+			var lastUsage interface{}
+			if _, ok := extra["stream_options"]; ok && usage.last != nil {
+				lastUsage = usage.last
+			}
+			sendChunk(map[string]interface{}{}, finishReason(usage), lastUsage)
+
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}
+
+		dumpMessageToHistory(session, *NewMessage("assistant", answer.String()))
+	})
+
+	slog.Info("forwarding requests", "listen", "http://"+listen+"/v1", "api_base", apiBase)
+
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// the first run without a config asks for a provider, API key, default
+// model and whether to keep a history instead of silently talking to
+// gpt-3.5-turbo on api.openai.com
+
+const keyringService = "llm"
+
+type provider struct {
+	Name    string
+	Title   string
+	APIBase string // empty: asked for
+	Model   string
+	NoKey   bool
+}
+
+var providers = []provider{
+	{Name: "openai", Title: "OpenAI", APIBase: "https://api.openai.com/v1", Model: "gpt-4o-mini"},
+	{Name: "groq", Title: "Groq", APIBase: "https://api.groq.com/openai/v1", Model: "llama-3.3-70b-versatile"},
+	{Name: "openrouter", Title: "OpenRouter", APIBase: "https://openrouter.ai/api/v1", Model: "openai/gpt-4o-mini"},
+	{Name: "ollama", Title: "Ollama (local)", APIBase: "http://localhost:11434/v1", Model: "llama3.2", NoKey: true},
+	{Name: "custom", Title: "Other OpenAI-compatible API"},
+}
+
+// configuredAPI returns the API key and base, see resolveRunConfig
+func configuredAPI(cmd *cobra.Command) (string, string) {
+	rc := resolveRunConfig(cmd)
+	return rc.APIKey.Value, rc.APIBase.Value
+}
+
+// isConfigCmd tells whether cmd is llm config or shell completion, which work
+// with a missing or broken config
+func isConfigCmd(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		switch c.Name() {
+		case "config", "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return true
+		}
+	}
+	return false
+}
+
+// needsSetup is true on the first interactive run, unless the API is
+// already configured through the environment or the flags
+func needsSetup(cmd *cobra.Command) bool {
+	if isConfigCmd(cmd) {
+		return false
+	}
+
+	if caps := terminal(); !caps.Stdin || !caps.Stderr || caps.CI {
+		return false
+	}
+	if cmd.Flags().Changed("api-key") || cmd.Flags().Changed("api-base") {
+		return false
+	}
+	for _, env := range []string{"OPENAI_API_KEY", "OPENAI_API_BASE", "LLM_CASSETTE"} {
+		if os.Getenv(env) != "" {
+			return false
+		}
+	}
+
+	configFile, err := configFilePath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(configFile)
+	return os.IsNotExist(err)
+}
+
+type setupPrompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p setupPrompter) ask(question, fallback string) (string, error) {
+	if fallback != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, fallback)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return fallback, nil
+	}
+	return line, nil
+}
+
+func (p setupPrompter) confirm(question string, fallback bool) (bool, error) {
+	hint := "y/N"
+	if fallback {
+		hint = "Y/n"
+	}
+	answer, err := p.ask(question+" ("+hint+")", "")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "":
+		return fallback, nil
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (p setupPrompter) secret(question string) (string, error) {
+	fmt.Fprintf(p.out, "%s: ", question)
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := p.in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+	key, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(p.out)
+	return strings.TrimSpace(string(key)), err
+}
+
+// runSetup runs the wizard and writes its answers into the config, other
+// settings in an existing config are kept. With firstRun it asks first and
+// remembers a refusal, so it isn't offered again.
+func runSetup(firstRun bool) error {
+	p := setupPrompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+
+	configFile, err := configFilePath()
+	if err != nil {
+		return err
+	}
+
+	if firstRun {
+		ok, err := p.confirm(fmt.Sprintf("No config found (%s). Set up the provider, API key and default model now?", configFile), true)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(p.out, "Using OpenAI with $OPENAI_API_KEY, run llm config init to set up later.")
+			return writeConfigFile([]byte("# run llm config init to set up the provider, API key and default model\n"))
+		}
+	}
+
+	fmt.Fprintln(p.out, "Provider:")
+	for i, prov := range providers {
+		fmt.Fprintf(p.out, "  %d) %s\n", i+1, prov.Title)
+	}
+	var prov provider
+	for {
+		choice, err := p.ask("Choose", "1")
+		if err != nil {
+			return err
+		}
+		if n, err := strconv.Atoi(choice); err == nil && n >= 1 && n <= len(providers) {
+			prov = providers[n-1]
+			break
+		}
+		fmt.Fprintf(p.out, "Enter a number between 1 and %d\n", len(providers))
+	}
+
+	for prov.APIBase == "" {
+		base, err := p.ask("API base URL (e.g. http://localhost:8080/v1)", "")
+		if err != nil {
+			return err
+		}
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintln(p.out, "Enter an http:// or https:// URL")
+			continue
+		}
+		prov.APIBase = base
+	}
+
+	var apiKey string
+	if !prov.NoKey {
+		if apiKey, err = p.secret("API key (input hidden, empty to use $OPENAI_API_KEY)"); err != nil {
+			return err
+		}
+	}
+
+	model, err := p.ask("Default model", prov.Model)
+	if err != nil {
+		return err
+	}
+
+	keepHistory, err := p.confirm("Keep a local history of your chats (llm history)?", true)
+	if err != nil {
+		return err
+	}
+
+	data, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	str := func(s string) *yaml.Node { return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s} }
+	setConfigValue(&doc, []string{"provider"}, str(prov.Name))
+	setConfigValue(&doc, []string{"api_base"}, str(prov.APIBase))
+	if model != "" {
+		setConfigValue(&doc, []string{"model"}, str(model))
+	}
+	setConfigValue(&doc, []string{"history", "enabled"}, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(keepHistory)})
+
+	keyStored := ""
+	if apiKey != "" {
+		if err := keyring.Set(keyringService, prov.Name, apiKey); err == nil {
+			keyStored = "the API key is in the system keyring"
+			// an older key in the config would take precedence
+			if root := doc.Content[0]; mappingValue(root, "api_key") != nil {
+				for i := 0; i+1 < len(root.Content); i += 2 {
+					if root.Content[i].Value == "api_key" {
+						root.Content = append(root.Content[:i], root.Content[i+2:]...)
+						break
+					}
+				}
+			}
+		} else {
+			fmt.Fprintf(p.out, "The system keyring is unavailable: %s\n", err)
+			ok, err := p.confirm("Store the API key in the config file instead (readable only by you)?", false)
+			if err != nil {
+				return err
+			}
+			if ok {
+				setConfigValue(&doc, []string{"api_key"}, str(apiKey))
+				keyStored = "the API key is in the config"
+			} else {
+				keyStored = "set $OPENAI_API_KEY to provide the API key"
+			}
+		}
+	}
+
+	out, err := marshalYAML(&doc)
+	if err != nil {
+		return err
+	}
+	if err := writeConfigFile(out); err != nil {
+		return err
+	}
+	// the file may hold the API key now
+	if err := os.Chmod(configFile, 0o600); err != nil {
+		return err
+	}
+
+	msg := "Saved " + configFile
+	if keyStored != "" {
+		msg += ", " + keyStored
+	}
+	fmt.Fprintln(p.out, msg+". Run llm config init again to change these.")
+	return nil
+}
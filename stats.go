@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/spf13/cobra"
+)
+
+// llm stats summarizes the requests recorded in the history, llm stats
+// export dumps them one per row for spreadsheets and notebooks
+
+type requestStat struct {
+	Time             time.Time `json:"time" parquet:"time,timestamp"`
+	Session          string    `json:"session" parquet:"session"`
+	Model            string    `json:"model" parquet:"model"`
+	PromptTokens     int       `json:"prompt_tokens" parquet:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens" parquet:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens" parquet:"total_tokens"`
+	Estimated        bool      `json:"estimated" parquet:"estimated"`
+	LatencyMS        int64     `json:"latency_ms" parquet:"latency_ms"`
+	CostUSD          float64   `json:"cost_usd" parquet:"cost_usd"`
+	Status           string    `json:"status" parquet:"status"` // ok, incomplete or failed
+	Error            string    `json:"error" parquet:"error"`   // of failed requests: rate limit, timeout, ...
+}
+
+var requestStatColumns = []string{"time", "session", "model", "prompt_tokens", "completion_tokens", "total_tokens", "estimated", "latency_ms", "cost_usd", "status", "error"}
+
+func (s requestStat) row() []string {
+	return []string{
+		s.Time.Format(time.RFC3339),
+		s.Session,
+		s.Model,
+		strconv.Itoa(s.PromptTokens),
+		strconv.Itoa(s.CompletionTokens),
+		strconv.Itoa(s.TotalTokens),
+		strconv.FormatBool(s.Estimated),
+		strconv.FormatInt(s.LatencyMS, 10),
+		strconv.FormatFloat(s.CostUSD, 'f', -1, 64),
+		s.Status,
+		s.Error,
+	}
+}
+
+// parseSince accepts a duration back from now (24h, 7d) or a date
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, use a duration like 24h or 7d, or a date like 2024-05-01", value)
+}
+
+// readRequestStats returns the requests recorded since the given time,
+// optionally of one model only
+func readRequestStats(since time.Time, model string) ([]requestStat, error) {
+	var ret []requestStat
+	err := readHistory(func(rec historyRecord) error {
+		if rec.Usage == nil || int64(rec.TS) < since.Unix() {
+			return nil
+		}
+		if model != "" && rec.Usage.Model != model {
+			return nil
+		}
+		u := rec.Usage.Usage
+		status := "ok"
+		switch {
+		case u.Error != "":
+			status = "failed"
+		case u.Incomplete:
+			status = "incomplete"
+		}
+		ret = append(ret, requestStat{
+			Time:             time.Unix(int64(rec.TS), 0),
+			Session:          rec.SID,
+			Model:            rec.Usage.Model,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			TotalTokens:      u.TotalTokens,
+			Estimated:        u.Estimated,
+			LatencyMS:        u.LatencyMS,
+			CostUSD:          rec.Usage.CostUSD,
+			Status:           status,
+			Error:            u.Error,
+		})
+		return nil
+	})
+	return ret, err
+}
+
+func writeRequestStats(w io.Writer, stats []requestStat, format string) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(requestStatColumns)
+		for _, s := range stats {
+			cw.Write(s.row())
+		}
+		cw.Flush()
+		return cw.Error()
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, s := range stats {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "parquet":
+		return parquet.Write(w, stats)
+	}
+	return fmt.Errorf("unknown --format %q, use csv, jsonl or parquet", format)
+}
+
+// printStatsSummary prints requests, tokens, cost and the median latency
+// per model, failed requests count but don't weigh on the latency
+func printStatsSummary(w io.Writer, stats []requestStat) {
+	type modelStats struct {
+		requests, incomplete, failed int
+		prompt, completion           int
+		cost                         float64
+		latencies                    []int64
+	}
+	byModel := map[string]*modelStats{}
+	var models []string
+	for _, s := range stats {
+		m, ok := byModel[s.Model]
+		if !ok {
+			m = &modelStats{}
+			byModel[s.Model] = m
+			models = append(models, s.Model)
+		}
+		m.requests++
+		switch s.Status {
+		case "failed":
+			m.failed++
+		case "incomplete":
+			m.incomplete++
+		}
+		m.prompt += s.PromptTokens
+		m.completion += s.CompletionTokens
+		m.cost += s.CostUSD
+		if s.LatencyMS > 0 && s.Status != "failed" {
+			m.latencies = append(m.latencies, s.LatencyMS)
+		}
+	}
+	sort.Strings(models)
+
+	fmt.Fprintf(w, "%-28s %9s %12s %12s %12s %12s\n", "MODEL", "REQUESTS", "IN TOKENS", "OUT TOKENS", "COST", "P50 LATENCY")
+	for _, model := range models {
+		m := byModel[model]
+		latency := "-"
+		if len(m.latencies) > 0 {
+			sort.Slice(m.latencies, func(i, j int) bool { return m.latencies[i] < m.latencies[j] })
+			latency = (time.Duration(m.latencies[len(m.latencies)/2]) * time.Millisecond).String()
+		}
+		var notes []string
+		if m.incomplete > 0 {
+			notes = append(notes, fmt.Sprintf("%d cut", m.incomplete))
+		}
+		if m.failed > 0 {
+			notes = append(notes, fmt.Sprintf("%d failed", m.failed))
+		}
+		requests := strconv.Itoa(m.requests)
+		if len(notes) > 0 {
+			requests += " (" + strings.Join(notes, ", ") + ")"
+		}
+		fmt.Fprintf(w, "%-28s %9s %12d %12d %12s %12s\n", model, requests, m.prompt, m.completion, fmt.Sprintf("$%.4f", m.cost), latency)
+	}
+}
+
+func newStatsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "stats",
+		Short:   "Summarize the recorded requests per model: tokens, cost and latency",
+		GroupID: "data",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sinceFlag, _ := cmd.Flags().GetString("since")
+			model, _ := cmd.Flags().GetString("model")
+
+			since, err := parseSince(sinceFlag)
+			if err != nil {
+				return err
+			}
+			stats, err := readRequestStats(since, model)
+			if err != nil {
+				return err
+			}
+			if len(stats) == 0 {
+				fmt.Fprintln(os.Stderr, "no requests recorded")
+				return nil
+			}
+			printStatsSummary(os.Stdout, stats)
+			return nil
+		},
+	}
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write one row per recorded request (time, session, model, tokens, latency, cost, status) as CSV, JSONL or Parquet",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			out, _ := cmd.Flags().GetString("out")
+			sinceFlag, _ := cmd.Flags().GetString("since")
+			model, _ := cmd.Flags().GetString("model")
+
+			since, err := parseSince(sinceFlag)
+			if err != nil {
+				return err
+			}
+			stats, err := readRequestStats(since, model)
+			if err != nil {
+				return err
+			}
+
+			if out == "" || out == "-" {
+				return writeRequestStats(os.Stdout, stats, format)
+			}
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			if err := writeRequestStats(f, stats, format); err != nil {
+				f.Close()
+				os.Remove(out)
+				return err
+			}
+			return f.Close()
+		},
+	}
+
+	exportCmd.Flags().String("format", "csv", "csv, jsonl or parquet")
+	exportCmd.Flags().StringP("out", "o", "", "File to write to instead of stdout")
+
+	// -m selects the requests to a model
+	cmd.PersistentFlags().String("since", "", "Only requests since a duration ago (24h, 7d) or a date (2024-05-01)")
+
+	cmd.AddCommand(exportCmd)
+
+	return cmd
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// statusLine is the spinner shown while an answer is awaited and streamed,
+// in the chat and at the --repl prompt. Its look is set in tui.status, the
+// pulsing blocks of the default come out as garbage in some terminals.
+
+type StatusConfig struct {
+	Spinner     string `yaml:"spinner"`      // pulse (default), dot, minidot, line, points, meter, ellipsis, static or none
+	Color       string `yaml:"color"`        // while waiting for the first token, a 256-color number or #rrggbb, none for the terminal's color; default 171
+	StreamColor string `yaml:"stream_color"` // while the answer streams, default 51
+	Text        string `yaml:"text"`         // shown next to the spinner, e.g. thinking
+}
+
+// shown instead of the spinner when animations are disabled
+var staticSpinner = spinner.Spinner{Frames: []string{"..."}, FPS: time.Hour}
+
+var statusSpinners = map[string]spinner.Spinner{
+	"pulse":    {Frames: spinner.Pulse.Frames, FPS: time.Second / 10},
+	"dot":      spinner.Dot,
+	"minidot":  spinner.MiniDot,
+	"line":     spinner.Line,
+	"points":   spinner.Points,
+	"meter":    spinner.Meter,
+	"ellipsis": spinner.Ellipsis,
+	"static":   staticSpinner,
+	"none":     {Frames: []string{""}, FPS: time.Hour},
+}
+
+func statusSpinnerNames() []string {
+	var ret []string
+	for name := range statusSpinners {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+type statusLine struct {
+	cfg     StatusConfig
+	spinner spinner.Model
+}
+
+func newStatusLine(cfg StatusConfig) statusLine {
+	s := statusLine{cfg: cfg, spinner: spinner.New()}
+	s.spinner.Spinner = s.frames()
+	return s
+}
+
+// statusConfig is the tui.status of the config, the defaults if it can't be
+// read
+func statusConfig() StatusConfig {
+	if cfg, err := loadConfig(); err == nil {
+		return cfg.TUI.Status
+	}
+	return StatusConfig{}
+}
+
+func (s statusLine) animated() bool {
+	return terminal().Animations() && s.cfg.Spinner != "static" && s.cfg.Spinner != "none"
+}
+
+func (s statusLine) frames() spinner.Spinner {
+	if !terminal().Animations() && s.cfg.Spinner != "none" {
+		return staticSpinner
+	}
+	if sp, ok := statusSpinners[s.cfg.Spinner]; ok {
+		return sp
+	}
+	return statusSpinners["pulse"]
+}
+
+func statusStyle(color, fallback string) lipgloss.Style {
+	switch color {
+	case "none":
+		return lipgloss.NewStyle()
+	case "":
+		color = fallback
+	}
+	return lipgloss.NewStyle().Foreground(lipgloss.Color(color))
+}
+
+// waiting restarts the spinner for a new answer, the returned command
+// animates it
+func (s *statusLine) waiting() tea.Cmd {
+	s.spinner.Spinner = s.frames()
+	s.spinner.Style = statusStyle(s.cfg.Color, "171")
+	if !s.animated() {
+		return nil
+	}
+	return s.spinner.Tick
+}
+
+// streaming switches to the color of an answer arriving
+func (s *statusLine) streaming() {
+	s.spinner.Style = statusStyle(s.cfg.StreamColor, "51")
+}
+
+func (s statusLine) Update(msg tea.Msg) (statusLine, tea.Cmd) {
+	var cmd tea.Cmd
+	s.spinner, cmd = s.spinner.Update(msg)
+	return s, cmd
+}
+
+func (s statusLine) View() string {
+	return s.withText(s.spinner.View())
+}
+
+func (s statusLine) withText(frame string) string {
+	if s.cfg.Text == "" {
+		return frame
+	}
+	if frame != "" {
+		frame += " "
+	}
+	return frame + s.spinner.Style.Render(s.cfg.Text)
+}
+
+// show animates the status on a line of its own outside of the TUI until
+// the returned function is called, which clears the line. Nothing is shown
+// without animations, a line redrawn in place garbles logs.
+func (s statusLine) show(w io.Writer) (stop func()) {
+	if !s.animated() {
+		return func() {}
+	}
+	sp := s.frames()
+	style := statusStyle(s.cfg.Color, "171")
+	s.spinner.Style = style
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for frame := 0; ; frame++ {
+			fmt.Fprint(w, "\r\033[K"+s.withText(style.Render(sp.Frames[frame%len(sp.Frames)])))
+			select {
+			case <-done:
+				fmt.Fprint(w, "\r\033[K")
+				return
+			case <-time.After(sp.FPS):
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// llm sync keeps a clone of a team's config repository in
+// ~/.config/llmcli/team. Its config.yaml is read before the personal config,
+// which wins key by key (entries of tasks, pipelines, ... one by one). The
+// clone is reset on every sync, changes belong in the personal config. Only
+// the prompt and preset sections are taken from it, a shared repository
+// mustn't be able to redirect requests and keys or run commands.
+
+var teamConfigSections = map[string]bool{
+	"aliases":         true,
+	"model":           true,
+	"tasks":           true,
+	"pipelines":       true,
+	"contexts":        true,
+	"pricing":         true,
+	"context_windows": true,
+	"context_layout":  true,
+	"requests":        true,
+	"summarize":       true,
+	"instructions":    true,
+	"stacktrace":      true,
+	"lang":            true,
+	"inject_datetime": true,
+}
+
+func teamDirPath() (string, error) {
+	configDir, err := historyDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "team"), nil
+}
+
+func teamConfigPath() (string, error) {
+	dir, err := teamDirPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+// readTeamConfig returns the mapping of the team config, nil without one
+func readTeamConfig() (*yaml.Node, error) {
+	path, err := teamConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: not a mapping of config keys", path)
+	}
+	return doc.Content[0], nil
+}
+
+// teamOverlay leaves the sections of the team config that may be shared,
+// the others are returned to be warned about
+func teamOverlay(node *yaml.Node) (overlay *yaml.Node, ignored []string) {
+	overlay = &yaml.Node{Kind: yaml.MappingNode, Tag: node.Tag}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i].Value; !teamConfigSections[key] {
+			ignored = append(ignored, key)
+			continue
+		}
+		overlay.Content = append(overlay.Content, node.Content[i], node.Content[i+1])
+	}
+	return overlay, ignored
+}
+
+// applyTeamConfig decodes the team config into cfg before the personal
+// config is
+func applyTeamConfig(cfg *Config) error {
+	node, err := readTeamConfig()
+	if err != nil || node == nil {
+		return err
+	}
+	overlay, _ := teamOverlay(node)
+	if err := overlay.Decode(cfg); err != nil {
+		path, _ := teamConfigPath()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// teamConfigProblems lists the unknown keys of the team config and the
+// sections left out of it
+func teamConfigProblems(node *yaml.Node) []string {
+	overlay, ignored := teamOverlay(node)
+	problems := unknownConfigKeys(overlay, reflect.TypeOf(Config{}), "")
+	for _, key := range ignored {
+		if _, known := yamlFields(reflect.TypeOf(Config{}))[key]; known {
+			problems = append(problems, fmt.Sprintf("%q isn't taken from the team config, see llm sync --help", key))
+		} else {
+			problems = append(problems, unknownKeyMessage("", key, yamlFields(reflect.TypeOf(Config{}))))
+		}
+	}
+	return problems
+}
+
+func teamSectionNames() string {
+	var names []string
+	for name := range teamConfigSections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func newSyncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync [--repo git-url]",
+		Short: "Pull the team's shared config (tasks, pipelines, contexts, model settings) from a git repository",
+		Long: `Pull the team's shared config from a git repository into ~/.config/llmcli/team.
+The config.yaml at the top of the repository applies under the personal
+config, which overrides it key by key. Only the prompt and preset sections
+are shared: ` + teamSectionNames() + `.`,
+		Example: `  llm sync --repo git@github.com:acme/llm-config.git
+  llm sync`,
+		GroupID: "data",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repo, _ := cmd.Flags().GetString("repo")
+			remove, _ := cmd.Flags().GetBool("remove")
+
+			dir, err := teamDirPath()
+			if err != nil {
+				return err
+			}
+
+			if remove {
+				if err := os.RemoveAll(dir); err != nil {
+					return err
+				}
+				fmt.Fprintln(os.Stderr, "removed the team config")
+				return nil
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+				if repo == "" {
+					return fmt.Errorf("no team config yet, give its repository with --repo")
+				}
+				if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+					return err
+				}
+				if _, err := git(filepath.Dir(dir), "clone", "--depth", "1", repo, dir); err != nil {
+					return err
+				}
+			} else {
+				if repo != "" {
+					if current, _ := git(dir, "remote", "get-url", "origin"); current != repo {
+						if _, err := git(dir, "remote", "set-url", "origin", repo); err != nil {
+							return err
+						}
+					}
+				}
+				// the clone is a mirror, whatever was changed in it is dropped
+				if _, err := git(dir, "fetch", "--depth", "1", "origin", "HEAD"); err != nil {
+					return err
+				}
+				if _, err := git(dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+					return err
+				}
+			}
+
+			commit, err := git(dir, "log", "-1", "--format=%h %s")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "team config at %s\n", commit)
+
+			node, err := readTeamConfig()
+			if err != nil {
+				return err
+			}
+			if node == nil {
+				path, _ := teamConfigPath()
+				return fmt.Errorf("the repository has no config.yaml, expected %s", path)
+			}
+			for _, problem := range teamConfigProblems(node) {
+				slog.Warn("team config: " + problem)
+			}
+
+			var team Config
+			if err := applyTeamConfig(&team); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "%d tasks, %d pipelines, %d contexts\n", len(team.Tasks), len(team.Pipelines), len(team.Contexts))
+			return nil
+		},
+	}
+
+	cmd.Flags().String("repo", "", "Git repository of the team config, needed for the first sync")
+	cmd.Flags().Bool("remove", false, "Remove the team config")
+
+	return cmd
+}
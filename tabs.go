@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// several independent conversations in one chat: Ctrl+T opens a tab with the
+// model of the current one, /tab <model> with another one. Tab (what most
+// terminals send for Ctrl+Tab) or Ctrl+PgDn switches to the next tab,
+// Shift+Tab or Ctrl+PgUp to the previous one, Alt+1..9 to a numbered one.
+// /close closes the current tab.
+
+var (
+	activeTabStyle   = lipgloss.NewStyle().Reverse(true)
+	inactiveTabStyle = lipgloss.NewStyle().Faint(true)
+)
+
+type chatTabs struct {
+	tabs          []chatTuiState
+	active        int
+	nextID        int
+	newTab        func(model string) chatTuiState
+	width, height int
+}
+
+func newChatTabs(first chatTuiState, newTab func(model string) chatTuiState) chatTabs {
+	t := chatTabs{newTab: newTab}
+	first.id = t.nextID
+	t.nextID++
+	t.tabs = []chatTuiState{first}
+	return t
+}
+
+func (t chatTabs) Init() tea.Cmd {
+	return t.tabs[0].Init()
+}
+
+func (t chatTabs) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlT:
+			return t.open(t.tabs[t.active].modelname)
+		case tea.KeyTab, tea.KeyCtrlPgDown:
+			t.active = (t.active + 1) % len(t.tabs)
+			return t, nil
+		case tea.KeyShiftTab, tea.KeyCtrlPgUp:
+			t.active = (t.active + len(t.tabs) - 1) % len(t.tabs)
+			return t, nil
+		case tea.KeyRunes:
+			if msg.Alt && len(msg.Runes) == 1 && msg.Runes[0] >= '1' && msg.Runes[0] <= '9' {
+				if n := int(msg.Runes[0] - '1'); n < len(t.tabs) {
+					t.active = n
+				}
+				return t, nil
+			}
+		case tea.KeyEnter:
+			if msg.Alt {
+				break
+			}
+			input := strings.TrimSpace(t.tabs[t.active].textarea.Value())
+			if input == "/close" {
+				return t.close()
+			}
+			if input == "/tab" || strings.HasPrefix(input, "/tab ") {
+				t.tabs[t.active].textarea.Reset()
+				model := strings.TrimSpace(strings.TrimPrefix(input, "/tab"))
+				if model == "" {
+					model = t.tabs[t.active].modelname
+				}
+				return t.open(model)
+			}
+		}
+		return t.updateTab(t.active, msg)
+
+	case tea.MouseMsg:
+		return t.updateTab(t.active, msg)
+
+	case tea.WindowSizeMsg:
+		t.width, t.height = msg.Width, msg.Height
+		return t.resize()
+
+	case updateViewportMsg:
+		for i := range t.tabs {
+			if t.tabs[i].id == msg.tab {
+				return t.updateTab(i, msg)
+			}
+		}
+		// the tab was closed
+		return t, nil
+	}
+
+	// timers of spinners and cursors, config reloads
+	var cmds []tea.Cmd
+	for i := range t.tabs {
+		var cmd tea.Cmd
+		t, cmd = t.updateTab(i, msg)
+		cmds = append(cmds, cmd)
+	}
+	return t, tea.Batch(cmds...)
+}
+
+func (t chatTabs) updateTab(i int, msg tea.Msg) (chatTabs, tea.Cmd) {
+	m, cmd := t.tabs[i].Update(msg)
+	t.tabs[i] = m.(chatTuiState)
+	return t, cmd
+}
+
+func (t chatTabs) open(model string) (tea.Model, tea.Cmd) {
+	tab := t.newTab(model)
+	tab.id = t.nextID
+	t.nextID++
+	t.tabs = append(t.tabs, tab)
+	t.active = len(t.tabs) - 1
+
+	// the tab bar may have just appeared
+	ret, cmd := t.resize()
+	return ret, tea.Batch(cmd, tab.Init())
+}
+
+func (t chatTabs) close() (tea.Model, tea.Cmd) {
+	if len(t.tabs) == 1 {
+		return t, tea.Quit
+	}
+
+	tab := t.tabs[t.active]
+	if tab.ch != nil {
+		if tab.cancel != nil {
+			tab.cancel()
+		}
+		// nobody reads the rest of the answer anymore
+		go func() {
+			for range tab.ch {
+			}
+		}()
+	}
+
+	t.tabs = append(t.tabs[:t.active], t.tabs[t.active+1:]...)
+	t.active = min(t.active, len(t.tabs)-1)
+
+	return t.resize()
+}
+
+// resize passes the size of the window without the tab bar to the tabs
+func (t chatTabs) resize() (tea.Model, tea.Cmd) {
+	if t.width == 0 {
+		return t, nil
+	}
+
+	size := tea.WindowSizeMsg{Width: t.width, Height: t.height}
+	if len(t.tabs) > 1 {
+		size.Height--
+	}
+
+	var cmds []tea.Cmd
+	for i := range t.tabs {
+		var cmd tea.Cmd
+		t, cmd = t.updateTab(i, size)
+		cmds = append(cmds, cmd)
+	}
+	return t, tea.Batch(cmds...)
+}
+
+func (t chatTabs) View() string {
+	if len(t.tabs) == 1 {
+		return t.tabs[0].View()
+	}
+
+	var bar strings.Builder
+	for i, tab := range t.tabs {
+		label := fmt.Sprintf(" %d %s ", i+1, tab.modelname)
+		if tab.ch != nil {
+			label = fmt.Sprintf(" %d %s • ", i+1, tab.modelname)
+		}
+		if i == t.active {
+			bar.WriteString(activeTabStyle.Render(label))
+		} else {
+			bar.WriteString(inactiveTabStyle.Render(label))
+		}
+		bar.WriteString(" ")
+	}
+
+	return lipgloss.NewStyle().MaxWidth(t.width).Render(bar.String()) + "\n" + t.tabs[t.active].View()
+}
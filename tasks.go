@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// TaskPreset bundles defaults for a kind of task, explicitly given flags
+// take precedence over it
+type TaskPreset struct {
+	Temperature     *float64 `yaml:"temperature"`
+	ReasoningEffort string   `yaml:"reasoning_effort"` // minimal|low|medium|high, reasoning models only
+	Verbosity       string   `yaml:"verbosity"`        // low|medium|high, only some OpenAI models
+	SystemPrompt    string   `yaml:"system_prompt"`
+}
+
+func temperaturePtr(t float64) *float64 {
+	return &t
+}
+
+// reasoning effort and verbosity are rejected by most non-reasoning models,
+// the built-in presets leave them to the config
+var defaultTaskPresets = map[string]TaskPreset{
+	"code": {
+		Temperature:  temperaturePtr(0.1),
+		SystemPrompt: "You are an expert software engineer. Answer with correct, idiomatic, complete code first and keep explanations short. Point out assumptions and edge cases.",
+	},
+	"write": {
+		Temperature:  temperaturePtr(0.8),
+		SystemPrompt: "You are a skilled writer and editor. Write clear, natural and engaging prose matching the requested tone, avoid filler and cliches.",
+	},
+	"chat": {
+		Temperature:  temperaturePtr(0.7),
+		SystemPrompt: "You are a helpful, knowledgeable assistant. Be concise and friendly.",
+	},
+	"extract": {
+		Temperature:  temperaturePtr(0),
+		SystemPrompt: "Extract exactly the requested information from the input. Output only the extracted data without commentary, keep the original wording, and output nothing if the information is not present.",
+	},
+}
+
+func taskPresetNames(cfg *Config) []string {
+	names := map[string]bool{}
+	for name := range defaultTaskPresets {
+		names[name] = true
+	}
+	for name := range cfg.Tasks {
+		names[name] = true
+	}
+
+	var ret []string
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+// lookupTaskPreset merges the config's preset of the same name over the
+// built-in one
+func lookupTaskPreset(cfg *Config, name string) (TaskPreset, error) {
+	preset, builtin := defaultTaskPresets[name]
+	custom, configured := cfg.Tasks[name]
+
+	if !builtin && !configured {
+		return TaskPreset{}, fmt.Errorf("unknown task %q, available: %s", name, strings.Join(taskPresetNames(cfg), ", "))
+	}
+
+	if custom.Temperature != nil {
+		preset.Temperature = custom.Temperature
+	}
+	if custom.ReasoningEffort != "" {
+		preset.ReasoningEffort = custom.ReasoningEffort
+	}
+	if custom.Verbosity != "" {
+		preset.Verbosity = custom.Verbosity
+	}
+	if custom.SystemPrompt != "" {
+		preset.SystemPrompt = custom.SystemPrompt
+	}
+
+	return preset, nil
+}
+
+// applyTaskPreset fills the flags that weren't given on the command line
+// from the --task preset
+func applyTaskPreset(cmd *cobra.Command, cfg *Config) error {
+	name, _ := cmd.Flags().GetString("task")
+	if name == "" {
+		return nil
+	}
+
+	preset, err := lookupTaskPreset(cfg, name)
+	if err != nil {
+		return err
+	}
+
+	defaults := map[string]string{
+		"prompt":           preset.SystemPrompt,
+		"reasoning-effort": preset.ReasoningEffort,
+		"verbosity":        preset.Verbosity,
+	}
+	if preset.Temperature != nil {
+		defaults["temperature"] = strconv.FormatFloat(*preset.Temperature, 'f', -1, 64)
+	}
+
+	for flag, value := range defaults {
+		if value == "" || cmd.Flags().Changed(flag) {
+			continue
+		}
+		if err := cmd.Flags().Set(flag, value); err != nil {
+			return fmt.Errorf("task %s: %s: %w", name, flag, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-isatty"
+	"github.com/mattn/go-runewidth"
+	"github.com/muesli/termenv"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func is_interactive(fd uintptr) bool {
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// ciEnvVars are set by common CI systems, output there is read from logs
+var ciEnvVars = []string{"CI", "GITHUB_ACTIONS", "GITLAB_CI", "BUILDKITE", "JENKINS_URL", "TF_BUILD", "TEAMCITY_VERSION"}
+
+type imageProtocol string
+
+const (
+	imagesNone  imageProtocol = ""
+	imagesKitty imageProtocol = "kitty"
+	imagesITerm imageProtocol = "iterm"
+	imagesSixel imageProtocol = "sixel"
+)
+
+// terminalCaps is probed once per process, code deciding between interactive
+// and plain behaviour, colors or layout asks it instead of sniffing fds and
+// environment variables itself
+type terminalCaps struct {
+	Stdin  bool
+	Stdout bool
+	Stderr bool
+	CI     bool
+
+	Colors     termenv.Profile // of stdout, honours NO_COLOR and CLICOLOR_FORCE
+	Width      int             // of stdout, 80 when unknown
+	Hyperlinks bool            // OSC 8
+	Images     imageProtocol
+
+	// WideAmbiguous is set when East Asian ambiguous characters (box drawing,
+	// arrows, some symbols) are drawn double width. go-runewidth assumes so in
+	// CJK locales, but most terminals draw them single width there too, so
+	// it's opt-in via RUNEWIDTH_EASTASIAN=1.
+	WideAmbiguous bool
+}
+
+var terminal = sync.OnceValue(func() terminalCaps {
+	caps := terminalCaps{
+		Stdin:  is_interactive(os.Stdin.Fd()),
+		Stdout: is_interactive(os.Stdout.Fd()),
+		Stderr: is_interactive(os.Stderr.Fd()),
+		Colors: termenv.EnvColorProfile(),
+		Width:  80,
+
+		WideAmbiguous: os.Getenv("RUNEWIDTH_EASTASIAN") == "1",
+	}
+
+	for _, name := range ciEnvVars {
+		if v := os.Getenv(name); v != "" && v != "0" && v != "false" {
+			caps.CI = true
+		}
+	}
+
+	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 {
+		caps.Width = width
+	} else if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		caps.Width = width
+	}
+
+	if caps.Stdout {
+		caps.Hyperlinks = detectHyperlinks()
+		caps.Images = detectImageProtocol()
+	}
+
+	return caps
+})
+
+func detectHyperlinks() bool {
+	switch os.Getenv("TERM_PROGRAM") {
+	case "iTerm.app", "WezTerm", "vscode", "ghostty", "Hyper":
+		return true
+	}
+
+	if os.Getenv("KITTY_WINDOW_ID") != "" || os.Getenv("WT_SESSION") != "" || os.Getenv("KONSOLE_VERSION") != "" {
+		return true
+	}
+
+	// gnome-terminal and other VTE based terminals since 0.50
+	if vte, err := strconv.Atoi(os.Getenv("VTE_VERSION")); err == nil && vte >= 5000 {
+		return true
+	}
+
+	return false
+}
+
+func detectImageProtocol() imageProtocol {
+	if os.Getenv("KITTY_WINDOW_ID") != "" || os.Getenv("TERM") == "xterm-kitty" || os.Getenv("TERM_PROGRAM") == "ghostty" {
+		return imagesKitty
+	}
+
+	switch os.Getenv("TERM_PROGRAM") {
+	case "iTerm.app", "WezTerm":
+		return imagesITerm
+	}
+
+	if strings.Contains(os.Getenv("TERM"), "sixel") || os.Getenv("TERM") == "mlterm" {
+		return imagesSixel
+	}
+
+	return imagesNone
+}
+
+// plainOutput is set by --plain or tui.plain for screen readers and braille
+// displays: no colors, spinners, redrawn lines, window titles or inline
+// images, and the chat is the line based --repl instead of the full screen
+// TUI. NO_COLOR alone only turns off the colors.
+var plainOutput bool
+
+// applyPlainOutput reads --plain, or tui.plain unless the config itself is
+// being worked on
+func applyPlainOutput(cmd *cobra.Command) {
+	plain, _ := cmd.Flags().GetBool("plain")
+	if !cmd.Flags().Changed("plain") && !isConfigCmd(cmd) {
+		if cfg, err := loadConfig(); err == nil {
+			plain = cfg.TUI.Plain
+		}
+	}
+	if plain {
+		plainOutput = true
+		lipgloss.SetColorProfile(termenv.Ascii)
+	}
+}
+
+// Animations tells whether spinners and other redrawn output are allowed,
+// they only garble redirected output and CI logs
+func (c terminalCaps) Animations() bool {
+	return c.Stdout && c.Stderr && !c.CI && !plainOutput
+}
+
+// Markdown tells whether markdown can be rendered with ANSI styling on stdout
+func (c terminalCaps) Markdown() bool {
+	return c.Stdout && c.Colors != termenv.Ascii && !plainOutput
+}
+
+// StatusLine tells whether a progress line can be redrawn in place on stderr
+func (c terminalCaps) StatusLine() bool {
+	return c.Stderr && !plainOutput
+}
+
+// stripControl drops control characters and turns whitespace into spaces
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// windowTitle names the terminal tab after the conversation. Control
+// characters are dropped, an escape or bell would end the title sequence
+// and the rest would reach the terminal as commands.
+func windowTitle(model string, usermsg string) string {
+	model = stripControl(model)
+	summary := strings.Join(strings.Fields(stripControl(usermsg)), " ")
+	summary = runewidth.Truncate(summary, 40, "…")
+
+	if summary == "" {
+		return "llm (" + model + ")"
+	}
+	return "llm: " + summary + " (" + model + ")"
+}
+
+// pushWindowTitle sets the terminal title (OSC 0), the previous one is saved
+// on the xterm title stack and put back by the returned function
+func pushWindowTitle(title string) (restore func()) {
+	caps := terminal()
+	if caps.CI || plainOutput {
+		return func() {}
+	}
+
+	var out *os.File
+	switch {
+	case caps.Stderr:
+		out = os.Stderr
+	case caps.Stdout:
+		out = os.Stdout
+	default:
+		return func() {}
+	}
+
+	fmt.Fprintf(out, "\x1b[22;0t\x1b]0;%s\x07", title)
+
+	return func() {
+		fmt.Fprint(out, "\x1b[23;0t")
+	}
+}
+
+// showImage draws a PNG inline, columns wide, with the kitty or iTerm2
+// protocol. Sixel would need re-encoding the image and isn't drawn.
+func showImage(w io.Writer, png []byte, protocol imageProtocol, columns int) {
+	if plainOutput {
+		return
+	}
+	data := base64.StdEncoding.EncodeToString(png)
+
+	switch protocol {
+	case imagesKitty:
+		// the payload is sent in chunks of at most 4096 bytes
+		for i := 0; i < len(data); i += 4096 {
+			end := min(i+4096, len(data))
+			more := 0
+			if end < len(data) {
+				more = 1
+			}
+			if i == 0 {
+				fmt.Fprintf(w, "\x1b_Gf=100,a=T,c=%d,m=%d;%s\x1b\\", columns, more, data[i:end])
+			} else {
+				fmt.Fprintf(w, "\x1b_Gm=%d;%s\x1b\\", more, data[i:end])
+			}
+		}
+		fmt.Fprintln(w)
+	case imagesITerm:
+		fmt.Fprintf(w, "\x1b]1337;File=inline=1;size=%d;width=%d;preserveAspectRatio=1:%s\a\n", len(png), columns, data)
+	}
+}
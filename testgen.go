@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+type codeSymbol struct {
+	Name   string
+	Source string
+}
+
+type testTemplate struct {
+	Language     string
+	Instructions string
+	testPath     func(src string) string
+	runCmd       func(testPath string) *exec.Cmd
+	symbols      func(src []byte) ([]codeSymbol, error)
+}
+
+var testTemplates = map[string]testTemplate{
+	".go": {
+		Language: "go",
+		Instructions: `Write table-driven tests using only the standard "testing" package.
+Use one TestXxx function per symbol with a []struct{...} case table and t.Run subtests.
+The test file must declare the same package as the source file and must compile as is.`,
+		testPath: func(src string) string {
+			return uniqueTestPath(strings.TrimSuffix(src, ".go"), "_test.go")
+		},
+		runCmd: func(testPath string) *exec.Cmd {
+			cmd := exec.Command("go", "test", ".")
+			cmd.Dir = filepath.Dir(testPath)
+			return cmd
+		},
+		symbols: goSymbols,
+	},
+	".py": {
+		Language: "python",
+		Instructions: `Write pytest tests, using @pytest.mark.parametrize case tables where it makes sense.
+Import the module under test by its file name, the test file lives in the same directory.`,
+		testPath: func(src string) string {
+			dir, base := filepath.Split(strings.TrimSuffix(src, ".py"))
+			return uniqueTestPath(filepath.Join(dir, "test_"+base), ".py")
+		},
+		runCmd: func(testPath string) *exec.Cmd {
+			cmd := exec.Command("python3", "-m", "pytest", "-q", filepath.Base(testPath))
+			cmd.Dir = filepath.Dir(testPath)
+			return cmd
+		},
+		symbols: pySymbols,
+	},
+}
+
+// uniqueTestPath returns the first of stem+suffix, stem_gen+suffix,
+// stem_gen2+suffix, ... not taken, a file of the user is never overwritten
+func uniqueTestPath(stem, suffix string) string {
+	path := stem + suffix
+	for n := 1; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		if n == 1 {
+			path = stem + "_gen" + suffix
+		} else {
+			path = fmt.Sprintf("%s_gen%d%s", stem, n, suffix)
+		}
+	}
+}
+
+func goSymbols(src []byte) ([]codeSymbol, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []codeSymbol
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name == "main" || fn.Name.Name == "init" {
+			continue
+		}
+
+		name := fn.Name.Name
+		if fn.Recv != nil && len(fn.Recv.List) > 0 {
+			name = receiverTypeName(fn.Recv.List[0].Type) + "." + name
+		}
+
+		start, end := fset.Position(fn.Pos()).Offset, fset.Position(fn.End()).Offset
+		ret = append(ret, codeSymbol{Name: name, Source: string(src[start:end])})
+	}
+
+	return ret, nil
+}
+
+func receiverTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexListExpr:
+		return receiverTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+var pyDefRe = regexp.MustCompile(`(?m)^(?:async\s+)?(?:def|class)\s+(\w+)`)
+
+func pySymbols(src []byte) ([]codeSymbol, error) {
+	text := string(src)
+	matches := pyDefRe.FindAllStringSubmatchIndex(text, -1)
+
+	var ret []codeSymbol
+	for i, m := range matches {
+		end := len(text)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		ret = append(ret, codeSymbol{Name: text[m[2]:m[3]], Source: strings.TrimRight(text[m[0]:end], "\n")})
+	}
+
+	return ret, nil
+}
+
+func selectSymbols(all []codeSymbol, names []string) ([]codeSymbol, error) {
+	if len(names) == 0 {
+		return all, nil
+	}
+
+	var ret []codeSymbol
+	for _, name := range names {
+		found := false
+		for _, sym := range all {
+			if sym.Name == name || strings.HasSuffix(sym.Name, "."+name) {
+				ret = append(ret, sym)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("symbol %s not found", name)
+		}
+	}
+
+	return ret, nil
+}
+
+func newTestsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "tests",
+		Short:   "Generate tests for selected symbols, run them and present the result as a patch",
+		GroupID: "code",
+		Args:    cobra.NoArgs,
+		RunE:    runTests,
+	}
+
+	cmd.Flags().StringSliceP("files", "f", []string{}, "Source files to generate tests for")
+	cmd.Flags().StringSlice("symbol", []string{}, "Only test these functions/methods (default: all)")
+	cmd.Flags().Bool("apply", false, "Write the generated test files instead of only printing the patch")
+	cmd.Flags().Int("fix-attempts", 1, "How many times to feed failing test output back to the model")
+
+	return cmd
+}
+
+func runTests(cmd *cobra.Command, args []string) error {
+	files, _ := cmd.Flags().GetStringSlice("files")
+	symbolNames, _ := cmd.Flags().GetStringSlice("symbol")
+	apply, _ := cmd.Flags().GetBool("apply")
+	fixAttempts, _ := cmd.Flags().GetInt("fix-attempts")
+
+	if len(files) == 0 {
+		return fmt.Errorf("at least one source file is required (-f)")
+	}
+
+	complete := newLLMCompleter(cmd)
+
+	var patches []filePatch
+
+	for _, file := range files {
+		tmpl, ok := testTemplates[filepath.Ext(file)]
+		if !ok {
+			return fmt.Errorf("%s: unsupported language", file)
+		}
+
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		all, err := tmpl.symbols(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		symbols, err := selectSymbols(all, symbolNames)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if len(symbols) == 0 {
+			slog.Warn(file + ": nothing to test")
+			continue
+		}
+
+		testPath := tmpl.testPath(file)
+		testCode, err := generateTestFile(complete, tmpl, file, string(src), symbols, testPath, fixAttempts)
+		if errors.Is(err, errTestsInterrupted) {
+			return &exitError{code: 130}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		patches = append(patches, filePatch{Path: testPath, New: testCode})
+	}
+
+	fmt.Print(formatPatches(patches))
+
+	if apply {
+		return applyFilePatches(patches)
+	}
+
+	return nil
+}
+
+func generateTestFile(complete llmCompleteFunc, tmpl testTemplate, file, src string, symbols []codeSymbol, testPath string, fixAttempts int) (string, error) {
+	names := make([]string, len(symbols))
+	for i, sym := range symbols {
+		names[i] = sym.Name
+	}
+
+	messages := []llmclient.Message{
+		{
+			Role: "system",
+			Content: fmt.Sprintf("You are an expert %s engineer writing unit tests.\n%s\nRespond with the complete test file in a single fenced code block and nothing else.",
+				tmpl.Language, tmpl.Instructions),
+		},
+		{
+			Role: "user",
+			Content: fmt.Sprintf("Source file %s:\n```%s\n%s\n```\n\nWrite tests for: %s\nThe tests will be saved as %s.",
+				file, tmpl.Language, strings.TrimRight(src, "\n"), strings.Join(names, ", "), filepath.Base(testPath)),
+		},
+	}
+
+	var testCode string
+
+	for attempt := 0; ; attempt++ {
+		answer, err := complete(messages)
+		if err != nil {
+			return "", err
+		}
+		messages = append(messages, llmclient.Message{Role: "assistant", Content: answer})
+
+		testCode, err = extractCodeBlock(answer)
+		if err != nil {
+			return "", err
+		}
+
+		slog.Info("running the generated tests", "file", file)
+		output, err := runGeneratedTests(tmpl, testPath, testCode)
+		if errors.Is(err, errTestsInterrupted) {
+			return "", err
+		}
+		if err == nil {
+			slog.Info("generated tests pass", "file", file)
+			break
+		}
+
+		if attempt >= fixAttempts {
+			slog.Warn(fmt.Sprintf("%s: generated tests still fail:\n%s", file, output))
+			break
+		}
+
+		messages = append(messages, llmclient.Message{
+			Role:    "user",
+			Content: fmt.Sprintf("Running the tests failed:\n```\n%s\n```\nFix the test file and respond with the complete corrected file.", output),
+		})
+	}
+
+	return testCode, nil
+}
+
+var errTestsInterrupted = errors.New("interrupted")
+
+// runGeneratedTests temporarily places the test file next to the source, the
+// user's tree is left untouched unless --apply is given. Interrupting llm
+// while the tests run stops them, removes the file and returns
+// errTestsInterrupted.
+func runGeneratedTests(tmpl testTemplate, testPath, testCode string) (string, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the path was free when picked, a file created since isn't overwritten
+	f, err := os.OpenFile(testPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(testPath)
+	_, err = f.WriteString(testCode)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+	cmd := tmpl.runCmd(testPath)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// go test leaves the test binary writing to the output when killed
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-exited
+		return "", errTestsInterrupted
+	}
+
+	return strings.TrimSpace(output.String()), err
+}
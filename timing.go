@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --vt prints the timing of the answer to stderr: time to the first token
+// and tokens per second. For servers on this machine the GPUs are sampled
+// with nvidia-smi while the answer streams, and llama.cpp's /metrics (with
+// --metrics) add the KV cache use and the server's own throughput, for
+// tuning context size, offloaded layers and batch sizes.
+
+type answerTiming struct {
+	start, first, end time.Time
+}
+
+func (t *answerTiming) chunk() {
+	if t.first.IsZero() {
+		t.first = time.Now()
+	}
+}
+
+// print reports the time to the first token and the rate of the following
+// ones, which a response that wasn't streamed doesn't tell
+func (t *answerTiming) print(completionTokens int, estimated bool, streamed bool) {
+	approx := ""
+	if estimated {
+		approx = "~"
+	}
+	total := t.end.Sub(t.start)
+	if t.first.IsZero() {
+		fmt.Fprintf(os.Stderr, "timing: no tokens in %s\n", total.Round(time.Millisecond))
+		return
+	}
+	if !streamed {
+		fmt.Fprintf(os.Stderr, "timing: %s%d tokens in %s, not streamed\n", approx, completionTokens, total.Round(time.Millisecond))
+		return
+	}
+	line := fmt.Sprintf("timing: first token %s, %s%d tokens in %s", t.first.Sub(t.start).Round(time.Millisecond), approx, completionTokens, total.Round(time.Millisecond))
+	if generation := t.end.Sub(t.first).Seconds(); generation > 0 && completionTokens > 1 {
+		line += fmt.Sprintf(", %s%.1f tokens/s", approx, float64(completionTokens-1)/generation)
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// isLocalAPI tells whether the API runs on this machine
+func isLocalAPI(apiBase string) bool {
+	u, err := url.Parse(apiBase)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+type gpuSample struct {
+	Name       string
+	MemUsedMB  int
+	MemTotalMB int
+	Util       int // percent
+}
+
+func sampleGPUs() ([]gpuSample, error) {
+	out, err := exec.Command("nvidia-smi", "--query-gpu=name,memory.used,memory.total,utilization.gpu", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, err
+	}
+	var ret []gpuSample
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) != 4 {
+			continue
+		}
+		s := gpuSample{Name: fields[0]}
+		s.MemUsedMB, _ = strconv.Atoi(fields[1])
+		s.MemTotalMB, _ = strconv.Atoi(fields[2])
+		s.Util, _ = strconv.Atoi(fields[3])
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// gpuMonitor keeps the peak memory and utilization of every GPU
+type gpuMonitor struct {
+	mu     sync.Mutex
+	peak   []gpuSample
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startGPUMonitor returns nil without nvidia-smi
+func startGPUMonitor(interval time.Duration) *gpuMonitor {
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &gpuMonitor{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if samples, err := sampleGPUs(); err == nil {
+				m.record(samples)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return m
+}
+
+func (m *gpuMonitor) record(samples []gpuSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.peak) != len(samples) {
+		m.peak = samples
+		return
+	}
+	for i, s := range samples {
+		m.peak[i].MemUsedMB = max(m.peak[i].MemUsedMB, s.MemUsedMB)
+		m.peak[i].Util = max(m.peak[i].Util, s.Util)
+	}
+}
+
+func (m *gpuMonitor) stop() []gpuSample {
+	if m == nil {
+		return nil
+	}
+	m.cancel()
+	<-m.done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peak
+}
+
+func printGPUSamples(samples []gpuSample) {
+	for i, s := range samples {
+		fmt.Fprintf(os.Stderr, "gpu %d: %s, peak %.1f/%.1f GiB, %d%% utilization\n", i, s.Name, float64(s.MemUsedMB)/1024, float64(s.MemTotalMB)/1024, s.Util)
+	}
+}
+
+// scrapeServerMetrics reads the llamacpp: metrics of the Prometheus endpoint
+// next to the API, nil when there is none
+func scrapeServerMetrics(apiBase string) map[string]float64 {
+	u, err := url.Parse(apiBase)
+	if err != nil {
+		return nil
+	}
+	u.Path = "/metrics"
+
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	ret := map[string]float64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || !strings.HasPrefix(name, "llamacpp:") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			ret[strings.TrimPrefix(name, "llamacpp:")] = v
+		}
+	}
+	return ret
+}
+
+func printServerMetrics(metrics map[string]float64) {
+	var parts []string
+	if v, ok := metrics["kv_cache_usage_ratio"]; ok {
+		parts = append(parts, fmt.Sprintf("kv cache %.0f%% used", v*100))
+	}
+	if v, ok := metrics["prompt_tokens_seconds"]; ok {
+		parts = append(parts, fmt.Sprintf("prompt %.1f tokens/s", v))
+	}
+	if v, ok := metrics["predicted_tokens_seconds"]; ok {
+		parts = append(parts, fmt.Sprintf("generation %.1f tokens/s", v))
+	}
+	if len(parts) > 0 {
+		fmt.Fprintf(os.Stderr, "server: %s\n", strings.Join(parts, ", "))
+	}
+}
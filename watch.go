@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kir-gadjello/llm/pkg/contextbuilder"
+	"github.com/spf13/cobra"
+)
+
+// --watch asks again whenever one of the -f files changes, an answer still
+// streaming is abandoned. Files are polled, new files matching the patterns
+// count as a change too.
+
+const watchInterval = 500 * time.Millisecond
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func watchSnapshot(patterns []string) map[string]fileState {
+	paths, _ := contextbuilder.PathResolver{}.Resolve(patterns)
+	ret := make(map[string]fileState, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			ret[path] = fileState{info.Size(), info.ModTime()}
+		}
+	}
+	return ret
+}
+
+// changedFile returns a file that differs between the snapshots
+func changedFile(old, cur map[string]fileState) (string, bool) {
+	var paths []string
+	for path := range cur {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		if st, ok := old[path]; !ok || st != cur[path] {
+			return path, true
+		}
+	}
+	for path := range old {
+		if _, ok := cur[path]; !ok {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// waitForChange polls until a file changes, editors saving in several steps
+// are given a moment to finish
+func waitForChange(ctx context.Context, patterns []string, snapshot map[string]fileState) (string, bool) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-ticker.C:
+		}
+		if path, changed := changedFile(snapshot, watchSnapshot(patterns)); changed {
+			time.Sleep(watchInterval / 2)
+			return path, true
+		}
+	}
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	// the context's files would be added again on every run
+	if err := applyContextPreset(cmd, cfg); err != nil {
+		return err
+	}
+	cmd.Flags().Set("context", "")
+
+	patterns, _ := cmd.Flags().GetStringSlice("files")
+	if len(patterns) == 0 {
+		return fmt.Errorf("--watch needs the files to watch, give them with -f")
+	}
+	chat, _ := cmd.Flags().GetBool("chat")
+	chatSend, _ := cmd.Flags().GetBool("chat-send")
+	follow, _ := cmd.Flags().GetBool("follow")
+	models, _ := cmd.Flags().GetStringSlice("models")
+	if len(args) == 0 || chat || chatSend || follow || len(models) > 0 {
+		return fmt.Errorf("--watch only works in a one-shot query to a single model")
+	}
+	if stat, _ := os.Stdin.Stat(); stat.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("--watch can't be combined with piped input, it's read only once")
+	}
+
+	cmd.Flags().Set("watch", "false")
+	parent := cmd.Context()
+
+	for {
+		snapshot := watchSnapshot(patterns)
+
+		ctx, cancel := context.WithCancel(parent)
+		cmd.SetContext(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- runLLMChat(cmd, args)
+		}()
+
+		changes := make(chan string, 1)
+		go func() {
+			if path, ok := waitForChange(ctx, patterns, snapshot); ok {
+				changes <- path
+			}
+		}()
+
+		var path string
+		select {
+		case err := <-done:
+			// the verdict of --check is already printed
+			var exit *exitError
+			if err != nil && !(errors.As(err, &exit) && exit.err == nil) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			path = <-changes
+		case path = <-changes:
+			cancel()
+			<-done
+		}
+		cancel()
+
+		if terminal().Stdout && !plainOutput {
+			fmt.Print("\033[H\033[2J")
+		} else {
+			fmt.Println()
+		}
+		fmt.Fprintf(os.Stderr, "watch: %s changed at %s\n\n", path, time.Now().Format(time.TimeOnly))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/kir-gadjello/llm/pkg/llmclient"
+	"github.com/spf13/cobra"
+)
+
+// shared plumbing for the non-interactive code workflows (tests, doc, ...)
+
+// addPersistentLLMFlags registers the flags shared by all commands on the
+// root, subcommands inherit them
+func addPersistentLLMFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringP("model", "m", "", "LLM model: OPENAI_API_MODEL,GROQ_API_MODEL,LLM_MODEL from env, model from the config or gpt-3.5-turbo")
+	cmd.PersistentFlags().IntP("seed", "s", 1337, "Random seed")
+	cmd.PersistentFlags().Float64P("temperature", "t", 0.0, "Temperature")
+	cmd.PersistentFlags().StringP("api-key", "k", "", "OpenAI API key")
+	cmd.PersistentFlags().StringP("api-base", "b", "https://api.openai.com/v1/", "OpenAI API base URL")
+	cmd.PersistentFlags().BoolP("verbose", "v", false, "Debug logging with the request payloads, --log-dir records the HTTP exchanges")
+	cmd.PersistentFlags().String("log-level", "info", "Least severe messages printed to stderr: debug, info, warn or error (config: logging.level)")
+	cmd.PersistentFlags().String("log-dir", "", "Write every API request and its raw response, streamed events included, to a file in this directory, API keys redacted (config: logging.dir)")
+	cmd.PersistentFlags().Bool("cost", false, "Print the estimated cost after each request")
+	cmd.PersistentFlags().Bool("cache", false, "Serve identical one-shot requests from the response cache")
+	cmd.PersistentFlags().Bool("no-cache", false, "Bypass the response cache even if enabled in config")
+	cmd.PersistentFlags().Bool("plain", false, "Plain text output for screen readers: no colors, spinners, redrawn lines or inline images, the chat uses the --repl prompt (tui.plain in the config)")
+	cmd.PersistentFlags().Bool("no-instructions", false, "Don't add the project instruction files (AGENTS.md, LLM.md, .cursorrules) to the system prompt")
+}
+
+func getModelName(cmd *cobra.Command) string {
+	return resolveRunConfig(cmd).Model.Value
+}
+
+type llmCompleteFunc func(messages []llmclient.Message) (string, error)
+
+// llmStreamFunc sends the request and, when out is not nil, streams the
+// answer into it while it is generated
+type llmStreamFunc func(messages []llmclient.Message, out io.Writer) (string, error)
+
+func newLLMStreamer(cmd *cobra.Command) llmStreamFunc {
+	modelname := getModelName(cmd)
+	seed, _ := cmd.Flags().GetInt("seed")
+	temperature, _ := cmd.Flags().GetFloat64("temperature")
+	apiKey, apiBase := configuredAPI(cmd)
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	printCost, _ := cmd.Flags().GetBool("cost")
+	noInstructions, _ := cmd.Flags().GetBool("no-instructions")
+
+	session := newSession()
+
+	return func(messages []llmclient.Message, out io.Writer) (string, error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			return "", err
+		}
+		if !noInstructions {
+			instructions, err := loadProjectInstructions(cfg)
+			if err != nil {
+				return "", err
+			}
+			messages = withSystemSection(messages, instructions)
+		}
+
+		usage := newUsageReporter(cfg, session, modelname)
+
+		cache, err := openResponseCache(cmd, cfg)
+		if err != nil {
+			return "", err
+		}
+
+		var extra map[string]interface{}
+		if out != nil && printCost {
+			extra = map[string]interface{}{"stream_options": map[string]interface{}{"include_usage": true}}
+		}
+
+		ch, err := llmclient.Chat(messages, modelname, seed, temperature, nil, apiKey, apiBase, out != nil, extra, verbose, usage.Record, cache, cfg.Hooks, requestMiddlewares(cfg, modelname)...)
+		if err != nil {
+			return "", err
+		}
+
+		var ret strings.Builder
+		for content := range ch {
+			ret.WriteString(content)
+			if out != nil {
+				io.WriteString(out, content)
+			}
+		}
+
+		if printCost {
+			usage.Print()
+		}
+
+		return ret.String(), nil
+	}
+}
+
+func newLLMCompleter(cmd *cobra.Command) llmCompleteFunc {
+	stream := newLLMStreamer(cmd)
+
+	return func(messages []llmclient.Message) (string, error) {
+		return stream(messages, nil)
+	}
+}
+
+var errNoCodeBlock = errors.New("no code block in model response")
+
+var codeBlockRe = regexp.MustCompile("(?s)```[\\w+#.-]*[ \\t]*\\n(.*?)\\n?```")
+
+// extractCodeBlock returns the longest fenced code block of a model response
+func extractCodeBlock(text string) (string, error) {
+	var best string
+	for _, match := range codeBlockRe.FindAllStringSubmatch(text, -1) {
+		if len(match[1]) > len(best) {
+			best = match[1]
+		}
+	}
+
+	if best == "" {
+		return "", errNoCodeBlock
+	}
+
+	return best + "\n", nil
+}